@@ -0,0 +1,71 @@
+package job
+
+import (
+	"context"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+)
+
+type CodecMaker func(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec
+
+var codecMap = make(map[string]CodecMaker)
+
+func RegisterCodec(typ string, maker CodecMaker) {
+	if _, ok := codecMap[typ]; ok {
+		util.Warn("codec maker [%s] already exists.", typ)
+	} else {
+		codecMap[typ] = maker
+	}
+}
+
+// Codec decodes the raw payload of a source into map[string]interface{} or []map[string]interface{}.
+type Codec interface {
+	Decode(data []byte) (interface{}, error)
+}
+
+// Encoder is implemented by codecs which can also encode payloads, e.g. for producers.
+type Encoder interface {
+	Encode(payload interface{}) ([]byte, error)
+}
+
+func newCodec(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec {
+	if maker, ok := codecMap[conf.Type]; ok {
+		return maker(conf, ctx, log)
+	}
+	util.Warn("codec maker [%s] not found", conf.Type)
+	return nil
+}
+
+// newSourceCodec creates the codec configured by metadata codec/codecConf of a source. nil if not configured.
+func newSourceCodec(conf *SourceConf, ctx context.Context, log *zap.Logger) Codec {
+	typ := conf.Metadata.GetString("codec")
+	if len(typ) == 0 {
+		return nil
+	}
+	codec := newCodec(&CodecConf{Type: typ, Metadata: conf.Metadata.GetKeyValueConf("codecConf")}, ctx, log)
+	if codec == nil {
+		log.Panic("unknown codec for source", zap.String("source", conf.Type), zap.String("codec", typ))
+	}
+	return codec
+}
+
+// decodePayload replaces the raw payload with the decoded one. the raw payload is kept when decode failed.
+func decodePayload(codec Codec, data *TaskData, log *zap.Logger) {
+	if codec == nil {
+		return
+	}
+	var raw []byte
+	switch data.Payload.(type) {
+	case []byte:
+		raw = data.Payload.([]byte)
+	case string:
+		raw = []byte(data.Payload.(string))
+	default:
+		return
+	}
+	if p, e := codec.Decode(raw); e != nil {
+		log.Error("decode payload failed.", zap.String("tag", "Codec"), zap.Error(e), zap.Any("meta", data.Metadata))
+	} else {
+		data.Payload = p
+	}
+}
@@ -0,0 +1,553 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/linkedin/goavro/v2"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterCodec("avro", func(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec {
+		c := &AvroCodec{}
+		c.init(conf, ctx, log)
+		return c
+	})
+}
+
+// AvroCodec decodes avro binary data with the schema loaded from a local file,
+// or confluent wire format data with the schema resolved from the schema registry.
+type AvroCodec struct {
+	conf     *CodecConf
+	log      *zap.Logger
+	schema   *avroSchema
+	registry *SchemaRegistry
+	subject  string
+	mu       sync.RWMutex
+	schemas  map[int]*avroSchema
+	schemaID int
+}
+
+func (ac *AvroCodec) init(conf *CodecConf, ctx context.Context, log *zap.Logger) {
+	ac.conf = conf
+	ac.log = log
+	ac.registry = newCodecRegistry(conf, log)
+	ac.subject = conf.Metadata.GetString("subject")
+	ac.schemas = make(map[int]*avroSchema)
+	file := conf.Metadata.GetString("schema")
+	if len(file) == 0 {
+		if ac.registry == nil {
+			log.Panic("missing schema file or registry config for avro codec", ac.tag())
+		}
+		return
+	}
+	spec, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic("read avro schema file failed", ac.tag(), zap.String("file", file), zap.Error(err))
+	}
+	if ac.schema, err = newAvroSchema(string(spec)); err != nil {
+		log.Panic("parse avro schema failed", ac.tag(), zap.String("file", file), zap.Error(err))
+	}
+}
+
+func (ac *AvroCodec) Decode(data []byte) (interface{}, error) {
+	if ac.registry == nil {
+		return ac.schema.decode(data)
+	}
+	id, payload, err := splitConfluentWire(data)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ac.schemaByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return schema.decode(payload)
+}
+
+// Encode encodes the payload with the local schema file. when registry is used, the local schema is
+// registered under subject, or the latest schema of subject is used, and data is in confluent wire format.
+func (ac *AvroCodec) Encode(payload interface{}) ([]byte, error) {
+	if ac.registry == nil {
+		return ac.schema.encode(payload)
+	}
+	id, schema, err := ac.encodeSchema()
+	if err != nil {
+		return nil, err
+	}
+	data, err := schema.encode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return appendConfluentWire(id, data), nil
+}
+
+func (ac *AvroCodec) schemaByID(id int) (*avroSchema, error) {
+	ac.mu.RLock()
+	schema, ok := ac.schemas[id]
+	ac.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+	rs, err := ac.registry.SchemaByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if rs.Type() != SchemaTypeAvro {
+		return nil, errors.New("schema " + strconv.Itoa(id) + " is not an avro schema but " + rs.Type())
+	}
+	if schema, err = newAvroSchema(rs.Schema); err != nil {
+		return nil, err
+	}
+	ac.mu.Lock()
+	ac.schemas[id] = schema
+	ac.mu.Unlock()
+	return schema, nil
+}
+
+func (ac *AvroCodec) encodeSchema() (int, *avroSchema, error) {
+	ac.mu.RLock()
+	id := ac.schemaID
+	ac.mu.RUnlock()
+	if id > 0 {
+		schema, err := ac.schemaByID(id)
+		return id, schema, err
+	}
+	if len(ac.subject) == 0 {
+		return 0, nil, errors.New("missing subject config for avro encoding with schema registry")
+	}
+	var err error
+	if ac.schema != nil {
+		id, err = ac.registry.Register(ac.subject, &RegistrySchema{Schema: ac.schema.codec.Schema()})
+	} else {
+		var rs *RegistrySchema
+		if rs, err = ac.registry.SchemaBySubject(ac.subject, 0); err == nil {
+			id = rs.ID
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	ac.mu.Lock()
+	ac.schemaID = id
+	if ac.schema != nil {
+		ac.schemas[id] = ac.schema
+	}
+	ac.mu.Unlock()
+	schema, err := ac.schemaByID(id)
+	return id, schema, err
+}
+
+func (ac *AvroCodec) tag() zap.Field {
+	return zap.String("tag", "AvroCodec")
+}
+
+// avroSchema wraps goavro codec, and unwraps the {"type": value} union representation of goavro,
+// so decoded records have the same shape as json payloads.
+type avroSchema struct {
+	codec *goavro.Codec
+	root  interface{}
+	named map[string]interface{}
+}
+
+func newAvroSchema(spec string) (*avroSchema, error) {
+	codec, err := goavro.NewCodec(spec)
+	if err != nil {
+		return nil, err
+	}
+	as := &avroSchema{codec: codec, named: make(map[string]interface{})}
+	if err := jsonApi.UnmarshalFromString(spec, &as.root); err != nil {
+		return nil, err
+	}
+	as.collect(as.root, "")
+	return as, nil
+}
+
+func (as *avroSchema) decode(data []byte) (interface{}, error) {
+	native, _, err := as.codec.NativeFromBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	switch v := as.unwrap(as.root, "", native).(type) {
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		r := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); ok {
+				r = append(r, m)
+			} else {
+				return nil, errors.New("avro array item is not a record")
+			}
+		}
+		return r, nil
+	default:
+		return nil, errors.New("avro payload is neither a record nor an array of records")
+	}
+}
+
+func (as *avroSchema) encode(payload interface{}) ([]byte, error) {
+	if reflect.TypeOf(payload).Kind() == reflect.Ptr {
+		payload = reflect.ValueOf(payload).Elem().Interface()
+	}
+	if items, ok := payload.([]map[string]interface{}); ok {
+		array := make([]interface{}, len(items))
+		for i, item := range items {
+			array[i] = item
+		}
+		payload = array
+	}
+	return as.codec.BinaryFromNative(nil, as.wrap(as.root, "", payload))
+}
+
+// collect registers all named types, so references by name can be resolved while decoding.
+func (as *avroSchema) collect(schema interface{}, ns string) {
+	switch s := schema.(type) {
+	case []interface{}:
+		for _, branch := range s {
+			as.collect(branch, ns)
+		}
+	case map[string]interface{}:
+		switch t := s["type"].(type) {
+		case string:
+			switch t {
+			case "record", "error":
+				full := avroFullName(s, ns)
+				as.named[full] = s
+				for _, f := range avroFields(s) {
+					as.collect(f["type"], avroNamespace(full))
+				}
+			case "enum", "fixed":
+				as.named[avroFullName(s, ns)] = s
+			case "array":
+				as.collect(s["items"], ns)
+			case "map":
+				as.collect(s["values"], ns)
+			}
+		default:
+			as.collect(t, ns)
+		}
+	}
+}
+
+func (as *avroSchema) resolve(name, ns string) (interface{}, bool) {
+	if !strings.Contains(name, ".") && len(ns) > 0 {
+		if def, ok := as.named[ns+"."+name]; ok {
+			return def, true
+		}
+	}
+	def, ok := as.named[name]
+	return def, ok
+}
+
+func (as *avroSchema) unwrap(schema interface{}, ns string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch s := schema.(type) {
+	case string:
+		if def, ok := as.resolve(s, ns); ok {
+			return as.unwrap(def, ns, value)
+		}
+		return value
+	case []interface{}:
+		m, ok := value.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return value
+		}
+		for key, v := range m {
+			for _, branch := range s {
+				if as.match(branch, ns, key) {
+					return as.unwrap(branch, ns, v)
+				}
+			}
+			return v
+		}
+	case map[string]interface{}:
+		switch t := s["type"].(type) {
+		case string:
+			switch t {
+			case "record", "error":
+				record, ok := value.(map[string]interface{})
+				if !ok {
+					return value
+				}
+				child := avroNamespace(avroFullName(s, ns))
+				out := make(map[string]interface{}, len(record))
+				for _, f := range avroFields(s) {
+					name, _ := f["name"].(string)
+					if v, ok := record[name]; ok {
+						out[name] = as.unwrap(f["type"], child, v)
+					}
+				}
+				return out
+			case "array":
+				items, ok := value.([]interface{})
+				if !ok {
+					return value
+				}
+				out := make([]interface{}, len(items))
+				for i, item := range items {
+					out[i] = as.unwrap(s["items"], ns, item)
+				}
+				return out
+			case "map":
+				values, ok := value.(map[string]interface{})
+				if !ok {
+					return value
+				}
+				out := make(map[string]interface{}, len(values))
+				for k, v := range values {
+					out[k] = as.unwrap(s["values"], ns, v)
+				}
+				return out
+			case "enum", "fixed":
+				return value
+			default:
+				if def, ok := as.resolve(t, ns); ok {
+					return as.unwrap(def, ns, value)
+				}
+				return value
+			}
+		default:
+			return as.unwrap(t, ns, value)
+		}
+	}
+	return value
+}
+
+// wrap is the reverse of unwrap, union values are wrapped with the name of the first branch accepting them,
+// and json numbers are converted according to the schema type.
+func (as *avroSchema) wrap(schema interface{}, ns string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch s := schema.(type) {
+	case string:
+		if def, ok := as.resolve(s, ns); ok {
+			return as.wrap(def, ns, value)
+		}
+		return avroPrimitive(s, value)
+	case []interface{}:
+		var fallback interface{}
+		for _, branch := range s {
+			if branch == "null" {
+				continue
+			}
+			if fallback == nil {
+				fallback = branch
+			}
+			if as.accept(branch, ns, value) {
+				return goavro.Union(as.name(branch, ns), as.wrap(branch, ns, value))
+			}
+		}
+		if fallback != nil {
+			return goavro.Union(as.name(fallback, ns), as.wrap(fallback, ns, value))
+		}
+		return value
+	case map[string]interface{}:
+		switch t := s["type"].(type) {
+		case string:
+			switch t {
+			case "record", "error":
+				record, ok := value.(map[string]interface{})
+				if !ok {
+					return value
+				}
+				child := avroNamespace(avroFullName(s, ns))
+				out := make(map[string]interface{}, len(record))
+				for _, f := range avroFields(s) {
+					name, _ := f["name"].(string)
+					if v, ok := record[name]; ok {
+						out[name] = as.wrap(f["type"], child, v)
+					}
+				}
+				return out
+			case "array":
+				items, ok := value.([]interface{})
+				if !ok {
+					return value
+				}
+				out := make([]interface{}, len(items))
+				for i, item := range items {
+					out[i] = as.wrap(s["items"], ns, item)
+				}
+				return out
+			case "map":
+				values, ok := value.(map[string]interface{})
+				if !ok {
+					return value
+				}
+				out := make(map[string]interface{}, len(values))
+				for k, v := range values {
+					out[k] = as.wrap(s["values"], ns, v)
+				}
+				return out
+			case "enum", "fixed":
+				return value
+			default:
+				if def, ok := as.resolve(t, ns); ok {
+					return as.wrap(def, ns, value)
+				}
+				return avroPrimitive(t, value)
+			}
+		default:
+			return as.wrap(t, ns, value)
+		}
+	}
+	return value
+}
+
+// accept checks whether the value could be encoded as the branch type.
+func (as *avroSchema) accept(branch interface{}, ns string, value interface{}) bool {
+	t := ""
+	switch b := branch.(type) {
+	case string:
+		if def, ok := as.resolve(b, ns); ok {
+			return as.accept(def, ns, value)
+		}
+		t = b
+	case map[string]interface{}:
+		switch bt := b["type"].(type) {
+		case string:
+			t = bt
+		default:
+			return as.accept(bt, ns, value)
+		}
+	}
+	switch value.(type) {
+	case map[string]interface{}:
+		return t == "record" || t == "error" || t == "map"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string" || t == "enum"
+	case []byte:
+		return t == "bytes" || t == "fixed"
+	case bool:
+		return t == "boolean"
+	case float32, float64:
+		return t == "float" || t == "double"
+	case json.Number:
+		if _, err := value.(json.Number).Int64(); err == nil {
+			return t == "int" || t == "long" || t == "float" || t == "double"
+		}
+		return t == "float" || t == "double"
+	case time.Time:
+		return t == "long" || t == "int"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return t == "int" || t == "long"
+	}
+	return false
+}
+
+// name returns the union key of the branch used by goavro.
+func (as *avroSchema) name(branch interface{}, ns string) string {
+	switch b := branch.(type) {
+	case string:
+		if def, ok := as.resolve(b, ns); ok {
+			return as.name(def, ns)
+		}
+		return b
+	case map[string]interface{}:
+		switch t := b["type"].(type) {
+		case string:
+			switch t {
+			case "record", "error", "enum", "fixed":
+				return avroFullName(b, ns)
+			}
+			if lt, _ := b["logicalType"].(string); len(lt) > 0 {
+				return t + "." + lt
+			}
+			return t
+		default:
+			return as.name(t, ns)
+		}
+	}
+	return ""
+}
+
+// avroPrimitive converts json numbers, which goavro does not accept.
+func avroPrimitive(t string, value interface{}) interface{} {
+	n, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	switch t {
+	case "int", "long":
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+	case "float", "double":
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return value
+}
+
+// match checks whether the union key produced by goavro names the branch.
+// goavro uses full names for named types, and suffixes logical types, e.g. long.timestamp-millis
+func (as *avroSchema) match(branch interface{}, ns, key string) bool {
+	name := ""
+	switch b := branch.(type) {
+	case string:
+		if def, ok := as.resolve(b, ns); ok {
+			return as.match(def, ns, key)
+		}
+		name = b
+	case map[string]interface{}:
+		switch t := b["type"].(type) {
+		case string:
+			switch t {
+			case "record", "error", "enum", "fixed":
+				full := avroFullName(b, ns)
+				return key == full || key == full[strings.LastIndex(full, ".")+1:]
+			default:
+				name = t
+			}
+		default:
+			return as.match(t, ns, key)
+		}
+	}
+	return key == name || strings.HasPrefix(key, name+".")
+}
+
+func avroFields(record map[string]interface{}) []map[string]interface{} {
+	fields, _ := record["fields"].([]interface{})
+	r := make([]map[string]interface{}, 0, len(fields))
+	for _, f := range fields {
+		if m, ok := f.(map[string]interface{}); ok {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+func avroFullName(named map[string]interface{}, ns string) string {
+	name, _ := named["name"].(string)
+	if strings.Contains(name, ".") {
+		return name
+	}
+	if n, _ := named["namespace"].(string); len(n) > 0 {
+		return n + "." + name
+	}
+	if len(ns) > 0 {
+		return ns + "." + name
+	}
+	return name
+}
+
+func avroNamespace(full string) string {
+	if i := strings.LastIndex(full, "."); i > 0 {
+		return full[:i]
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"unicode/utf8"
+)
+
+func init() {
+	RegisterCodec("csv", func(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec {
+		c := &CsvCodec{}
+		c.init(conf, ctx, log)
+		return c
+	})
+}
+
+// CsvCodec decodes csv records into maps keyed by column name.
+// a payload with a single record becomes a map, otherwise []map.
+type CsvCodec struct {
+	conf      *CodecConf
+	log       *zap.Logger
+	columns   []string
+	header    bool
+	delimiter rune
+	comment   rune
+}
+
+func (cc *CsvCodec) init(conf *CodecConf, ctx context.Context, log *zap.Logger) {
+	cc.conf = conf
+	cc.log = log
+	cc.columns = conf.Metadata.GetStringSlice("columns")
+	cc.header = conf.Metadata.GetBool("header")
+	cc.delimiter = ','
+	if d := conf.Metadata.GetString("delimiter"); len(d) > 0 {
+		cc.delimiter, _ = utf8.DecodeRuneInString(d)
+	}
+	if c := conf.Metadata.GetString("comment"); len(c) > 0 {
+		cc.comment, _ = utf8.DecodeRuneInString(c)
+	}
+	if len(cc.columns) == 0 && !cc.header {
+		log.Panic("csv codec need columns or header config", cc.tag())
+	}
+}
+
+func (cc *CsvCodec) Decode(data []byte) (interface{}, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = cc.delimiter
+	reader.Comment = cc.comment
+	reader.FieldsPerRecord = -1
+	columns := cc.columns
+	headerRead := !cc.header
+	rows := make([]map[string]interface{}, 0)
+	for {
+		record, e := reader.Read()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return nil, e
+		}
+		if !headerRead {
+			headerRead = true
+			if len(columns) == 0 {
+				columns = record
+			}
+			continue
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			if i < len(record) {
+				row[col] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	switch len(rows) {
+	case 0:
+		return nil, errors.New("no csv record found")
+	case 1:
+		return rows[0], nil
+	default:
+		return rows, nil
+	}
+}
+
+func (cc *CsvCodec) tag() zap.Field {
+	return zap.String("tag", "CsvCodec")
+}
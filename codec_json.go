@@ -0,0 +1,28 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterCodec("json", func(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec {
+		return &JsonCodec{}
+	})
+}
+
+// JsonCodec decodes a json object into map, or a json array into []map.
+type JsonCodec struct {
+}
+
+func (jc *JsonCodec) Decode(data []byte) (interface{}, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		p := make([]map[string]interface{}, 0)
+		err := jsonApi.Unmarshal(trimmed, &p)
+		return p, err
+	}
+	p := make(map[string]interface{})
+	err := jsonApi.Unmarshal(data, &p)
+	return p, err
+}
@@ -0,0 +1,42 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterCodec("msgpack", func(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec {
+		return &MsgPackCodec{}
+	})
+}
+
+// MsgPackCodec decodes a message pack map into map, or an array of maps into []map.
+type MsgPackCodec struct {
+}
+
+func (mc *MsgPackCodec) Decode(data []byte) (interface{}, error) {
+	var v interface{}
+	if e := msgpack.Unmarshal(data, &v); e != nil {
+		return nil, e
+	}
+	switch v.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		items := v.([]interface{})
+		r := make([]map[string]interface{}, 0, len(items))
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				r = append(r, m)
+			} else {
+				return nil, errors.New("message pack array item is not a map")
+			}
+		}
+		return r, nil
+	default:
+		return nil, errors.New("message pack payload is neither a map nor an array")
+	}
+}
@@ -0,0 +1,256 @@
+package job
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/ioutil"
+	"strconv"
+	"sync"
+)
+
+func init() {
+	RegisterCodec("protobuf", func(conf *CodecConf, ctx context.Context, log *zap.Logger) Codec {
+		c := &ProtobufCodec{}
+		c.init(conf, ctx, log)
+		return c
+	})
+}
+
+// ProtobufCodec decodes protobuf messages with the descriptor set generated by
+// protoc --include_imports --descriptor_set_out, or confluent wire format messages
+// with the schema resolved from the schema registry.
+type ProtobufCodec struct {
+	conf     *CodecConf
+	log      *zap.Logger
+	message  protoreflect.MessageDescriptor
+	registry *SchemaRegistry
+	mu       sync.RWMutex
+	files    map[int]protoreflect.FileDescriptor
+}
+
+func (pc *ProtobufCodec) init(conf *CodecConf, ctx context.Context, log *zap.Logger) {
+	pc.conf = conf
+	pc.log = log
+	pc.registry = newCodecRegistry(conf, log)
+	pc.files = make(map[int]protoreflect.FileDescriptor)
+	if pc.registry != nil {
+		return
+	}
+	file := conf.Metadata.GetString("descriptor")
+	message := conf.Metadata.GetString("message")
+	if len(file) == 0 || len(message) == 0 {
+		log.Panic("missing descriptor or message config for protobuf codec", pc.tag())
+	}
+	files, err := loadProtoDescriptorSet(file)
+	if err != nil {
+		log.Panic("load protobuf descriptor set failed", pc.tag(), zap.String("file", file), zap.Error(err))
+	}
+	if d, err := files.FindDescriptorByName(protoreflect.FullName(message)); err != nil {
+		log.Panic("protobuf message not found in descriptor set", pc.tag(), zap.String("message", message), zap.Error(err))
+	} else if md, ok := d.(protoreflect.MessageDescriptor); ok {
+		pc.message = md
+	} else {
+		log.Panic("protobuf descriptor is not a message", pc.tag(), zap.String("message", message))
+	}
+}
+
+func (pc *ProtobufCodec) Decode(data []byte) (interface{}, error) {
+	if pc.registry == nil {
+		return decodeProtoMessage(pc.message, data)
+	}
+	id, payload, err := splitConfluentWire(data)
+	if err != nil {
+		return nil, err
+	}
+	indexes, payload, err := readProtoMessageIndexes(payload)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := pc.fileByID(id)
+	if err != nil {
+		return nil, err
+	}
+	md, err := protoMessageByIndexes(fd, indexes)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProtoMessage(md, payload)
+}
+
+func (pc *ProtobufCodec) fileByID(id int) (protoreflect.FileDescriptor, error) {
+	pc.mu.RLock()
+	fd, ok := pc.files[id]
+	pc.mu.RUnlock()
+	if ok {
+		return fd, nil
+	}
+	rs, err := pc.registry.SchemaByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if rs.Type() != SchemaTypeProtobuf {
+		return nil, errors.New("schema " + strconv.Itoa(id) + " is not a protobuf schema but " + rs.Type())
+	}
+	refs, err := pc.registry.References(rs)
+	if err != nil {
+		return nil, err
+	}
+	if fd, err = compileProtoSchema(rs.Schema, refs); err != nil {
+		return nil, err
+	}
+	pc.mu.Lock()
+	pc.files[id] = fd
+	pc.mu.Unlock()
+	return fd, nil
+}
+
+func (pc *ProtobufCodec) tag() zap.Field {
+	return zap.String("tag", "ProtobufCodec")
+}
+
+func loadProtoDescriptorSet(file string) (*protoregistry.Files, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	return protodesc.NewFiles(set)
+}
+
+// compileProtoSchema compiles the proto source with its referenced sources keyed by import path.
+func compileProtoSchema(schema string, refs map[string]string) (protoreflect.FileDescriptor, error) {
+	const name = "registry_schema.proto"
+	sources := map[string]string{name: schema}
+	for k, v := range refs {
+		sources[k] = v
+	}
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(sources)}
+	parsed, err := parser.ParseFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	visited := make(map[string]bool)
+	var collect func(fd *desc.FileDescriptor)
+	collect = func(fd *desc.FileDescriptor) {
+		if visited[fd.GetName()] {
+			return
+		}
+		visited[fd.GetName()] = true
+		for _, dep := range fd.GetDependencies() {
+			collect(dep)
+		}
+		set.File = append(set.File, fd.AsFileDescriptorProto())
+	}
+	collect(parsed[0])
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	return files.FindFileByPath(name)
+}
+
+// readProtoMessageIndexes reads the zigzag varint encoded message indexes of confluent wire format,
+// a single 0 is the shortcut of the first message.
+func readProtoMessageIndexes(data []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, nil, errors.New("read protobuf message indexes failed")
+	}
+	data = data[n:]
+	if count == 0 {
+		return []int{0}, data, nil
+	}
+	indexes := make([]int, count)
+	for i := range indexes {
+		index, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, nil, errors.New("read protobuf message indexes failed")
+		}
+		indexes[i] = int(index)
+		data = data[n:]
+	}
+	return indexes, data, nil
+}
+
+func protoMessageByIndexes(fd protoreflect.FileDescriptor, indexes []int) (protoreflect.MessageDescriptor, error) {
+	messages := fd.Messages()
+	var md protoreflect.MessageDescriptor
+	for _, index := range indexes {
+		if index < 0 || index >= messages.Len() {
+			return nil, errors.New("protobuf message index out of range")
+		}
+		md = messages.Get(index)
+		messages = md.Messages()
+	}
+	return md, nil
+}
+
+func decodeProtoMessage(md protoreflect.MessageDescriptor, data []byte) (map[string]interface{}, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return protoMessageToMap(msg), nil
+}
+
+// protoMessageToMap converts the message to map keyed by the proto field names, enums are converted to their names.
+func protoMessageToMap(msg protoreflect.Message) map[string]interface{} {
+	fields := msg.Descriptor().Fields()
+	m := make(map[string]interface{}, fields.Len())
+	// every field is set, zero values of proto3 included, so all messages have the same keys
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.HasPresence() && !msg.Has(fd) {
+			m[string(fd.Name())] = nil
+			continue
+		}
+		v := msg.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			items := make([]interface{}, list.Len())
+			for j := 0; j < list.Len(); j++ {
+				items[j] = protoValue(fd, list.Get(j))
+			}
+			m[string(fd.Name())] = items
+		case fd.IsMap():
+			entries := make(map[string]interface{})
+			v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+				entries[k.String()] = protoValue(fd.MapValue(), mv)
+				return true
+			})
+			m[string(fd.Name())] = entries
+		default:
+			m[string(fd.Name())] = protoValue(fd, v)
+		}
+	}
+	return m
+}
+
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoMessageToMap(v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int32(v.Enum())
+	default:
+		return v.Interface()
+	}
+}
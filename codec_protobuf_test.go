@@ -0,0 +1,48 @@
+package job
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testProtoSchema = `syntax = "proto3";
+message Player {
+  int64 id = 1;
+  string name = 2;
+  repeated string tags = 3;
+  Profile profile = 4;
+  optional int32 level = 5;
+}
+message Profile {
+  bool vip = 1;
+}`
+
+func TestProtoMessageToMapKeepsZeroValues(t *testing.T) {
+	fd, err := compileProtoSchema(testProtoSchema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := fd.Messages().ByName("Player")
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("name"), protoreflect.ValueOfString("a"))
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decodeProtoMessage(md, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 5 {
+		t.Fatalf("got %v, want all 5 fields", m)
+	}
+	if m["id"] != int64(0) || m["name"] != "a" || m["profile"] != nil || m["level"] != nil {
+		t.Fatalf("unexpected values %v", m)
+	}
+	if tags, ok := m["tags"].([]interface{}); !ok || len(tags) != 0 {
+		t.Fatalf("tags %v, want an empty list", m["tags"])
+	}
+}
@@ -1,6 +1,7 @@
 package job
 
 import (
+	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/ywengineer/g-util/util"
 	"gopkg.in/yaml.v2"
@@ -94,6 +95,28 @@ func (src *KeyValueConf) GetStringSlice(key string) []string {
 	return nil
 }
 
+// GetKeyValueConf returns the nested conf of key, both yaml and json decoded maps are accepted.
+func (src *KeyValueConf) GetKeyValueConf(key string) KeyValueConf {
+	r := make(KeyValueConf)
+	if v, ok := (*src)[key]; ok {
+		switch v.(type) {
+		case map[interface{}]interface{}:
+			for k, kv := range v.(map[interface{}]interface{}) {
+				r[fmt.Sprint(k)] = kv
+			}
+		case map[string]interface{}:
+			for k, kv := range v.(map[string]interface{}) {
+				r[k] = kv
+			}
+		case KeyValueConf:
+			for k, kv := range v.(KeyValueConf) {
+				r[k] = kv
+			}
+		}
+	}
+	return r
+}
+
 func (src *KeyValueConf) Contains(key string) bool {
 	_, ok := (*src)[key]
 	return ok
@@ -133,3 +156,36 @@ type FilterConf struct {
 	Type     string       `json:"type" yaml:"type"`
 	Metadata KeyValueConf `json:"metadata" yaml:"metadata"`
 }
+
+type CodecConf struct {
+	Type     string       `json:"type" yaml:"type"`
+	Metadata KeyValueConf `json:"metadata" yaml:"metadata"`
+}
+
+// plainValue deep copies v, yaml decoded maps are converted to map[string]interface{} like json decoded ones.
+func plainValue(v interface{}) interface{} {
+	switch v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, mv := range v.(map[interface{}]interface{}) {
+			m[fmt.Sprint(k)] = plainValue(mv)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+		for k, mv := range v.(map[string]interface{}) {
+			m[k] = plainValue(mv)
+		}
+		return m
+	case KeyValueConf:
+		return plainValue(map[string]interface{}(v.(KeyValueConf)))
+	case []interface{}:
+		s := make([]interface{}, len(v.([]interface{})))
+		for i, sv := range v.([]interface{}) {
+			s[i] = plainValue(sv)
+		}
+		return s
+	default:
+		return v
+	}
+}
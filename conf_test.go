@@ -0,0 +1,11 @@
+package job
+
+import "testing"
+
+func TestGetKeyValueConfNonStringKeys(t *testing.T) {
+	conf := KeyValueConf{"m": map[interface{}]interface{}{1: "a", "b": 2}}
+	m := conf.GetKeyValueConf("m")
+	if m["1"] != "a" || m["b"] != 2 {
+		t.Fatalf("got %v", m)
+	}
+}
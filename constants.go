@@ -1,7 +1,14 @@
 package job
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+	"github.com/nats-io/nats.go"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/ywengineer/g-util/client"
 	"github.com/ywengineer/g-util/es"
@@ -9,12 +16,67 @@ import (
 	"github.com/ywengineer/g-util/util"
 	"go.uber.org/zap"
 	"go.uber.org/zap/buffer"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 var transport = client.NewFastHttpTransport()
 
+// roundTrip sends req by the shared transport, and returns the status code and the response body.
+func roundTrip(req *http.Request) (int, []byte, error) {
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, body, err
+}
+
+// roundTripContext sends req by the shared transport, which ignores the request context. the response is abandoned
+// once the context is done, e.g. by a deadline, the transport itself gives up reading a response after 2 seconds.
+func roundTripContext(req *http.Request) (int, []byte, error) {
+	type response struct {
+		status int
+		body   []byte
+		err    error
+	}
+	ch := make(chan response, 1)
+	go func() {
+		status, body, err := roundTrip(req)
+		ch <- response{status: status, body: body, err: err}
+	}()
+	select {
+	case res := <-ch:
+		return res.status, res.body, res.err
+	case <-req.Context().Done():
+		return 0, nil, req.Context().Err()
+	}
+}
+
+// newHttpClient returns a client honoring timeout and the request context, which the shared transport ignores.
+func newHttpClient(timeout time.Duration, tlsConf KeyValueConf, log *zap.Logger) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = newTLSConfig(tlsConf, log)
+	return &http.Client{Timeout: timeout, Transport: tr}
+}
+
+// doRequest sends req by client, and returns the status code and the response body.
+func doRequest(client *http.Client, req *http.Request) (int, []byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return res.StatusCode, body, err
+}
+
 ///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 const MetaSnowflakeID = "sf-id"
 
@@ -26,6 +88,7 @@ var jsonApi = jsoniter.Config{UseNumber: true, EscapeHTML: true}.Froze()
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 var _es *esapi.API
+var _esAddress []string
 var esMutex = sync.Mutex{}
 
 const ConfAddress = "address"
@@ -34,9 +97,10 @@ func SetGlobalES(conf KeyValueConf, log *zap.Logger) {
 	esMutex.Lock()
 	defer esMutex.Unlock()
 	if _es == nil && conf.Contains(ConfAddress) {
-		_es = es.NewESClient(conf.GetStringSlice(ConfAddress), log)
+		_esAddress = conf.GetStringSlice(ConfAddress)
+		_es = es.NewESClient(_esAddress, log)
 	} else {
-		util.Error("global elastic client already exists.", mysql.String())
+		util.Error("global elastic client already exists.")
 	}
 }
 
@@ -56,8 +120,202 @@ func SetGlobalMySQL(conf KeyValueConf, log *zap.Logger) {
 	if mysql == nil {
 		mysql = newMySQLClient(conf, log)
 	} else {
-		util.Error("global mysql client already exists.", mysql.String())
+		util.Error("global mysql client already exists. %s", mysql.String())
 	}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// newRedisClient creates a single node, sentinel (masterName set) or cluster (several addresses) client.
+func newRedisClient(conf KeyValueConf, log *zap.Logger) redis.UniversalClient {
+	var address []string
+	if a, ok := conf[ConfAddress].(string); ok {
+		address = []string{a}
+	} else {
+		address = conf.GetStringSlice(ConfAddress)
+	}
+	if len(address) == 0 {
+		log.Panic("missing address config for redis client")
+	}
+	c := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:        address,
+		Username:     conf.GetString("user"),
+		Password:     conf.GetString("password"),
+		DB:           conf.GetInt("db"),
+		MasterName:   conf.GetString("masterName"),
+		PoolSize:     conf.GetInt("poolSize"),
+		DialTimeout:  time.Duration(conf.GetInt("dialTimeout")) * time.Second,
+		ReadTimeout:  time.Duration(conf.GetInt("readTimeout")) * time.Second,
+		WriteTimeout: time.Duration(conf.GetInt("writeTimeout")) * time.Second,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx).Err(); err != nil {
+		log.Panic("Error creating redis client", zap.Strings("address", address), zap.Error(err))
+	}
+	return c
+}
+
+var _redis redis.UniversalClient
+var redisMutex = sync.Mutex{}
+
+func SetGlobalRedis(conf KeyValueConf, log *zap.Logger) {
+	redisMutex.Lock()
+	defer redisMutex.Unlock()
+	if _redis == nil {
+		_redis = newRedisClient(conf, log)
+	} else {
+		util.Error("global redis client already exists.")
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func newNatsConn(conf KeyValueConf, log *zap.Logger) *nats.Conn {
+	var address []string
+	if a, ok := conf[ConfAddress].(string); ok {
+		address = []string{a}
+	} else {
+		address = conf.GetStringSlice(ConfAddress)
+	}
+	if len(address) == 0 {
+		address = []string{nats.DefaultURL}
+	}
+	opts := []nats.Option{
+		nats.Name(conf.GetStringOrDefault("name", "chain-job")),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			log.Warn("nats disconnected", zap.Error(err))
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info("nats reconnected", zap.String("url", c.ConnectedUrl()))
+		}),
+	}
+	if user := conf.GetString("user"); len(user) > 0 {
+		opts = append(opts, nats.UserInfo(user, conf.GetString("password")))
+	}
+	if token := conf.GetString("token"); len(token) > 0 {
+		opts = append(opts, nats.Token(token))
+	}
+	nc, err := nats.Connect(strings.Join(address, ","), opts...)
+	if err != nil {
+		log.Panic("Error creating nats connection", zap.Strings("address", address), zap.Error(err))
+	}
+	return nc
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// newTLSConfig builds a tls config from the ca, cert, key and insecureSkipVerify options. nil if conf is empty.
+func newTLSConfig(conf KeyValueConf, log *zap.Logger) *tls.Config {
+	if len(conf) == 0 {
+		return nil
+	}
+	tc := &tls.Config{
+		InsecureSkipVerify: conf.GetBool("insecureSkipVerify"),
+		ServerName:         conf.GetString("serverName"),
+	}
+	if ca := conf.GetString("ca"); len(ca) > 0 {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			log.Panic("read tls ca file failed", zap.String("ca", ca), zap.Error(err))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			log.Panic("no certificate found in tls ca file", zap.String("ca", ca))
+		}
+		tc.RootCAs = pool
+		tc.ClientCAs = pool
+	}
+	if cert := conf.GetString("cert"); len(cert) > 0 {
+		pair, err := tls.LoadX509KeyPair(cert, conf.GetString("key"))
+		if err != nil {
+			log.Panic("load tls key pair failed", zap.String("cert", cert), zap.Error(err))
+		}
+		tc.Certificates = []tls.Certificate{pair}
+	}
+	return tc
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// newPostgresClient connects by dsn, or by host, port, user, password, db and sslmode.
+func newPostgresClient(conf KeyValueConf, log *zap.Logger) *sqlx.DB {
+	dsn := conf.GetString("dsn")
+	if len(dsn) == 0 {
+		var opts []string
+		escape := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+		for _, k := range [][2]string{{"host", "host"}, {"port", "port"}, {"user", "user"}, {"password", "password"}, {"db", "dbname"}, {"sslmode", "sslmode"}} {
+			if v, ok := conf[k[0]]; ok && v != nil {
+				opts = append(opts, k[1]+"='"+escape.Replace(fmt.Sprint(v))+"'")
+			}
+		}
+		if t := conf.GetInt("dialTimeout"); t > 0 {
+			opts = append(opts, "connect_timeout="+strconv.Itoa(t))
+		}
+		dsn = strings.Join(opts, " ")
+	}
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		log.Panic("Error creating postgres client", zap.Error(err))
+	}
+	db.SetMaxOpenConns(conf.GetInt("maxOpenConn"))
+	db.SetMaxIdleConns(conf.GetInt("maxIdleConn"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		log.Panic("Error creating postgres client", zap.String("host", conf.GetString("host")), zap.Error(err))
+	}
+	return db
+}
+
+var _postgres *sqlx.DB
+var postgresMutex = sync.Mutex{}
+
+func SetGlobalPostgres(conf KeyValueConf, log *zap.Logger) {
+	postgresMutex.Lock()
+	defer postgresMutex.Unlock()
+	if _postgres == nil {
+		_postgres = newPostgresClient(conf, log)
+	} else {
+		util.Error("global postgres client already exists.")
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// newSQLiteClient opens the database file of path, in wal mode unless wal is false.
+// one connection is used, sqlite allows a single writer.
+func newSQLiteClient(conf KeyValueConf, log *zap.Logger) *sqlx.DB {
+	path := conf.GetString("path")
+	if len(path) == 0 {
+		log.Panic("missing path config for sqlite client")
+	}
+	busy := conf.GetInt("busyTimeout")
+	if busy <= 0 {
+		busy = 5000
+	}
+	params := []string{"_busy_timeout=" + strconv.Itoa(busy), "_synchronous=" + conf.GetStringOrDefault("synchronous", "NORMAL")}
+	if !conf.Contains("wal") || conf.GetBool("wal") {
+		params = append(params, "_journal_mode=WAL")
+	}
+	db, err := sqlx.Open("sqlite3", "file:"+path+"?"+strings.Join(params, "&"))
+	if err != nil {
+		log.Panic("Error creating sqlite client", zap.String("path", path), zap.Error(err))
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		log.Panic("Error creating sqlite client", zap.String("path", path), zap.Error(err))
+	}
+	return db
+}
+
+var _sqlite *sqlx.DB
+var sqliteMutex = sync.Mutex{}
+
+func SetGlobalSQLite(conf KeyValueConf, log *zap.Logger) {
+	sqliteMutex.Lock()
+	defer sqliteMutex.Unlock()
+	if _sqlite == nil {
+		_sqlite = newSQLiteClient(conf, log)
+	} else {
+		util.Error("global sqlite client already exists.")
+	}
+}
@@ -25,7 +25,7 @@ func SetGlobalSnowflakeInfo(center, machine uint64) {
 	if gsf == nil {
 		gsf, _ = pro.NewWorker(center, machine)
 	} else {
-		util.Error("global snowflake worker already exists.", gsf.String())
+		util.Error("global snowflake worker already exists. %s", gsf.String())
 	}
 }
 
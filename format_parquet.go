@@ -0,0 +1,545 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ParquetString    = "string"
+	ParquetBytes     = "bytes"
+	ParquetInt32     = "int32"
+	ParquetInt64     = "int64"
+	ParquetFloat     = "float"
+	ParquetDouble    = "double"
+	ParquetBoolean   = "boolean"
+	ParquetTimestamp = "timestamp"
+	ParquetList      = "list"
+	ParquetGroup     = "group"
+)
+
+// parquetField is a column of a parquet schema. a list has an element, a group has fields.
+type parquetField struct {
+	key    string
+	name   string
+	typ    string
+	elem   *parquetField
+	fields []*parquetField
+}
+
+// parquetFormat encodes []map[string]interface{} payloads into parquet files for sinks writing files.
+// the schema is configured by field types, e.g. {id: int64, tags: [string], profile: {level: int32}},
+// or inferred from the first batch. a value is converted to the type of its column, unknown fields are dropped
+// with a warning once per field. a row group is buffered in memory, so its size is capped by the maxSize of files.
+type parquetFormat struct {
+	log          *zap.Logger
+	schema       *parquetField
+	unknown      map[string]bool
+	jsonSchema   string
+	compression  parquet.CompressionCodec
+	rowGroupSize int64
+	pageSize     int64
+}
+
+func newParquetFormat(conf KeyValueConf, maxSize int64, log *zap.Logger) *parquetFormat {
+	pf := &parquetFormat{log: log, unknown: make(map[string]bool)}
+	switch c := conf.GetStringOrDefault("compression", "snappy"); c {
+	case "snappy":
+		pf.compression = parquet.CompressionCodec_SNAPPY
+	case "zstd":
+		pf.compression = parquet.CompressionCodec_ZSTD
+	case "gzip":
+		pf.compression = parquet.CompressionCodec_GZIP
+	case "none":
+		pf.compression = parquet.CompressionCodec_UNCOMPRESSED
+	default:
+		log.Panic("unsupported parquet compression", pf.tag(), zap.String("compression", c))
+	}
+	pf.rowGroupSize = conf.GetInt64("rowGroupSize")
+	if pf.rowGroupSize <= 0 {
+		pf.rowGroupSize = 128 << 20
+	}
+	if maxSize > 0 && pf.rowGroupSize > maxSize {
+		pf.rowGroupSize = maxSize
+	}
+	pf.pageSize = conf.GetInt64("pageSize")
+	if pf.pageSize <= 0 {
+		pf.pageSize = 8 << 10
+	}
+	if conf.Contains("schema") {
+		fields, err := parquetSchemaOf(plainValue(conf["schema"]))
+		if err != nil {
+			log.Panic("bad parquet schema config", pf.tag(), zap.Error(err))
+		}
+		pf.setSchema(fields)
+	}
+	return pf
+}
+
+// infer sets the schema from the map items of the first batch if not configured.
+func (pf *parquetFormat) infer(items []interface{}) error {
+	if pf.schema != nil {
+		return nil
+	}
+	root := &parquetField{typ: ParquetGroup}
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			root = parquetMerge(root, parquetInfer(m))
+		}
+	}
+	if len(root.fields) == 0 {
+		return errors.New("parquet schema can not be inferred without map payloads")
+	}
+	pf.setSchema(root.fields)
+	pf.log.Info("parquet schema inferred", pf.tag(), zap.String("schema", pf.jsonSchema))
+	return nil
+}
+
+func (pf *parquetFormat) setSchema(fields []*parquetField) {
+	pf.schema = &parquetField{name: "parquet_go_root", typ: ParquetGroup, fields: fields}
+	root := map[string]interface{}{"Tag": "name=parquet_go_root, repetitiontype=REQUIRED", "Fields": parquetTags(fields)}
+	s, _ := jsonApi.MarshalToString(root)
+	pf.jsonSchema = s
+}
+
+// encode converts a map item to a json row of the schema, the rows are written by the writer.
+func (pf *parquetFormat) encode(item interface{}) ([]byte, error) {
+	if pf.schema == nil {
+		return nil, errors.New("parquet schema not set")
+	}
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("parquet format requires map payloads")
+	}
+	row, err := parquetValue(pf.schema, m)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range parquetUnknown(pf.schema, m, "") {
+		if !pf.unknown[key] {
+			pf.unknown[key] = true
+			pf.log.Warn("field not in parquet schema dropped", pf.tag(), zap.String("field", key))
+		}
+	}
+	data, err := jsonApi.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writer returns a writer of one parquet file, each write is a row from encode. the footer is written by Close.
+func (pf *parquetFormat) writer(w io.Writer) (io.WriteCloser, error) {
+	if pf.schema == nil {
+		return nil, errors.New("parquet schema not set")
+	}
+	pw, err := writer.NewJSONWriterFromWriter(pf.jsonSchema, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = pf.compression
+	pw.RowGroupSize = pf.rowGroupSize
+	pw.PageSize = pf.pageSize
+	return &parquetWriter{pw: pw}, nil
+}
+
+func (pf *parquetFormat) tag() zap.Field {
+	return zap.String("tag", "ParquetFormat")
+}
+
+type parquetWriter struct {
+	pw *writer.JSONWriter
+}
+
+func (w *parquetWriter) Write(p []byte) (int, error) {
+	if err := w.pw.Write(strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *parquetWriter) Close() error {
+	return w.pw.WriteStop()
+}
+
+// parquetSchemaOf parses the configured fields. a type is a name, a list of one element type or a map of fields.
+func parquetSchemaOf(v interface{}) ([]*parquetField, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil, errors.New("schema must be a map of fields")
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]*parquetField, 0, len(keys))
+	for _, k := range keys {
+		f, err := parquetFieldOf(k, m[k])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func parquetFieldOf(key string, v interface{}) (*parquetField, error) {
+	f := &parquetField{key: key, name: parquetName(key)}
+	switch t := plainValue(v).(type) {
+	case string:
+		f.typ = strings.ToLower(t)
+		switch f.typ {
+		case ParquetString, ParquetBytes, ParquetInt32, ParquetInt64, ParquetFloat, ParquetDouble, ParquetBoolean, ParquetTimestamp:
+		default:
+			return nil, fmt.Errorf("unsupported type %s of field %s", t, key)
+		}
+	case []interface{}:
+		if len(t) != 1 {
+			return nil, fmt.Errorf("list field %s must have one element type", key)
+		}
+		elem, err := parquetFieldOf("element", t[0])
+		if err != nil {
+			return nil, err
+		}
+		f.typ, f.elem = ParquetList, elem
+	case map[string]interface{}:
+		fields, err := parquetSchemaOf(t)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", key, err)
+		}
+		f.typ, f.fields = ParquetGroup, fields
+	default:
+		return nil, fmt.Errorf("bad type of field %s", key)
+	}
+	return f, nil
+}
+
+// parquetName replaces the characters of a field name which break the schema tags.
+func parquetName(key string) string {
+	return strings.NewReplacer(",", "_", "=", "_").Replace(key)
+}
+
+func parquetTags(fields []*parquetField) []interface{} {
+	tags := make([]interface{}, len(fields))
+	for i, f := range fields {
+		tags[i] = parquetTag(f)
+	}
+	return tags
+}
+
+func parquetTag(f *parquetField) map[string]interface{} {
+	tag := "name=" + f.name
+	switch f.typ {
+	case ParquetString:
+		tag += ", type=BYTE_ARRAY, convertedtype=UTF8"
+	case ParquetBytes:
+		tag += ", type=BYTE_ARRAY"
+	case ParquetInt32:
+		tag += ", type=INT32"
+	case ParquetInt64:
+		tag += ", type=INT64"
+	case ParquetFloat:
+		tag += ", type=FLOAT"
+	case ParquetDouble:
+		tag += ", type=DOUBLE"
+	case ParquetBoolean:
+		tag += ", type=BOOLEAN"
+	case ParquetTimestamp:
+		tag += ", type=INT64, convertedtype=TIMESTAMP_MILLIS"
+	case ParquetList:
+		tag += ", type=LIST"
+	}
+	m := map[string]interface{}{"Tag": tag + ", repetitiontype=OPTIONAL"}
+	switch f.typ {
+	case ParquetList:
+		m["Fields"] = []interface{}{parquetTag(f.elem)}
+	case ParquetGroup:
+		m["Fields"] = parquetTags(f.fields)
+	}
+	return m
+}
+
+// parquetInfer returns the field of a value, nil if its type is unknown.
+func parquetInfer(v interface{}) *parquetField {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return &parquetField{typ: ParquetString}
+	case []byte:
+		return &parquetField{typ: ParquetBytes}
+	case bool:
+		return &parquetField{typ: ParquetBoolean}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return &parquetField{typ: ParquetInt64}
+	case float32, float64:
+		return &parquetField{typ: ParquetDouble}
+	case json.Number:
+		if strings.ContainsAny(string(t), ".eE") {
+			return &parquetField{typ: ParquetDouble}
+		}
+		return &parquetField{typ: ParquetInt64}
+	case time.Time:
+		return &parquetField{typ: ParquetTimestamp}
+	case map[string]interface{}:
+		f := &parquetField{typ: ParquetGroup}
+		for k, e := range t {
+			if ef := parquetInfer(e); ef != nil {
+				ef.key, ef.name = k, parquetName(k)
+				f.fields = append(f.fields, ef)
+			}
+		}
+		sort.Slice(f.fields, func(i, j int) bool { return f.fields[i].name < f.fields[j].name })
+		return f
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return parquetInfer(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		var elem *parquetField
+		for i := 0; i < rv.Len(); i++ {
+			elem = parquetMerge(elem, parquetInfer(rv.Index(i).Interface()))
+		}
+		if elem == nil {
+			elem = &parquetField{typ: ParquetString}
+		}
+		elem.key, elem.name = "element", "element"
+		return &parquetField{typ: ParquetList, elem: elem}
+	case reflect.Map:
+		if m, ok := plainValue(v).(map[string]interface{}); ok {
+			return parquetInfer(m)
+		}
+	}
+	return &parquetField{typ: ParquetString}
+}
+
+// parquetMerge merges the fields of two values. int64 and double become double, other conflicts become string.
+func parquetMerge(a, b *parquetField) *parquetField {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.typ == b.typ {
+		switch a.typ {
+		case ParquetList:
+			elem := parquetMerge(a.elem, b.elem)
+			elem.key, elem.name = "element", "element"
+			return &parquetField{key: a.key, name: a.name, typ: ParquetList, elem: elem}
+		case ParquetGroup:
+			f := &parquetField{key: a.key, name: a.name, typ: ParquetGroup}
+			index := make(map[string]int)
+			for _, af := range a.fields {
+				index[af.key] = len(f.fields)
+				f.fields = append(f.fields, af)
+			}
+			for _, bf := range b.fields {
+				if i, ok := index[bf.key]; ok {
+					f.fields[i] = parquetMerge(f.fields[i], bf)
+				} else {
+					f.fields = append(f.fields, bf)
+				}
+			}
+			sort.Slice(f.fields, func(i, j int) bool { return f.fields[i].name < f.fields[j].name })
+			return f
+		}
+		return a
+	}
+	if (a.typ == ParquetInt64 && b.typ == ParquetDouble) || (a.typ == ParquetDouble && b.typ == ParquetInt64) {
+		return &parquetField{key: a.key, name: a.name, typ: ParquetDouble}
+	}
+	return &parquetField{key: a.key, name: a.name, typ: ParquetString}
+}
+
+// parquetValue converts a value to the json value of its column.
+func parquetValue(f *parquetField, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return parquetValue(f, rv.Elem().Interface())
+	}
+	switch f.typ {
+	case ParquetString, ParquetBytes:
+		switch t := v.(type) {
+		case string:
+			return t, nil
+		case []byte:
+			return string(t), nil
+		case json.Number, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			return fmt.Sprint(t), nil
+		case time.Time:
+			return t.Format(time.RFC3339Nano), nil
+		}
+		return jsonApi.MarshalToString(v)
+	case ParquetInt32, ParquetInt64:
+		n, err := parquetInt(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.key, err)
+		}
+		if f.typ == ParquetInt32 && (n > 1<<31-1 || n < -1<<31) {
+			return nil, fmt.Errorf("field %s: %d overflows int32", f.key, n)
+		}
+		return n, nil
+	case ParquetFloat, ParquetDouble:
+		switch t := v.(type) {
+		case float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return t, nil
+		case json.Number:
+			return t.Float64()
+		case string:
+			return strconv.ParseFloat(t, 64)
+		}
+		return nil, fmt.Errorf("field %s: %T is not a number", f.key, v)
+	case ParquetBoolean:
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case string:
+			return strconv.ParseBool(t)
+		}
+		return nil, fmt.Errorf("field %s: %T is not a boolean", f.key, v)
+	case ParquetTimestamp:
+		switch t := v.(type) {
+		case time.Time:
+			return t.UnixNano() / int64(time.Millisecond), nil
+		case string:
+			if tm, err := time.Parse(time.RFC3339Nano, t); err == nil {
+				return tm.UnixNano() / int64(time.Millisecond), nil
+			}
+		}
+		// numbers are milliseconds
+		n, err := parquetInt(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.key, err)
+		}
+		return n, nil
+	case ParquetList:
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, fmt.Errorf("field %s: %T is not a list", f.key, v)
+		}
+		if _, ok := v.([]byte); ok {
+			return nil, fmt.Errorf("field %s: bytes is not a list", f.key)
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			e, err := parquetValue(f.elem, rv.Index(i).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", f.key, err)
+			}
+			list[i] = e
+		}
+		return list, nil
+	case ParquetGroup:
+		m, ok := plainValue(v).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("field %s: %T is not a map", f.key, v)
+		}
+		group := make(map[string]interface{}, len(f.fields))
+		for _, sf := range f.fields {
+			e, err := parquetValue(sf, m[sf.key])
+			if err != nil {
+				return nil, err
+			}
+			if e != nil {
+				group[sf.name] = e
+			}
+		}
+		return group, nil
+	}
+	return nil, fmt.Errorf("field %s: unsupported type %s", f.key, f.typ)
+}
+
+// parquetUnknown returns the keys of m and its nested maps which are not fields of the group, e.g. profile.level
+func parquetUnknown(f *parquetField, m map[string]interface{}, prefix string) []string {
+	var keys []string
+	for k, v := range m {
+		var sf *parquetField
+		for _, e := range f.fields {
+			if e.key == k {
+				sf = e
+				break
+			}
+		}
+		if sf == nil {
+			if v != nil {
+				keys = append(keys, prefix+k)
+			}
+			continue
+		}
+		if sm, ok := plainValue(v).(map[string]interface{}); ok && sf.typ == ParquetGroup {
+			keys = append(keys, parquetUnknown(sf, sm, prefix+k+".")...)
+		}
+	}
+	return keys
+}
+
+func parquetInt(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), nil
+	case int8:
+		return int64(t), nil
+	case int16:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case uint:
+		return int64(t), nil
+	case uint8:
+		return int64(t), nil
+	case uint16:
+		return int64(t), nil
+	case uint32:
+		return int64(t), nil
+	case uint64:
+		return int64(t), nil
+	case float32:
+		return parquetIntegral(float64(t))
+	case float64:
+		return parquetIntegral(t)
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return parquetIntegral(f)
+	case string:
+		return strconv.ParseInt(t, 10, 64)
+	}
+	return 0, fmt.Errorf("%T is not an integer", v)
+}
+
+// parquetIntegral converts a float without a fraction, e.g. 10.0 of a json number, 10.5 is an error.
+func parquetIntegral(f float64) (int64, error) {
+	if f != math.Trunc(f) || f > math.MaxInt64 || f < math.MinInt64 {
+		return 0, fmt.Errorf("%v is not an integer", f)
+	}
+	return int64(f), nil
+}
@@ -0,0 +1,76 @@
+package job
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParquetValue(t *testing.T) {
+	fields, err := parquetSchemaOf(map[string]interface{}{
+		"id":      "int64",
+		"small":   "int32",
+		"score":   "double",
+		"tags":    []interface{}{"string"},
+		"profile": map[string]interface{}{"level": "int32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := &parquetField{typ: ParquetGroup, fields: fields}
+	row, err := parquetValue(schema, map[string]interface{}{
+		"id":      json.Number("10"),
+		"small":   10.0,
+		"score":   json.Number("1.5"),
+		"tags":    []interface{}{"a", 1},
+		"profile": map[string]interface{}{"level": json.Number("3.0")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":      int64(10),
+		"small":   int64(10),
+		"score":   1.5,
+		"tags":    []interface{}{"a", "1"},
+		"profile": map[string]interface{}{"level": int64(3)},
+	}
+	if !reflect.DeepEqual(row, want) {
+		t.Fatalf("row %v", row)
+	}
+	for _, v := range []interface{}{10.5, float32(0.25), json.Number("10.5"), json.Number("1e30"), "10.5"} {
+		if _, err := parquetValue(schema, map[string]interface{}{"id": v}); err == nil {
+			t.Fatalf("%v (%T) truncated to an integer", v, v)
+		}
+	}
+	if _, err := parquetValue(schema, map[string]interface{}{"small": int64(1) << 40}); err == nil {
+		t.Fatal("int32 overflow not reported")
+	}
+}
+
+func TestParquetUnknownFields(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	pf := newParquetFormat(KeyValueConf{}, 1<<20, zap.New(core))
+	if pf.rowGroupSize != 1<<20 {
+		t.Fatalf("row group size %d not capped by max size", pf.rowGroupSize)
+	}
+	if err := pf.infer([]interface{}{map[string]interface{}{"id": 1, "profile": map[string]interface{}{"level": 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := pf.encode(map[string]interface{}{"id": 2, "extra": "x", "profile": map[string]interface{}{"level": 2, "vip": true}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	warned := make(map[string]int)
+	for _, e := range logs.All() {
+		warned[e.ContextMap()["field"].(string)]++
+	}
+	if len(warned) != 2 || warned["extra"] != 1 || warned["profile.vip"] != 1 {
+		t.Fatalf("warnings %v, want one per unknown field", warned)
+	}
+}
@@ -3,11 +3,26 @@ module github.com/ywengineer/chain-job
 go 1.13
 
 require (
-	github.com/Shopify/sarama v1.26.1
+	github.com/Shopify/sarama v1.33.0
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/elastic/go-elasticsearch/v7 v7.5.1-0.20200409075911-14061b088525
-	github.com/json-iterator/go v1.1.9
+	github.com/go-mysql-org/go-mysql v1.5.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/jhump/protoreflect v1.12.0
+	github.com/jmoiron/sqlx v1.3.3
+	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.15.11
+	github.com/lib/pq v1.10.9
+	github.com/linkedin/goavro/v2 v2.12.0
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/nats-io/nats-server/v2 v2.9.11
+	github.com/nats-io/nats.go v1.22.1
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/xitongsys/parquet-go v1.6.2
 	github.com/ywengineer/g-util v0.0.0-20200503093932-59540bb2c593
 	github.com/ywengineer/snowflake-golang v0.3.1-0.20200412051904-4e96252abeab
-	go.uber.org/zap v1.13.0
-	gopkg.in/yaml.v2 v2.2.8
+	go.uber.org/zap v1.16.0
+	google.golang.org/protobuf v1.30.0
+	gopkg.in/yaml.v2 v2.4.0
 )
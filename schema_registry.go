@@ -0,0 +1,248 @@
+package job
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+	SchemaTypeJson     = "JSON"
+)
+
+// confluent wire format: magic byte 0, 4 bytes big endian schema id, then the encoded data.
+const confluentMagicByte = 0
+
+var _registry *SchemaRegistry
+var registryMutex = sync.Mutex{}
+
+func SetGlobalSchemaRegistry(conf KeyValueConf, log *zap.Logger) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _registry == nil {
+		_registry = NewSchemaRegistry(conf, log)
+	} else {
+		util.Error("global schema registry already exists. %s", _registry.url)
+	}
+}
+
+// newCodecRegistry returns the registry configured for a codec. nil if the codec does not use a registry.
+func newCodecRegistry(conf *CodecConf, log *zap.Logger) *SchemaRegistry {
+	if conf.Metadata.GetBool("global") {
+		if _registry == nil {
+			log.Panic("global schema registry not set.")
+		}
+		return _registry
+	}
+	if conf.Metadata.Contains("registry") {
+		return NewSchemaRegistry(conf.Metadata.GetKeyValueConf("registry"), log)
+	}
+	return nil
+}
+
+type RegistryReference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+type RegistrySchema struct {
+	ID         int                 `json:"id"`
+	Subject    string              `json:"subject,omitempty"`
+	Version    int                 `json:"version,omitempty"`
+	Schema     string              `json:"schema"`
+	SchemaType string              `json:"schemaType,omitempty"`
+	References []RegistryReference `json:"references,omitempty"`
+}
+
+// Type returns the schema type, registry omits it for avro schemas.
+func (rs *RegistrySchema) Type() string {
+	if len(rs.SchemaType) == 0 {
+		return SchemaTypeAvro
+	}
+	return rs.SchemaType
+}
+
+// SchemaRegistry is a client of the confluent schema registry rest api, resolved schemas are cached.
+type SchemaRegistry struct {
+	url      string
+	user     string
+	password string
+	log      *zap.Logger
+	ctx      context.Context
+	client   *http.Client
+	mu       sync.RWMutex
+	byID     map[int]*RegistrySchema
+	byRef    map[string]*RegistrySchema
+	ids      map[string]int
+}
+
+func NewSchemaRegistry(conf KeyValueConf, log *zap.Logger) *SchemaRegistry {
+	u := strings.TrimRight(conf.GetString("url"), "/")
+	if len(u) == 0 {
+		log.Panic("missing url config for schema registry")
+	}
+	timeout := time.Duration(conf.GetInt("timeout")) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &SchemaRegistry{
+		url:      u,
+		user:     conf.GetString("user"),
+		password: conf.GetString("password"),
+		log:      log,
+		ctx:      context.Background(),
+		client:   newHttpClient(timeout, conf.GetKeyValueConf("tls"), log),
+		byID:     make(map[int]*RegistrySchema),
+		byRef:    make(map[string]*RegistrySchema),
+		ids:      make(map[string]int),
+	}
+}
+
+// SchemaByID resolves the schema registered with id.
+func (sr *SchemaRegistry) SchemaByID(id int) (*RegistrySchema, error) {
+	sr.mu.RLock()
+	s, ok := sr.byID[id]
+	sr.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+	s = &RegistrySchema{}
+	if err := sr.do("GET", "/schemas/ids/"+strconv.Itoa(id), nil, s); err != nil {
+		return nil, err
+	}
+	s.ID = id
+	sr.mu.Lock()
+	sr.byID[id] = s
+	sr.mu.Unlock()
+	return s, nil
+}
+
+// SchemaBySubject resolves a version of subject, version <= 0 means the latest version which is never cached.
+func (sr *SchemaRegistry) SchemaBySubject(subject string, version int) (*RegistrySchema, error) {
+	v := "latest"
+	if version > 0 {
+		v = strconv.Itoa(version)
+	}
+	key := subject + "/" + v
+	if version > 0 {
+		sr.mu.RLock()
+		s, ok := sr.byRef[key]
+		sr.mu.RUnlock()
+		if ok {
+			return s, nil
+		}
+	}
+	s := &RegistrySchema{}
+	if err := sr.do("GET", "/subjects/"+url.PathEscape(subject)+"/versions/"+v, nil, s); err != nil {
+		return nil, err
+	}
+	sr.mu.Lock()
+	sr.byRef[subject+"/"+strconv.Itoa(s.Version)] = s
+	sr.byID[s.ID] = s
+	sr.mu.Unlock()
+	return s, nil
+}
+
+// Register registers the schema under subject and returns its id. registering an existing schema returns the existing id.
+func (sr *SchemaRegistry) Register(subject string, schema *RegistrySchema) (int, error) {
+	key := subject + "/" + schema.Type() + "/" + schema.Schema
+	sr.mu.RLock()
+	id, ok := sr.ids[key]
+	sr.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+	body := &RegistrySchema{Schema: schema.Schema, References: schema.References}
+	if schema.Type() != SchemaTypeAvro {
+		body.SchemaType = schema.SchemaType
+	}
+	r := &RegistrySchema{}
+	if err := sr.do("POST", "/subjects/"+url.PathEscape(subject)+"/versions", body, r); err != nil {
+		return 0, err
+	}
+	sr.mu.Lock()
+	sr.ids[key] = r.ID
+	sr.mu.Unlock()
+	return r.ID, nil
+}
+
+// References resolves the referenced schemas recursively, keyed by reference name.
+func (sr *SchemaRegistry) References(schema *RegistrySchema) (map[string]string, error) {
+	refs := make(map[string]string)
+	var resolve func(s *RegistrySchema) error
+	resolve = func(s *RegistrySchema) error {
+		for _, ref := range s.References {
+			if _, ok := refs[ref.Name]; ok {
+				continue
+			}
+			rs, err := sr.SchemaBySubject(ref.Subject, ref.Version)
+			if err != nil {
+				return err
+			}
+			refs[ref.Name] = rs.Schema
+			if err := resolve(rs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return refs, resolve(schema)
+}
+
+func (sr *SchemaRegistry) do(method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := jsonApi.MarshalToString(body)
+		if err != nil {
+			return err
+		}
+		reader = strings.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(sr.ctx, method, sr.url+path, reader)
+	if err != nil {
+		return err
+	}
+	if len(sr.user) > 0 {
+		req.SetBasicAuth(sr.user, sr.password)
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	//
+	status, data, err := doRequest(sr.client, req)
+	if err != nil {
+		return err
+	}
+	if status > 299 {
+		return fmt.Errorf("schema registry %s %s failed. %d: %s", method, path, status, string(data))
+	}
+	return jsonApi.Unmarshal(data, result)
+}
+
+// splitConfluentWire returns the schema id and the encoded data of a confluent wire format message.
+func splitConfluentWire(data []byte) (int, []byte, error) {
+	if len(data) < 5 || data[0] != confluentMagicByte {
+		return 0, nil, errors.New("unknown magic byte, data is not in confluent wire format")
+	}
+	return int(binary.BigEndian.Uint32(data[1:5])), data[5:], nil
+}
+
+// appendConfluentWire prepends the confluent wire format header to data.
+func appendConfluentWire(id int, data []byte) []byte {
+	buf := make([]byte, 5, 5+len(data))
+	buf[0] = confluentMagicByte
+	binary.BigEndian.PutUint32(buf[1:5], uint32(id))
+	return append(buf, data...)
+}
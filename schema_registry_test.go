@@ -0,0 +1,130 @@
+package job
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testAvroSchema = `{"type":"record","name":"Player","fields":[{"name":"id","type":"long"},{"name":"name","type":"string"}]}`
+
+// newTestRegistry starts a schema registry stand-in serving schema 1 and subject player.
+func newTestRegistry(t *testing.T, hits *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if user, password, ok := r.BasicAuth(); !ok || user != "u" || password != "p" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/1":
+			_, _ = w.Write([]byte(`{"schema":` + quoteJson(testAvroSchema) + `}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/subjects/player/versions/latest":
+			_, _ = w.Write([]byte(`{"id":1,"subject":"player","version":3,"schema":` + quoteJson(testAvroSchema) + `}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/subjects/player/versions":
+			body, _ := ioutil.ReadAll(r.Body)
+			if !strings.Contains(string(body), `"schema"`) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+			_, _ = w.Write([]byte(`{"id":7}`))
+		case r.URL.Path == "/slow":
+			time.Sleep(1500 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func quoteJson(s string) string {
+	b, _ := jsonApi.MarshalToString(s)
+	return b
+}
+
+func TestSchemaRegistryResolveAndCache(t *testing.T) {
+	var hits int32
+	srv := newTestRegistry(t, &hits)
+	sr := NewSchemaRegistry(KeyValueConf{"url": srv.URL + "/", "user": "u", "password": "p"}, zap.NewNop())
+	for i := 0; i < 2; i++ {
+		rs, err := sr.SchemaByID(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs.ID != 1 || rs.Type() != SchemaTypeAvro || rs.Schema != testAvroSchema {
+			t.Fatalf("unexpected schema %+v", rs)
+		}
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 1 {
+		t.Fatalf("registry hit %d times, want the schema cached", hits)
+	}
+	rs, err := sr.SchemaBySubject("player", 0)
+	if err != nil || rs.Version != 3 {
+		t.Fatalf("latest of subject: %+v %v", rs, err)
+	}
+	for i := 0; i < 2; i++ {
+		if id, err := sr.Register("player", &RegistrySchema{Schema: testAvroSchema}); err != nil || id != 7 {
+			t.Fatalf("register: %d %v", id, err)
+		}
+	}
+	if hits := atomic.LoadInt32(&hits); hits != 3 {
+		t.Fatalf("registry hit %d times, want the registered id cached", hits)
+	}
+	if _, err := sr.SchemaByID(2); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("missing schema error %v", err)
+	}
+}
+
+func TestSchemaRegistryTimeout(t *testing.T) {
+	var hits int32
+	srv := newTestRegistry(t, &hits)
+	sr := NewSchemaRegistry(KeyValueConf{"url": srv.URL, "user": "u", "password": "p", "timeout": 1}, zap.NewNop())
+	start := time.Now()
+	if err := sr.do(http.MethodGet, "/slow", nil, &RegistrySchema{}); err == nil {
+		t.Fatal("slow registry did not time out")
+	}
+	if d := time.Since(start); d > 1400*time.Millisecond {
+		t.Fatalf("timeout took %v", d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sr.ctx = ctx
+	if _, err := sr.SchemaByID(1); err == nil {
+		t.Fatal("cancelled context ignored")
+	}
+}
+
+func TestAvroCodecWithRegistry(t *testing.T) {
+	var hits int32
+	srv := newTestRegistry(t, &hits)
+	codec := newCodec(&CodecConf{Type: "avro", Metadata: KeyValueConf{
+		"registry": map[interface{}]interface{}{"url": srv.URL, "user": "u", "password": "p"},
+		"subject":  "player",
+	}}, context.Background(), zap.NewNop())
+	data, err := codec.(Encoder).Encode(map[string]interface{}{"id": int64(9), "name": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without a local schema the latest schema of subject is used
+	if id, _, err := splitConfluentWire(data); err != nil || id != 1 {
+		t.Fatalf("wire id %d %v", id, err)
+	}
+	v, err := codec.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := v.(map[string]interface{})
+	if m["name"] != "a" {
+		t.Fatalf("decoded %v", m)
+	}
+}
@@ -2,8 +2,14 @@ package job
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/ywengineer/g-util/util"
 	"go.uber.org/zap"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 )
 
 type SinkMaker func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink
@@ -27,6 +33,101 @@ func newSink(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
 	return nil
 }
 
+// Sink writes the data. a sink may also implement io.Closer, it is closed after the task finished.
 type Sink interface {
 	DoSink(message *TaskData)
 }
+
+// templateField matches the {field} placeholders of a template.
+var templateField = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// fillTemplate fills the {field} placeholders of template with the payload fields, e.g. user:{id}
+func fillTemplate(template string, item map[string]interface{}) (string, error) {
+	var missing []string
+	key := templateField.ReplaceAllStringFunc(template, func(s string) string {
+		field := s[1 : len(s)-1]
+		v, ok := item[field]
+		if !ok || v == nil {
+			missing = append(missing, field)
+			return ""
+		}
+		return fmt.Sprint(v)
+	})
+	if len(missing) > 0 {
+		return "", errors.New("missing template fields: " + strings.Join(missing, ","))
+	}
+	return key, nil
+}
+
+// templateFields merges the payload fields and metadata for templates. the fields of every sink are resolved the
+// same way, a payload field comes first and metadata only fills the missing ones, so metadata like the packet id
+// of mqtt or the partition of kafka never replaces a payload field.
+func templateFields(item map[string]interface{}, meta KeyValueConf) map[string]interface{} {
+	fields := make(map[string]interface{}, len(item)+len(meta))
+	for k, v := range meta {
+		fields[k] = v
+	}
+	for k, v := range item {
+		if v != nil {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// payloadItems splits a payload into the items of a map slice, a single map or raw bytes is one item.
+func payloadItems(data interface{}) []interface{} {
+	if data == nil {
+		return nil
+	}
+	switch reflect.TypeOf(data).Kind() {
+	case reflect.Ptr:
+		return payloadItems(reflect.ValueOf(data).Elem().Interface())
+	case reflect.Slice:
+		if raw, ok := data.([]byte); ok {
+			return []interface{}{raw}
+		}
+		if slice, ok := data.([]map[string]interface{}); ok {
+			r := make([]interface{}, len(slice))
+			for i, item := range slice {
+				r[i] = item
+			}
+			return r
+		}
+		if slice, ok := data.([]interface{}); ok {
+			return slice
+		}
+	}
+	return []interface{}{data}
+}
+
+// sleepContext waits d for a retry backoff, false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// heldMessages are the messages held by a sink until their buffered data is written.
+type heldMessages struct {
+	releases []func(error)
+	metas    []KeyValueConf
+}
+
+func (hm *heldMessages) hold(message *TaskData) {
+	hm.releases = append(hm.releases, message.Hold())
+	hm.metas = append(hm.metas, message.Metadata)
+}
+
+// release notifies the sources of the held messages once their data is written, or fails them by err.
+func (hm *heldMessages) release(err error) {
+	for _, release := range hm.releases {
+		release(err)
+	}
+	hm.releases, hm.metas = nil, nil
+}
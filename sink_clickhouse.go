@@ -0,0 +1,690 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("clickhouse", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkClickHouse{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	ClickHouseJSONEachRow = "JSONEachRow"
+	ClickHouseRowBinary   = "RowBinary"
+)
+
+// clickhouseColumn is a column name with its clickhouse type, e.g. Nullable(String)
+type clickhouseColumn struct {
+	name string
+	typ  string
+}
+
+// clickhouseBatch is the pending rows of a table, and the messages held until the rows are inserted.
+type clickhouseBatch struct {
+	table   string
+	columns []clickhouseColumn
+	buf     *bytes.Buffer
+	rows    int
+	created time.Time
+	held    heldMessages
+}
+
+// SinkClickHouse inserts rows through the clickhouse http interface in JSONEachRow or RowBinary format.
+// the table is picked by the tablesKey metadata from tablesMap like SinkES indicesMap, or is the fixed table.
+// rows are batched per table and flushed by batchRows, batchBytes or interval seconds, and on close.
+// tables lists the columns as "name Type" of a table, its engine, and is created or checked at start.
+// RowBinary takes the columns of tables, or describes the table once.
+// a message is acknowledged to the source once its rows are inserted, or dropped after retries.
+type SinkClickHouse struct {
+	conf       *SinkConf
+	log        *zap.Logger
+	ctx        context.Context
+	cancel     context.CancelFunc
+	address    string
+	database   string
+	user       string
+	password   string
+	format     string
+	table      string
+	tablesMap  KeyValueConf
+	tablesKey  string
+	columns    map[string][]clickhouseColumn
+	batchRows  int
+	batchBytes int
+	interval   time.Duration
+	timeout    time.Duration
+	retries    int
+	client     *http.Client
+	mu         sync.Mutex
+	batches    map[string]*clickhouseBatch
+	closed     bool
+	stop       chan bool
+}
+
+func (sc *SinkClickHouse) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	sc.conf = conf
+	sc.log = log
+	// retries of failed writes stop once the task is cancelled or the sink is closed
+	sc.ctx, sc.cancel = context.WithCancel(ctx)
+	sc.address = strings.TrimRight(conf.Metadata.GetStringOrDefault(ConfAddress, "http://127.0.0.1:8123"), "/")
+	sc.database = conf.Metadata.GetStringOrDefault("database", "default")
+	sc.user = conf.Metadata.GetString("user")
+	sc.password = conf.Metadata.GetString("password")
+	sc.format = conf.Metadata.GetStringOrDefault("format", ClickHouseJSONEachRow)
+	if sc.format != ClickHouseJSONEachRow && sc.format != ClickHouseRowBinary {
+		log.Panic("unsupported format for SinkClickHouse", sc.tag(), zap.String("format", sc.format))
+	}
+	sc.table = conf.Metadata.GetString("table")
+	sc.tablesMap = conf.Metadata.GetKeyValueConf("tablesMap")
+	sc.tablesKey = conf.Metadata.GetString("tablesKey")
+	if len(sc.table) == 0 && (len(sc.tablesMap) == 0 || len(sc.tablesKey) == 0) {
+		log.Panic("missing table or tablesMap and tablesKey config for SinkClickHouse", sc.tag())
+	}
+	sc.batchRows = conf.Metadata.GetInt("batchRows")
+	if sc.batchRows <= 0 {
+		sc.batchRows = 10000
+	}
+	sc.batchBytes = conf.Metadata.GetInt("batchBytes")
+	if sc.batchBytes <= 0 {
+		sc.batchBytes = 8 << 20
+	}
+	sc.interval = time.Duration(conf.Metadata.GetInt("interval")) * time.Second
+	if sc.interval <= 0 {
+		sc.interval = 5 * time.Second
+	}
+	sc.timeout = time.Duration(conf.Metadata.GetInt("timeout")) * time.Second
+	if sc.timeout <= 0 {
+		sc.timeout = 30 * time.Second
+	}
+	sc.retries = conf.Metadata.GetInt("retries")
+	if !conf.Metadata.Contains("retries") {
+		sc.retries = 3
+	}
+	sc.client = newHttpClient(sc.timeout, conf.Metadata.GetKeyValueConf("tls"), log)
+	//
+	sc.columns = make(map[string][]clickhouseColumn)
+	tables := conf.Metadata.GetKeyValueConf("tables")
+	for name, v := range tables {
+		tc, _ := plainValue(v).(map[string]interface{})
+		table := KeyValueConf(tc)
+		var columns []clickhouseColumn
+		if table.Contains("columns") {
+			for _, c := range table.GetStringSlice("columns") {
+				parts := strings.SplitN(strings.TrimSpace(c), " ", 2)
+				if len(parts) != 2 {
+					log.Panic("bad column config for SinkClickHouse, name Type expected", sc.tag(), zap.String("table", name), zap.String("column", c))
+				}
+				columns = append(columns, clickhouseColumn{name: parts[0], typ: strings.TrimSpace(parts[1])})
+			}
+		}
+		if len(columns) == 0 {
+			log.Panic("missing columns config for SinkClickHouse", sc.tag(), zap.String("table", name))
+		}
+		sc.columns[sc.qualified(name)] = columns
+		if conf.Metadata.GetBool("create") {
+			if err := sc.create(name, columns, table.GetStringOrDefault("engine", "MergeTree() ORDER BY tuple()")); err != nil {
+				log.Panic("create clickhouse table failed", sc.tag(), zap.String("table", name), zap.Error(err))
+			}
+		}
+		if conf.Metadata.GetBool("check") {
+			if err := sc.check(name, columns); err != nil {
+				log.Panic("check clickhouse table failed", sc.tag(), zap.String("table", name), zap.Error(err))
+			}
+		}
+	}
+	sc.batches = make(map[string]*clickhouseBatch)
+	sc.stop = make(chan bool)
+	go sc.flushLoop()
+}
+
+func (sc *SinkClickHouse) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			sc.log.Error("catch panic event.", sc.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	table := sc.table
+	if len(sc.tablesKey) > 0 {
+		if tp := message.Metadata.GetString(sc.tablesKey); len(tp) > 0 {
+			t, ok := sc.tablesMap[tp]
+			if !ok {
+				sc.log.Error("missing tables map", sc.tag(), zap.String("key", tp), zap.Any("data", *message))
+				return
+			}
+			table = t.(string)
+		}
+	}
+	if len(table) == 0 {
+		sc.log.Error("missing tables key meta", sc.tag(), zap.String("tablesKey", sc.tablesKey), zap.Any("data", *message))
+		return
+	}
+	rows := sc.rows(message.Payload)
+	if len(rows) == 0 {
+		return
+	}
+	qualified := sc.qualified(table)
+	var columns []clickhouseColumn
+	if sc.format == ClickHouseRowBinary {
+		var err error
+		if columns, err = sc.columnsOf(qualified); err != nil {
+			sc.log.Error("prepare clickhouse batch failed", sc.tag(), zap.String("table", table), zap.Error(err), zap.Any("meta", message.Metadata))
+			return
+		}
+	}
+	//
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		sc.log.Error("sink clickhouse is closed", sc.tag(), zap.Any("meta", message.Metadata))
+		return
+	}
+	batch := sc.batch(qualified, columns)
+	encoded := 0
+	for _, row := range rows {
+		if err := sc.encode(batch, row); err != nil {
+			sc.log.Error("encode clickhouse row failed", sc.tag(), zap.String("table", table), zap.Error(err), zap.Any("row", row))
+		} else {
+			encoded++
+		}
+	}
+	if encoded > 0 {
+		batch.held.hold(message)
+	}
+	var full *clickhouseBatch
+	if batch.rows >= sc.batchRows || batch.buf.Len() >= sc.batchBytes {
+		full = batch
+		delete(sc.batches, batch.table)
+	}
+	sc.mu.Unlock()
+	if full != nil {
+		sc.flush(full)
+	}
+}
+
+// Close flushes the pending rows of all tables.
+func (sc *SinkClickHouse) Close() error {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.closed = true
+	close(sc.stop)
+	sc.cancel()
+	batches := sc.batches
+	sc.batches = nil
+	sc.mu.Unlock()
+	var errs []string
+	for _, batch := range batches {
+		if err := sc.flush(batch); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (sc *SinkClickHouse) rows(data interface{}) []map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	switch data.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{data.(map[string]interface{})}
+	case []map[string]interface{}:
+		return data.([]map[string]interface{})
+	}
+	if reflect.TypeOf(data).Kind() == reflect.Ptr {
+		return sc.rows(reflect.ValueOf(data).Elem().Interface())
+	}
+	sc.log.Error("unknown message kind for sink clickhouse", sc.tag(), zap.Any("kind", reflect.TypeOf(data).Kind().String()))
+	return nil
+}
+
+// columnsOf returns the columns of a qualified table for RowBinary, an unknown table is described without the lock held.
+func (sc *SinkClickHouse) columnsOf(table string) ([]clickhouseColumn, error) {
+	sc.mu.Lock()
+	columns, ok := sc.columns[table]
+	sc.mu.Unlock()
+	if ok {
+		return columns, nil
+	}
+	columns, err := sc.describe(table)
+	if err != nil {
+		return nil, err
+	}
+	sc.mu.Lock()
+	sc.columns[table] = columns
+	sc.mu.Unlock()
+	return columns, nil
+}
+
+// batch returns the pending batch of a table, RowBinary needs the columns of the table.
+func (sc *SinkClickHouse) batch(table string, columns []clickhouseColumn) *clickhouseBatch {
+	if batch, ok := sc.batches[table]; ok {
+		return batch
+	}
+	batch := &clickhouseBatch{table: table, columns: columns, buf: &bytes.Buffer{}, created: time.Now()}
+	sc.batches[table] = batch
+	return batch
+}
+
+func (sc *SinkClickHouse) encode(batch *clickhouseBatch, row map[string]interface{}) error {
+	if sc.format == ClickHouseJSONEachRow {
+		data, err := jsonApi.Marshal(row)
+		if err != nil {
+			return err
+		}
+		batch.buf.Write(data)
+		batch.buf.WriteByte('\n')
+		batch.rows++
+		return nil
+	}
+	// a failed row must not leave partial data in the batch
+	var buf bytes.Buffer
+	for _, c := range batch.columns {
+		if err := clickhouseBinary(&buf, c.typ, row[c.name]); err != nil {
+			return fmt.Errorf("column %s: %v", c.name, err)
+		}
+	}
+	batch.buf.Write(buf.Bytes())
+	batch.rows++
+	return nil
+}
+
+// flush inserts the rows of a batch, retried with backoff. the held messages are released once the rows are inserted,
+// or failed after retries, so the sources deliver them again.
+func (sc *SinkClickHouse) flush(batch *clickhouseBatch) (err error) {
+	defer func() {
+		batch.held.release(err)
+	}()
+	if batch.rows == 0 {
+		return nil
+	}
+	query := "INSERT INTO " + batch.table + " FORMAT " + sc.format
+	if sc.format == ClickHouseRowBinary {
+		names := make([]string, len(batch.columns))
+		for i, c := range batch.columns {
+			names[i] = clickhouseQuote(c.name)
+		}
+		query = "INSERT INTO " + batch.table + " (" + strings.Join(names, ", ") + ") FORMAT " + sc.format
+	}
+	start := time.Now()
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if _, err = sc.query(query, batch.buf.Bytes()); err == nil {
+			break
+		}
+		if attempt >= sc.retries || sc.ctx.Err() != nil {
+			sc.log.Error("insert clickhouse rows failed, messages not acknowledged", sc.tag(), zap.String("table", batch.table), zap.Int("rows", batch.rows),
+				zap.Int("attempts", attempt+1), zap.Error(err), zap.Any("messages", batch.held.metas))
+			return err
+		}
+		sc.log.Warn("insert clickhouse rows failed, retry later", sc.tag(), zap.String("table", batch.table), zap.Error(err), zap.Duration("backoff", backoff))
+		sleepContext(sc.ctx, backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+	sc.log.Debug("clickhouse rows inserted", sc.tag(), zap.String("table", batch.table), zap.Int("rows", batch.rows),
+		zap.Int("bytes", batch.buf.Len()), zap.Duration("cost", time.Since(start)))
+	return nil
+}
+
+// flushLoop flushes the batches older than interval.
+func (sc *SinkClickHouse) flushLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sc.stop:
+			return
+		case <-ticker.C:
+		}
+		var due []*clickhouseBatch
+		sc.mu.Lock()
+		for table, batch := range sc.batches {
+			if time.Since(batch.created) >= sc.interval {
+				due = append(due, batch)
+				delete(sc.batches, table)
+			}
+		}
+		sc.mu.Unlock()
+		for _, batch := range due {
+			_ = sc.flush(batch)
+		}
+	}
+}
+
+func (sc *SinkClickHouse) create(table string, columns []clickhouseColumn, engine string) error {
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		defs[i] = clickhouseQuote(c.name) + " " + c.typ
+	}
+	_, err := sc.query("CREATE TABLE IF NOT EXISTS "+sc.qualified(table)+" ("+strings.Join(defs, ", ")+") ENGINE = "+engine, nil)
+	return err
+}
+
+// check compares the configured columns with the columns of the table.
+func (sc *SinkClickHouse) check(table string, columns []clickhouseColumn) error {
+	actual, err := sc.describe(sc.qualified(table))
+	if err != nil {
+		return err
+	}
+	types := make(map[string]string, len(actual))
+	for _, c := range actual {
+		types[c.name] = c.typ
+	}
+	var diff []string
+	for _, c := range columns {
+		if t, ok := types[c.name]; !ok {
+			diff = append(diff, c.name+" missing")
+		} else if t != c.typ {
+			diff = append(diff, c.name+" is "+t+" not "+c.typ)
+		}
+	}
+	if len(diff) > 0 {
+		sort.Strings(diff)
+		return errors.New("table columns mismatch: " + strings.Join(diff, ", "))
+	}
+	return nil
+}
+
+// describe returns the insertable columns of a qualified table.
+func (sc *SinkClickHouse) describe(table string) ([]clickhouseColumn, error) {
+	data, err := sc.query("DESCRIBE TABLE "+table+" FORMAT JSONEachRow", nil)
+	if err != nil {
+		return nil, err
+	}
+	var columns []clickhouseColumn
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var c struct {
+			Name        string `json:"name"`
+			Type        string `json:"type"`
+			DefaultType string `json:"default_type"`
+		}
+		if err := jsonApi.Unmarshal(line, &c); err != nil {
+			return nil, err
+		}
+		if c.DefaultType != "MATERIALIZED" && c.DefaultType != "ALIAS" {
+			columns = append(columns, clickhouseColumn{name: c.Name, typ: c.Type})
+		}
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("no column found of table " + table)
+	}
+	return columns, nil
+}
+
+// query sends a query with the body as data, it does not depend on the task context so close can flush.
+func (sc *SinkClickHouse) query(query string, body []byte) ([]byte, error) {
+	params := url.Values{}
+	params.Set("database", sc.database)
+	params.Set("query", query)
+	req, err := http.NewRequest(http.MethodPost, sc.address+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(sc.user) > 0 {
+		req.Header.Set("X-ClickHouse-User", sc.user)
+		req.Header.Set("X-ClickHouse-Key", sc.password)
+	}
+	status, res, err := doRequest(sc.client, req)
+	if err != nil {
+		return nil, err
+	}
+	if status > 299 {
+		return nil, fmt.Errorf("%d: %s", status, strings.TrimSpace(string(res)))
+	}
+	return res, nil
+}
+
+// qualified prefixes the database to a table without one, both quoted.
+func (sc *SinkClickHouse) qualified(table string) string {
+	if strings.HasPrefix(table, "`") {
+		return table
+	}
+	if i := strings.Index(table, "."); i > 0 {
+		return clickhouseQuote(table[:i]) + "." + clickhouseQuote(table[i+1:])
+	}
+	return clickhouseQuote(sc.database) + "." + clickhouseQuote(table)
+}
+
+func (sc *SinkClickHouse) tag() zap.Field {
+	return zap.String("tag", "SinkClickHouse")
+}
+
+func clickhouseQuote(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+// clickhouseBinary appends v in the RowBinary encoding of typ, a nil value is the zero value of typ.
+func clickhouseBinary(buf *bytes.Buffer, typ string, v interface{}) error {
+	if inner, ok := clickhouseInner(typ, "Nullable"); ok {
+		if v == nil {
+			buf.WriteByte(1)
+			return nil
+		}
+		buf.WriteByte(0)
+		return clickhouseBinary(buf, inner, v)
+	}
+	if inner, ok := clickhouseInner(typ, "LowCardinality"); ok {
+		return clickhouseBinary(buf, inner, v)
+	}
+	if inner, ok := clickhouseInner(typ, "Array"); ok {
+		var items []interface{}
+		if v != nil {
+			rv := reflect.ValueOf(v)
+			if rv.Kind() != reflect.Slice {
+				return fmt.Errorf("array expected, got %T", v)
+			}
+			for i := 0; i < rv.Len(); i++ {
+				items = append(items, rv.Index(i).Interface())
+			}
+		}
+		clickhouseUvarint(buf, uint64(len(items)))
+		for _, item := range items {
+			if err := clickhouseBinary(buf, inner, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if n, ok := clickhouseInner(typ, "FixedString"); ok {
+		size, err := strconv.Atoi(n)
+		if err != nil {
+			return err
+		}
+		s := clickhouseString(v)
+		if len(s) > size {
+			return fmt.Errorf("value longer than %s", typ)
+		}
+		buf.WriteString(s)
+		buf.Write(make([]byte, size-len(s)))
+		return nil
+	}
+	if p, ok := clickhouseInner(typ, "DateTime64"); ok {
+		precision, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(p, ",", 2)[0]))
+		if err != nil {
+			return err
+		}
+		t, err := clickhouseTime(v)
+		if err != nil {
+			return err
+		}
+		return binary.Write(buf, binary.LittleEndian, t.UnixNano()/int64(math.Pow10(9-precision)))
+	}
+	if strings.HasPrefix(typ, "DateTime") {
+		t, err := clickhouseTime(v)
+		if err != nil {
+			return err
+		}
+		return binary.Write(buf, binary.LittleEndian, uint32(t.Unix()))
+	}
+	var err error
+	switch typ {
+	case "String":
+		s := clickhouseString(v)
+		clickhouseUvarint(buf, uint64(len(s)))
+		buf.WriteString(s)
+	case "Bool":
+		b := false
+		if v != nil {
+			if b, err = strconv.ParseBool(fmt.Sprint(v)); err != nil {
+				return err
+			}
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "Date":
+		var t time.Time
+		if t, err = clickhouseTime(v); err != nil {
+			return err
+		}
+		return binary.Write(buf, binary.LittleEndian, uint16(t.Unix()/86400))
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		var n uint64
+		if n, err = clickhouseUint(v); err != nil {
+			return err
+		}
+		switch typ {
+		case "UInt8":
+			return binary.Write(buf, binary.LittleEndian, uint8(n))
+		case "UInt16":
+			return binary.Write(buf, binary.LittleEndian, uint16(n))
+		case "UInt32":
+			return binary.Write(buf, binary.LittleEndian, uint32(n))
+		}
+		return binary.Write(buf, binary.LittleEndian, n)
+	case "Int8", "Int16", "Int32", "Int64":
+		var n int64
+		if n, err = clickhouseInt(v); err != nil {
+			return err
+		}
+		switch typ {
+		case "Int8":
+			return binary.Write(buf, binary.LittleEndian, int8(n))
+		case "Int16":
+			return binary.Write(buf, binary.LittleEndian, int16(n))
+		case "Int32":
+			return binary.Write(buf, binary.LittleEndian, int32(n))
+		}
+		return binary.Write(buf, binary.LittleEndian, n)
+	case "Float32", "Float64":
+		var f float64
+		if v != nil {
+			if f, err = strconv.ParseFloat(fmt.Sprint(v), 64); err != nil {
+				return err
+			}
+		}
+		if typ == "Float32" {
+			return binary.Write(buf, binary.LittleEndian, float32(f))
+		}
+		return binary.Write(buf, binary.LittleEndian, f)
+	default:
+		return errors.New("unsupported RowBinary type " + typ)
+	}
+	return nil
+}
+
+// clickhouseInner returns the argument of a wrapper type, e.g. String of Nullable(String)
+func clickhouseInner(typ, wrapper string) (string, bool) {
+	if strings.HasPrefix(typ, wrapper+"(") && strings.HasSuffix(typ, ")") {
+		return strings.TrimSpace(typ[len(wrapper)+1 : len(typ)-1]), true
+	}
+	return "", false
+}
+
+func clickhouseUvarint(buf *bytes.Buffer, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+// clickhouseString encodes nested values as json.
+func clickhouseString(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v.(string)
+	case []byte:
+		return string(v.([]byte))
+	case map[string]interface{}, []interface{}:
+		s, _ := jsonApi.MarshalToString(v)
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func clickhouseInt(v interface{}) (int64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	s := fmt.Sprint(v)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return int64(f), err
+}
+
+func clickhouseUint(v interface{}) (uint64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	s := fmt.Sprint(v)
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return uint64(f), err
+}
+
+// clickhouseTime takes a time, unix seconds, or a string in RFC3339 or yyyy-MM-dd HH:mm:ss
+func clickhouseTime(v interface{}) (time.Time, error) {
+	switch v.(type) {
+	case nil:
+		return time.Unix(0, 0), nil
+	case time.Time:
+		return v.(time.Time), nil
+	case string:
+		s := v.(string)
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"} {
+			if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+				return t, nil
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time value %v", v)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
@@ -0,0 +1,140 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// clickhouseStandIn records the queries and bodies sent to the clickhouse http interface.
+type clickhouseStandIn struct {
+	mu      sync.Mutex
+	queries []string
+	bodies  [][]byte
+	status  int
+	delay   time.Duration
+}
+
+func (cs *clickhouseStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	query := r.URL.Query().Get("query")
+	cs.mu.Lock()
+	cs.queries = append(cs.queries, query)
+	cs.bodies = append(cs.bodies, body)
+	status := cs.status
+	cs.mu.Unlock()
+	time.Sleep(cs.delay)
+	if strings.HasPrefix(query, "DESCRIBE") {
+		_, _ = w.Write([]byte(`{"name":"id","type":"UInt32","default_type":""}` + "\n" +
+			`{"name":"name","type":"String","default_type":""}` + "\n" +
+			`{"name":"day","type":"Date","default_type":"MATERIALIZED"}` + "\n"))
+		return
+	}
+	if status > 0 {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("Code: 241. DB::Exception: Memory limit exceeded"))
+	}
+}
+
+func (cs *clickhouseStandIn) inserts() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var r []string
+	for i, q := range cs.queries {
+		if strings.HasPrefix(q, "INSERT") {
+			r = append(r, q+"\n"+string(cs.bodies[i]))
+		}
+	}
+	return r
+}
+
+func newTestClickHouse(t *testing.T, cs *clickhouseStandIn, meta KeyValueConf) *SinkClickHouse {
+	srv := httptest.NewServer(cs)
+	t.Cleanup(srv.Close)
+	meta[ConfAddress] = srv.URL
+	meta["table"] = "events"
+	sc := &SinkClickHouse{}
+	sc.init(&SinkConf{Type: "clickhouse", Metadata: meta}, context.Background(), zap.NewNop())
+	return sc
+}
+
+func TestSinkClickHouseHoldUntilFlushed(t *testing.T) {
+	cs := &clickhouseStandIn{}
+	sc := newTestClickHouse(t, cs, KeyValueConf{"batchRows": 3})
+	done := 0
+	for i := 0; i < 2; i++ {
+		data := &TaskData{Payload: map[string]interface{}{"id": i}, done: func() { done++ }}
+		sc.DoSink(data)
+		data.Done()
+	}
+	if done != 0 || len(cs.inserts()) != 0 {
+		t.Fatalf("%d messages acknowledged before the rows are inserted", done)
+	}
+	data := &TaskData{Payload: []map[string]interface{}{{"id": 2}, {"id": 3}}, done: func() { done++ }}
+	sc.DoSink(data)
+	data.Done()
+	inserts := cs.inserts()
+	if done != 3 || len(inserts) != 1 {
+		t.Fatalf("acknowledged %d, inserts %v", done, inserts)
+	}
+	if want := "INSERT INTO `default`.`events` FORMAT JSONEachRow\n{\"id\":0}\n{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n"; inserts[0] != want {
+		t.Fatalf("insert %q", inserts[0])
+	}
+}
+
+func TestSinkClickHouseFailedFlush(t *testing.T) {
+	cs := &clickhouseStandIn{status: http.StatusInternalServerError}
+	sc := newTestClickHouse(t, cs, KeyValueConf{"batchRows": 1, "retries": 1})
+	done, failed := 0, 0
+	data := &TaskData{Payload: map[string]interface{}{"id": 1}, done: func() { done++ }, fail: func() { failed++ }}
+	sc.DoSink(data)
+	data.Done()
+	if n := len(cs.inserts()); n != 2 {
+		t.Fatalf("inserted %d times, want a retry", n)
+	}
+	// not acknowledged after retries, the source delivers it again
+	if done != 0 || failed != 1 {
+		t.Fatalf("done %d, failed %d after the rows failed", done, failed)
+	}
+}
+
+func TestSinkClickHouseCloseStopsRetries(t *testing.T) {
+	cs := &clickhouseStandIn{status: http.StatusInternalServerError}
+	sc := newTestClickHouse(t, cs, KeyValueConf{"retries": 10})
+	sc.DoSink(&TaskData{Payload: map[string]interface{}{"id": 1}})
+	start := time.Now()
+	if err := sc.Close(); err == nil || !strings.Contains(err.Error(), "Memory limit") {
+		t.Fatalf("close error %v", err)
+	}
+	if cost := time.Since(start); cost > 2*time.Second {
+		t.Fatalf("close blocked %v by retries", cost)
+	}
+}
+
+func TestSinkClickHouseRowBinaryDescribe(t *testing.T) {
+	cs := &clickhouseStandIn{delay: 2200 * time.Millisecond}
+	// slower than the read timeout of the shared transport, within the configured timeout
+	sc := newTestClickHouse(t, cs, KeyValueConf{"format": ClickHouseRowBinary, "timeout": 10})
+	sc.DoSink(&TaskData{Payload: map[string]interface{}{"id": 7, "name": "ab"}})
+	if err := sc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	inserts := cs.inserts()
+	want := "INSERT INTO `default`.`events` (`id`, `name`) FORMAT RowBinary\n" + string([]byte{7, 0, 0, 0, 2, 'a', 'b'})
+	if len(inserts) != 1 || inserts[0] != want {
+		t.Fatalf("inserts %q", inserts)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !bytes.HasPrefix([]byte(cs.queries[0]), []byte("DESCRIBE TABLE `default`.`events`")) {
+		t.Fatalf("queries %v", cs.queries)
+	}
+}
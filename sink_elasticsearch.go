@@ -2,12 +2,19 @@ package job
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/ywengineer/g-util/es"
 	"go.uber.org/zap"
+	"io"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -18,13 +25,41 @@ func init() {
 	})
 }
 
+const (
+	ESOpIndex  = "index"
+	ESOpCreate = "create"
+)
+
+// esDateToken matches the date placeholders of an index name, which start with +, e.g. player-sign-{+yyyy.MM.dd},
+// so fields like {d} or {dd} are not taken as dates.
+var esDateToken = regexp.MustCompile(`^\+[-_./yMdHms]*[yMdH][-_./yMdHms]*$`)
+
+var esDateLayout = strings.NewReplacer("yyyy", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15", "mm", "04", "ss", "05")
+
+// SinkES indexes payloads into the index mapped from the indicesKey metadata. an index name may hold date
+// placeholders, e.g. player-sign-{+yyyy.MM.dd}, formatted with the timestamp payload field, the timestamp metadata
+// of kafka or now, and payload or metadata fields, e.g. player-{server}. opType create writes data streams.
+// ilmPolicies, indexTemplates and legacyTemplates are installed at startup.
+// the document id is a field or a template over payload and metadata fields, e.g. {sf-id} or {uid}-{day}, the id field
+// or the _id of hits read by ESSource by default. routing is a template too. version is a field of external versions, e.g. offset or updated_at,
+// an older version of a replay is skipped by elasticsearch.
 type SinkES struct {
-	conf       *SinkConf
-	log        *zap.Logger
-	_es        *esapi.API
-	indicesMap map[interface{}]interface{}
-	indicesKey string
-	ctx        context.Context
+	conf          *SinkConf
+	log           *zap.Logger
+	_es           *esapi.API
+	indicesMap    map[interface{}]interface{}
+	indicesKey    string
+	ctx           context.Context
+	opType        string
+	timestamp     string
+	timestampMeta string
+	timestampUnit time.Duration
+	utc           bool
+	docID         string
+	idRequired    bool
+	routing       string
+	version       string
+	versionType   string
 }
 
 func (sm *SinkES) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
@@ -51,6 +86,68 @@ func (sm *SinkES) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
 	} else {
 		sm._es = es.NewESClient(conf.Metadata.GetStringSlice(ConfAddress), log)
 	}
+	//
+	sm.opType = conf.Metadata.GetStringOrDefault("opType", ESOpIndex)
+	if sm.opType != ESOpIndex && sm.opType != ESOpCreate {
+		log.Panic("unsupported opType for SinkES", sm.tag(), zap.String("opType", sm.opType))
+	}
+	sm.timestamp = conf.Metadata.GetString("timestamp")
+	sm.timestampMeta = conf.Metadata.GetStringOrDefault("timestampMeta", "timestamp")
+	unit := conf.Metadata.GetStringOrDefault("timestampUnit", "ms")
+	if sm.timestampUnit = esTimestampUnits[unit]; sm.timestampUnit == 0 {
+		log.Panic("unsupported timestampUnit for SinkES", sm.tag(), zap.String("timestampUnit", unit))
+	}
+	sm.utc = !conf.Metadata.Contains("utc") || conf.Metadata.GetBool("utc")
+	sm.idRequired = conf.Metadata.Contains("id")
+	if sm.idRequired {
+		sm.docID = esTemplate(conf.Metadata.GetString("id"))
+	}
+	if conf.Metadata.Contains("routing") {
+		sm.routing = esTemplate(conf.Metadata.GetString("routing"))
+	}
+	sm.version = conf.Metadata.GetString("version")
+	if len(sm.version) > 0 {
+		if sm.opType == ESOpCreate {
+			log.Panic("version of SinkES only works with opType index", sm.tag())
+		}
+		sm.versionType = conf.Metadata.GetStringOrDefault("versionType", "external")
+		if sm.versionType != "external" && sm.versionType != "external_gte" {
+			log.Panic("unsupported versionType for SinkES", sm.tag(), zap.String("versionType", sm.versionType))
+		}
+	}
+	sm.install(conf.Metadata)
+}
+
+// install puts the ilm policies before the templates using them, a template is installed by its name.
+func (sm *SinkES) install(conf KeyValueConf) {
+	put := func(kind string, bodies KeyValueConf, do func(name string, body io.Reader) (*esapi.Response, error)) {
+		names := make([]string, 0, len(bodies))
+		for name := range bodies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			body, err := esBody(bodies[name])
+			if err != nil {
+				sm.log.Panic("bad "+kind+" config for SinkES", sm.tag(), zap.String("name", name), zap.Error(err))
+			}
+			res, err := do(name, body)
+			if err != nil || res.IsError() {
+				sm.log.Panic("install "+kind+" failed", sm.tag(), zap.String("name", name), zap.Error(err), zap.String("info", res.String()))
+			}
+			_ = res.Body.Close()
+			sm.log.Info(kind+" installed", sm.tag(), zap.String("name", name))
+		}
+	}
+	put("ilm policy", conf.GetKeyValueConf("ilmPolicies"), func(name string, body io.Reader) (*esapi.Response, error) {
+		return sm._es.ILM.PutLifecycle(name, sm._es.ILM.PutLifecycle.WithBody(body), sm._es.ILM.PutLifecycle.WithContext(sm.ctx))
+	})
+	put("index template", conf.GetKeyValueConf("indexTemplates"), func(name string, body io.Reader) (*esapi.Response, error) {
+		return sm._es.Indices.PutIndexTemplate(name, body, sm._es.Indices.PutIndexTemplate.WithContext(sm.ctx))
+	})
+	put("legacy template", conf.GetKeyValueConf("legacyTemplates"), func(name string, body io.Reader) (*esapi.Response, error) {
+		return sm._es.Indices.PutTemplate(name, body, sm._es.Indices.PutTemplate.WithContext(sm.ctx))
+	})
 }
 
 func (sm *SinkES) DoSink(message *TaskData) {
@@ -85,18 +182,29 @@ func (sm *SinkES) sink(data interface{}, indices string, message *TaskData) {
 		buf := reqBodyBufPool.Get()
 		defer buf.Free()
 		//
-		for _, item := range slice {
-			if id, ok := item["id"]; ok {
-				docID := strconv.FormatUint(id.(uint64), 10)
-				buf.AppendString(`{"index" : { "_index" : "` + indices + `", "_id" : "` + docID + `" }}`)
-			} else {
-				buf.AppendString(`{"index" : { "_index" : "` + indices + `" }}`)
+		for i, item := range slice {
+			meta := esItemMeta(message.Metadata, i, len(slice))
+			index, e := sm.index(indices, item, meta)
+			if e != nil {
+				sm.log.Error("resolve index failed", sm.tag(), zap.String("indices", indices), zap.Error(e), zap.Any("data", item))
+				continue
 			}
+			doc, e := sm.document(item, meta)
+			if e != nil {
+				sm.log.Error("resolve document failed", sm.tag(), zap.String("indices", indices), zap.Error(e), zap.Any("data", item))
+				continue
+			}
+			doc["_index"] = index
+			action, _ := jsonApi.MarshalToString(map[string]interface{}{sm.opType: doc})
+			buf.AppendString(action)
 			itemJsonString, _ := jsonApi.MarshalToString(item)
 			buf.AppendString("\n")
 			buf.AppendString(itemJsonString)
 			buf.AppendString("\n")
 		}
+		if buf.Len() == 0 {
+			return
+		}
 		//
 		bulk := sm._es.Bulk
 		res, err := bulk(
@@ -113,6 +221,8 @@ func (sm *SinkES) sink(data interface{}, indices string, message *TaskData) {
 				zap.Any("data", message),
 				zap.String("info", res.String()),
 				zap.String("body", buf.String()))
+		} else if failed, e := esBulkFailed(res.Body, len(sm.version) > 0); e != nil || len(failed) > 0 {
+			sm.log.Error("execute insert failed", sm.tag(), zap.Error(e), zap.String("indices", indices), zap.Any("items", failed))
 		}
 		if res != nil {
 			_ = res.Body.Close()
@@ -120,18 +230,28 @@ func (sm *SinkES) sink(data interface{}, indices string, message *TaskData) {
 	case reflect.Map:
 		if json, e := jsonApi.MarshalToString(data); e != nil {
 			sm.log.Error("encode map to json failed.", sm.tag(), zap.String("indices", indices), zap.Any("data", message))
+		} else if index, e := sm.index(indices, data.(map[string]interface{}), message.Metadata); e != nil {
+			sm.log.Error("resolve index failed", sm.tag(), zap.String("indices", indices), zap.Error(e), zap.Any("data", message))
+		} else if doc, e := sm.document(data.(map[string]interface{}), message.Metadata); e != nil {
+			sm.log.Error("resolve document failed", sm.tag(), zap.String("indices", indices), zap.Error(e), zap.Any("data", message))
 		} else {
 			insert := sm._es.Index
 			//
-			var res *esapi.Response
-			if id, ok := data.(map[string]interface{})["id"]; ok {
-				docID := strconv.FormatUint(id.(uint64), 10)
-				res, e = insert(indices, strings.NewReader(json), insert.WithDocumentID(docID), insert.WithContext(sm.ctx))
-			} else {
-				res, e = insert(indices, strings.NewReader(json), insert.WithContext(sm.ctx))
+			opts := []func(*esapi.IndexRequest){insert.WithOpType(sm.opType), insert.WithContext(sm.ctx)}
+			if id, ok := doc["_id"]; ok {
+				opts = append(opts, insert.WithDocumentID(id.(string)))
+			}
+			if routing, ok := doc["routing"]; ok {
+				opts = append(opts, insert.WithRouting(routing.(string)))
 			}
+			if version, ok := doc["version"]; ok {
+				opts = append(opts, insert.WithVersion(int(version.(int64))), insert.WithVersionType(sm.versionType))
+			}
+			res, e := insert(index, strings.NewReader(json), opts...)
 			//
-			if e != nil || res.IsError() {
+			if e == nil && res.StatusCode == 409 && len(sm.version) > 0 {
+				sm.log.Debug("skip older version", sm.tag(), zap.String("index", index), zap.Any("doc", doc))
+			} else if e != nil || res.IsError() {
 				sm.log.Error("execute insert failed", sm.tag(), zap.String("indices", indices), zap.Any("data", message))
 			}
 			if res != nil {
@@ -143,6 +263,214 @@ func (sm *SinkES) sink(data interface{}, indices string, message *TaskData) {
 	}
 }
 
+// index fills the date placeholders and fields of an index name.
+func (sm *SinkES) index(pattern string, item map[string]interface{}, meta KeyValueConf) (string, error) {
+	if !strings.Contains(pattern, "{") {
+		return pattern, nil
+	}
+	var t time.Time
+	var err error
+	var missing []string
+	index := templateField.ReplaceAllStringFunc(pattern, func(s string) string {
+		token := s[1 : len(s)-1]
+		if esDateToken.MatchString(token) {
+			if t.IsZero() && err == nil {
+				t, err = sm.time(item, meta)
+			}
+			return t.Format(esDateLayout.Replace(token[1:]))
+		}
+		if v, ok := item[token]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		if v, ok := meta[token]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		missing = append(missing, token)
+		return ""
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "", errors.New("missing index fields: " + strings.Join(missing, ","))
+	}
+	return index, nil
+}
+
+// document returns the id, routing and version of an item in bulk action keys.
+func (sm *SinkES) document(item map[string]interface{}, meta KeyValueConf) (map[string]interface{}, error) {
+	values := templateFields(item, meta)
+	doc := make(map[string]interface{}, 4)
+	if !sm.idRequired {
+		// the default id field of the payload, sources like mqtt set an id metadata of their own,
+		// or the _id metadata of a hit read by ESSource
+		if id, ok := item["id"]; ok && id != nil {
+			doc["_id"] = fmt.Sprint(id)
+		} else if id, ok := meta["_id"].(string); ok && len(id) > 0 {
+			doc["_id"] = id
+		}
+	} else if id, err := fillTemplate(sm.docID, values); err == nil {
+		doc["_id"] = id
+	} else {
+		return nil, err
+	}
+	if len(sm.routing) > 0 {
+		routing, err := fillTemplate(sm.routing, values)
+		if err != nil {
+			return nil, err
+		}
+		doc["routing"] = routing
+	}
+	if len(sm.version) > 0 {
+		v, ok := values[sm.version]
+		if !ok || v == nil {
+			return nil, errors.New("missing version field: " + sm.version)
+		}
+		version, err := esVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		doc["version"] = version
+		doc["version_type"] = sm.versionType
+	}
+	return doc, nil
+}
+
+// time is the timestamp of the payload field, or the timestamp metadata, or now.
+func (sm *SinkES) time(item map[string]interface{}, meta KeyValueConf) (time.Time, error) {
+	t := time.Now()
+	if v, ok := item[sm.timestamp]; ok && v != nil && len(sm.timestamp) > 0 {
+		pt, err := esTimestamp(v, sm.timestampUnit)
+		if err != nil {
+			return t, err
+		}
+		t = pt
+	} else if v, ok := meta[sm.timestampMeta]; ok && v != nil {
+		// kafka before 0.10 leaves a zero timestamp
+		if pt, err := esTimestamp(v, sm.timestampUnit); err == nil && !pt.IsZero() {
+			t = pt
+		}
+	}
+	if sm.utc {
+		return t.UTC(), nil
+	}
+	return t.Local(), nil
+}
+
 func (sm *SinkES) tag() zap.Field {
 	return zap.String("tag", "SinkES")
 }
+
+// esItemMeta returns the metadata of the i-th of n items, the lists of _index and _id metadata set per item,
+// e.g. by ESSource, are replaced by the values of the item.
+func esItemMeta(meta KeyValueConf, i, n int) KeyValueConf {
+	var item KeyValueConf
+	for _, key := range []string{"_index", "_id"} {
+		values, ok := meta[key].([]string)
+		if !ok || len(values) != n {
+			continue
+		}
+		if item == nil {
+			item = make(KeyValueConf, len(meta))
+			for k, v := range meta {
+				item[k] = v
+			}
+		}
+		item[key] = values[i]
+	}
+	if item == nil {
+		return meta
+	}
+	return item
+}
+
+// esTemplate makes a field name a template of the field.
+func esTemplate(s string) string {
+	if templateField.MatchString(s) {
+		return s
+	}
+	return "{" + s + "}"
+}
+
+// esVersion converts a number or a time to an external version, times in unix milliseconds.
+func esVersion(v interface{}) (int64, error) {
+	switch v.(type) {
+	case time.Time:
+		return v.(time.Time).UnixNano() / int64(time.Millisecond), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v.(string)); err == nil {
+			return t.UnixNano() / int64(time.Millisecond), nil
+		}
+	}
+	n, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad version %v", v)
+	}
+	return n, nil
+}
+
+// esBody encodes a request body config, a string is used as is.
+func esBody(v interface{}) (io.Reader, error) {
+	if s, ok := v.(string); ok {
+		return strings.NewReader(s), nil
+	}
+	b, err := jsonApi.Marshal(plainValue(v))
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(string(b)), nil
+}
+
+// esBulkFailed returns the failed items of a bulk response, version conflicts are skipped with external versions.
+func esBulkFailed(body io.Reader, versioned bool) ([]interface{}, error) {
+	var result struct {
+		Errors bool                                `json:"errors"`
+		Items  []map[string]map[string]interface{} `json:"items"`
+	}
+	if err := jsonApi.NewDecoder(body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	var failed []interface{}
+	for _, item := range result.Items {
+		for _, r := range item {
+			if status, _ := r["status"].(json.Number); versioned && status == "409" {
+				continue
+			}
+			if _, ok := r["error"]; ok {
+				failed = append(failed, r)
+			}
+		}
+	}
+	return failed, nil
+}
+
+// esTimestampUnits are the units of unix timestamps.
+var esTimestampUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// esTimestamp parses a time.Time, an RFC3339 string or a unix timestamp in unit.
+func esTimestamp(v interface{}, unit time.Duration) (time.Time, error) {
+	switch v.(type) {
+	case time.Time:
+		return v.(time.Time), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v.(string)); err == nil {
+			return t, nil
+		}
+	}
+	if n, err := strconv.ParseInt(fmt.Sprint(v), 10, 64); err == nil {
+		return time.Unix(0, n*int64(unit)), nil
+	}
+	n, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp %v", v)
+	}
+	return time.Unix(0, int64(n*float64(unit))), nil
+}
@@ -0,0 +1,148 @@
+package job
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSinkESDocument(t *testing.T) {
+	sm := &SinkES{idRequired: true, docID: esTemplate("id"), routing: esTemplate("{uid}-{topic}"), version: "offset", versionType: "external"}
+	// an mqtt packet id or a redis entry id in metadata never replaces the payload id
+	meta := KeyValueConf{"id": 17, "topic": "sign", "offset": int64(5)}
+	doc, err := sm.document(map[string]interface{}{"id": "p-1", "uid": 7, "topic": nil}, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["_id"] != "p-1" || doc["routing"] != "7-sign" || doc["version"] != int64(5) {
+		t.Fatalf("document %v", doc)
+	}
+	// metadata fills the fields missing from the payload
+	doc, err = sm.document(map[string]interface{}{"uid": 7}, meta)
+	if err != nil || doc["_id"] != "17" {
+		t.Fatalf("document %v, error %v", doc, err)
+	}
+}
+
+func TestSinkESIndex(t *testing.T) {
+	sm := &SinkES{timestampMeta: "timestamp", timestampUnit: time.Millisecond, utc: true}
+	meta := KeyValueConf{"server": "meta"}
+	index, err := sm.index("player-{server}-{+yyyy}", map[string]interface{}{"server": "s1"}, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "player-s1-" + time.Now().UTC().Format("2006"); index != want {
+		t.Fatalf("index %s, want %s", index, want)
+	}
+	if index, _ = sm.index("player-{server}", map[string]interface{}{}, meta); index != "player-meta" {
+		t.Fatalf("index %s", index)
+	}
+}
+
+func TestSinkESIndexDate(t *testing.T) {
+	sm := &SinkES{timestamp: "ts", timestampMeta: "timestamp", timestampUnit: time.Millisecond, utc: true}
+	ts := time.Date(2024, 3, 5, 7, 0, 0, 0, time.UTC).UnixNano() / int64(time.Millisecond)
+	cases := []struct {
+		pattern string
+		item    map[string]interface{}
+		want    string
+	}{
+		{"player-sign-{+yyyy.MM.dd}", map[string]interface{}{"ts": ts}, "player-sign-2024.03.05"},
+		{"logs-{+yyyy-MM}-{+HH}", map[string]interface{}{"ts": ts}, "logs-2024-03-07"},
+		// fields named like date patterns are fields
+		{"shard-{d}-{H}-{dd}", map[string]interface{}{"ts": ts, "d": 1, "H": "h", "dd": "x"}, "shard-1-h-x"},
+		{"player-{yyyy}", map[string]interface{}{"ts": ts, "yyyy": "field"}, "player-field"},
+	}
+	for _, c := range cases {
+		if index, err := sm.index(c.pattern, c.item, KeyValueConf{}); err != nil || index != c.want {
+			t.Errorf("index of %s: %s, %v, want %s", c.pattern, index, err, c.want)
+		}
+	}
+	if _, err := sm.index("shard-{d}", map[string]interface{}{}, KeyValueConf{}); err == nil {
+		t.Error("missing field {d} not reported")
+	}
+}
+
+// esInstallStandIn records the install requests, and fails the ones of a failed name.
+type esInstallStandIn struct {
+	mu       sync.Mutex
+	requests []string
+	failed   string
+}
+
+func (es *esInstallStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/" {
+		_, _ = w.Write([]byte(`{"version":{"number":"7.10.0"}}`))
+		return
+	}
+	es.mu.Lock()
+	es.requests = append(es.requests, r.Method+" "+r.URL.Path+" "+string(body))
+	es.mu.Unlock()
+	if len(es.failed) > 0 && r.URL.Path[len(r.URL.Path)-len(es.failed):] == es.failed {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"bad template"}`))
+		return
+	}
+	_, _ = w.Write([]byte(`{"acknowledged":true}`))
+}
+
+func newTestSinkES(t *testing.T, es *esInstallStandIn, install KeyValueConf) *SinkES {
+	srv := httptest.NewServer(es)
+	t.Cleanup(srv.Close)
+	conf := KeyValueConf{
+		ConfAddress:  []interface{}{srv.URL},
+		"indicesMap": map[interface{}]interface{}{"sign": "player-sign"},
+		"indicesKey": "topic",
+	}
+	for k, v := range install {
+		conf[k] = v
+	}
+	sm := &SinkES{}
+	sm.init(&SinkConf{Type: "elastic", Metadata: conf}, context.Background(), zap.NewNop())
+	return sm
+}
+
+func TestSinkESInstall(t *testing.T) {
+	es := &esInstallStandIn{}
+	newTestSinkES(t, es, KeyValueConf{
+		"indexTemplates":  map[interface{}]interface{}{"logs": map[interface{}]interface{}{"index_patterns": []interface{}{"logs-*"}}},
+		"ilmPolicies":     map[interface{}]interface{}{"hot-warm": `{"policy":{"phases":{}}}`, "cold": map[interface{}]interface{}{"policy": map[interface{}]interface{}{}}},
+		"legacyTemplates": map[interface{}]interface{}{"old": map[interface{}]interface{}{"index_patterns": []interface{}{"old-*"}}},
+	})
+	// the policies go first, as the templates refer to them
+	want := []string{
+		`PUT /_ilm/policy/cold {"policy":{}}`,
+		`PUT /_ilm/policy/hot-warm {"policy":{"phases":{}}}`,
+		`PUT /_index_template/logs {"index_patterns":["logs-*"]}`,
+		`PUT /_template/old {"index_patterns":["old-*"]}`,
+	}
+	if !reflect.DeepEqual(es.requests, want) {
+		t.Fatalf("requests\n%v\nwant\n%v", es.requests, want)
+	}
+}
+
+func TestSinkESInstallFailed(t *testing.T) {
+	es := &esInstallStandIn{failed: "logs"}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for a failed template install")
+		}
+		if len(es.requests) != 2 {
+			t.Fatalf("requests %v, want no install after the failed one", es.requests)
+		}
+	}()
+	newTestSinkES(t, es, KeyValueConf{
+		"ilmPolicies":     map[interface{}]interface{}{"hot": map[interface{}]interface{}{"policy": map[interface{}]interface{}{}}},
+		"indexTemplates":  map[interface{}]interface{}{"logs": map[interface{}]interface{}{"index_patterns": []interface{}{"logs-*"}}},
+		"legacyTemplates": map[interface{}]interface{}{"old": map[interface{}]interface{}{"index_patterns": []interface{}{"old-*"}}},
+	})
+}
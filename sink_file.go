@@ -0,0 +1,522 @@
+package job
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("file", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkFile{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	FileSyncNever  = "never"
+	FileSyncClose  = "close"
+	FileSyncAlways = "always"
+)
+
+// fileTimeTokens are the time placeholders of a path template.
+var fileTimeTokens = map[string]string{
+	"yyyy": "2006",
+	"MM":   "01",
+	"dd":   "02",
+	"HH":   "15",
+	"mm":   "04",
+}
+
+// partFile is an open output file. data is written to path.tmp, which is renamed to path once finished.
+// size counts the written data, compressed the output of the compressor.
+type partFile struct {
+	path       string
+	file       *os.File
+	buf        *bufio.Writer
+	comp       io.WriteCloser
+	compressed *countWriter
+	w          io.Writer
+	size       int64
+	opened     time.Time
+	written    time.Time
+}
+
+func (pf *partFile) write(data []byte) error {
+	n, err := pf.w.Write(data)
+	pf.size += int64(n)
+	pf.written = time.Now()
+	return err
+}
+
+// full reports whether next bytes exceed maxSize, by the compressed size if compressed.
+func (pf *partFile) full(maxSize int64, next int) bool {
+	if maxSize <= 0 || pf.size == 0 {
+		return false
+	}
+	if pf.compressed != nil {
+		return pf.compressed.n >= maxSize
+	}
+	return pf.size+int64(next) > maxSize
+}
+
+// bytes is the size of the file once finished.
+func (pf *partFile) bytes() int64 {
+	if pf.compressed != nil {
+		return pf.compressed.n
+	}
+	return pf.size
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (pf *partFile) flush(sync bool) error {
+	if f, ok := pf.comp.(interface{ Flush() error }); ok && sync {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := pf.buf.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return pf.file.Sync()
+	}
+	return nil
+}
+
+// finish closes the file and renames it to the final path.
+func (pf *partFile) finish(sync bool) error {
+	err := func() error {
+		if pf.comp != nil {
+			if err := pf.comp.Close(); err != nil {
+				return err
+			}
+		}
+		if err := pf.buf.Flush(); err != nil {
+			return err
+		}
+		if sync {
+			return pf.file.Sync()
+		}
+		return nil
+	}()
+	if e := pf.file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(pf.path+".tmp", pf.path)
+}
+
+// SinkFile writes jsonl, csv or parquet files. the path template takes payload fields, or metadata if missing, the time
+// tokens {yyyy} {MM} {dd} {HH} {mm} and the part number {n}, e.g. /data/{topic}/{yyyy}/{MM}/{dd}/part-{n}.jsonl
+// the time tokens are the processing time of an item, not a payload timestamp, so late data lands in the current partition.
+// a file is rotated by size or age, and renamed from .tmp to its final name once closed. maxSize counts the bytes
+// in the file, compressed with compression, so a file may exceed it by the data still buffered in the compressor.
+type SinkFile struct {
+	conf        *SinkConf
+	log         *zap.Logger
+	ctx         context.Context
+	path        string
+	format      string
+	columns     []string
+	header      bool
+	compression string
+	parquet     *parquetFormat
+	fsync       string
+	maxSize     int64
+	maxAge      time.Duration
+	idle        time.Duration
+	utc         bool
+	mu          sync.Mutex
+	files       map[string]*partFile
+	closed      bool
+	stop        chan bool
+}
+
+func (sf *SinkFile) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	sf.conf = conf
+	sf.log = log
+	sf.ctx = ctx
+	sf.path = conf.Metadata.GetString("path")
+	if len(sf.path) == 0 {
+		log.Panic("missing path config for SinkFile", sf.tag())
+	}
+	sf.maxSize = conf.Metadata.GetInt64("maxSize")
+	sf.format = conf.Metadata.GetStringOrDefault("format", "jsonl")
+	switch sf.format {
+	case "jsonl":
+	case "csv":
+		sf.columns = conf.Metadata.GetStringSlice("columns")
+		if len(sf.columns) == 0 {
+			log.Panic("missing columns config of csv format for SinkFile", sf.tag())
+		}
+		sf.header = conf.Metadata.GetBool("header")
+	case "parquet":
+		sf.parquet = newParquetFormat(conf.Metadata.GetKeyValueConf("parquet"), sf.maxSize, log)
+	default:
+		log.Panic("unsupported format for SinkFile", sf.tag(), zap.String("format", sf.format))
+	}
+	sf.compression = conf.Metadata.GetString("compression")
+	switch sf.compression {
+	case "", "gzip", "zstd":
+	default:
+		log.Panic("unsupported compression for SinkFile", sf.tag(), zap.String("compression", sf.compression))
+	}
+	if sf.parquet != nil && len(sf.compression) > 0 {
+		log.Panic("parquet format is compressed by parquet.compression of SinkFile", sf.tag())
+	}
+	sf.fsync = conf.Metadata.GetStringOrDefault("fsync", FileSyncClose)
+	switch sf.fsync {
+	case FileSyncNever, FileSyncClose, FileSyncAlways:
+	default:
+		log.Panic("unsupported fsync for SinkFile", sf.tag(), zap.String("fsync", sf.fsync))
+	}
+	sf.maxAge = time.Duration(conf.Metadata.GetInt("maxAge")) * time.Second
+	sf.idle = time.Duration(conf.Metadata.GetInt("idleTimeout")) * time.Second
+	if sf.idle <= 0 {
+		sf.idle = time.Minute
+	}
+	sf.utc = conf.Metadata.GetBool("utc")
+	sf.files = make(map[string]*partFile)
+	sf.stop = make(chan bool)
+	go sf.rotateLoop()
+}
+
+func (sf *SinkFile) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			sf.log.Error("catch panic event.", sf.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.closed {
+		sf.log.Error("sink file is closed", sf.tag(), zap.Any("meta", message.Metadata))
+		return
+	}
+	items := payloadItems(message.Payload)
+	if sf.parquet != nil {
+		if err := sf.parquet.infer(items); err != nil {
+			sf.log.Error("write file failed", sf.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+			return
+		}
+	}
+	touched := make(map[*partFile]bool)
+	for _, item := range items {
+		if pf, err := sf.write(item, message.Metadata); err != nil {
+			sf.log.Error("write file failed", sf.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+		} else if pf != nil {
+			touched[pf] = true
+		}
+	}
+	if sf.fsync == FileSyncAlways {
+		for pf := range touched {
+			if err := pf.flush(true); err != nil {
+				sf.log.Error("sync file failed", sf.tag(), zap.String("path", pf.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Close finishes all open files.
+func (sf *SinkFile) Close() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.closed {
+		return nil
+	}
+	sf.closed = true
+	close(sf.stop)
+	var errs []string
+	for key, pf := range sf.files {
+		if err := sf.finish(key, pf); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (sf *SinkFile) write(item interface{}, meta KeyValueConf) (*partFile, error) {
+	fields, _ := item.(map[string]interface{})
+	key, err := sf.partition(meta, fields)
+	if err != nil {
+		return nil, err
+	}
+	line, err := sf.encode(item)
+	if err != nil {
+		return nil, err
+	}
+	pf := sf.files[key]
+	if pf != nil && (pf.full(sf.maxSize, len(line)) || (sf.maxAge > 0 && time.Since(pf.opened) >= sf.maxAge)) {
+		if err := sf.finish(key, pf); err != nil {
+			sf.log.Error("finish file failed", sf.tag(), zap.String("path", pf.path), zap.Error(err))
+		}
+		pf = nil
+	}
+	if pf == nil {
+		if pf, err = sf.open(key); err != nil {
+			return nil, err
+		}
+		sf.files[key] = pf
+	}
+	return pf, pf.write(line)
+}
+
+// partition renders the path template except the part number.
+func (sf *SinkFile) partition(meta KeyValueConf, fields map[string]interface{}) (string, error) {
+	now := time.Now()
+	if sf.utc {
+		now = now.UTC()
+	}
+	return fillPath(sf.path, now, meta, fields, "n")
+}
+
+func (sf *SinkFile) encode(item interface{}) ([]byte, error) {
+	if sf.parquet != nil {
+		return sf.parquet.encode(item)
+	}
+	if sf.format == "csv" {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("csv format requires map payloads")
+		}
+		record := make([]string, len(sf.columns))
+		for i, col := range sf.columns {
+			record[i] = fileCsvValue(fields[col])
+		}
+		return fileCsvLine(record)
+	}
+	return jsonLine(item)
+}
+
+// open creates the next part file of the partition key, the part number skips existing files.
+func (sf *SinkFile) open(key string) (*partFile, error) {
+	path := key
+	if strings.Contains(key, "{n}") {
+		for n := 0; ; n++ {
+			path = strings.Replace(key, "{n}", strconv.Itoa(n), -1)
+			if sf.compression == "gzip" && !strings.HasSuffix(path, ".gz") {
+				path += ".gz"
+			} else if sf.compression == "zstd" && !strings.HasSuffix(path, ".zst") {
+				path += ".zst"
+			}
+			if !fileExists(path) && !fileExists(path+".tmp") {
+				break
+			}
+		}
+	} else {
+		if sf.compression == "gzip" && !strings.HasSuffix(path, ".gz") {
+			path += ".gz"
+		} else if sf.compression == "zstd" && !strings.HasSuffix(path, ".zst") {
+			path += ".zst"
+		}
+		if fileExists(path) {
+			return nil, errors.New("file exists, add {n} to the path template for rotation: " + path)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	pf := &partFile{path: path, file: f, buf: bufio.NewWriterSize(f, 64*1024), opened: now, written: now}
+	pf.w = pf.buf
+	switch sf.compression {
+	case "gzip":
+		pf.compressed = &countWriter{w: pf.buf}
+		pf.comp = gzip.NewWriter(pf.compressed)
+		pf.w = pf.comp
+	case "zstd":
+		pf.compressed = &countWriter{w: pf.buf}
+		enc, err := zstd.NewWriter(pf.compressed)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		pf.comp = enc
+		pf.w = enc
+	}
+	if sf.parquet != nil {
+		pw, err := sf.parquet.writer(pf.buf)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		pf.comp = pw
+		pf.w = pw
+	}
+	if sf.format == "csv" && sf.header {
+		header, _ := fileCsvLine(sf.columns)
+		if err := pf.write(header); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	sf.log.Info("file opened", sf.tag(), zap.String("path", path+".tmp"))
+	return pf, nil
+}
+
+func (sf *SinkFile) finish(key string, pf *partFile) error {
+	delete(sf.files, key)
+	if err := pf.finish(sf.fsync != FileSyncNever); err != nil {
+		return err
+	}
+	sf.log.Info("file finished", sf.tag(), zap.String("path", pf.path), zap.Int64("size", pf.bytes()))
+	return nil
+}
+
+// rotateLoop finishes aged and idle files, a time partitioned path leaves the previous file idle.
+func (sf *SinkFile) rotateLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sf.stop:
+			return
+		case <-ticker.C:
+		}
+		sf.mu.Lock()
+		for key, pf := range sf.files {
+			if (sf.maxAge > 0 && time.Since(pf.opened) >= sf.maxAge) || time.Since(pf.written) >= sf.idle {
+				if err := sf.finish(key, pf); err != nil {
+					sf.log.Error("finish file failed", sf.tag(), zap.String("path", pf.path), zap.Error(err))
+				}
+			} else if sf.fsync != FileSyncAlways {
+				// written lines become visible in the .tmp file
+				if err := pf.flush(false); err != nil {
+					sf.log.Error("flush file failed", sf.tag(), zap.String("path", pf.path), zap.Error(err))
+				}
+			}
+		}
+		sf.mu.Unlock()
+	}
+}
+
+func (sf *SinkFile) tag() zap.Field {
+	return zap.String("tag", "SinkFile")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// jsonLine encodes an item as a json line, raw bytes and strings are written as is.
+func jsonLine(item interface{}) ([]byte, error) {
+	var data []byte
+	switch item.(type) {
+	case []byte:
+		data = append([]byte(nil), item.([]byte)...)
+	case string:
+		data = []byte(item.(string))
+	default:
+		b, err := jsonApi.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	}
+	return append(data, '\n'), nil
+}
+
+func fileCsvLine(record []string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func fileCsvValue(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v.(string)
+	case []byte:
+		return string(v.([]byte))
+	case json.Number, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v)
+	default:
+		s, err := jsonApi.MarshalToString(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return s
+	}
+}
+
+// fillPath fills a path template with the time tokens, payload and metadata fields like templateFields.
+// the keep token is left as is.
+// substituted values are escaped by pathValue, so they never leave the directory of the template.
+func fillPath(template string, now time.Time, meta KeyValueConf, fields map[string]interface{}, keep string) (string, error) {
+	var missing []string
+	path := templateField.ReplaceAllStringFunc(template, func(s string) string {
+		token := s[1 : len(s)-1]
+		if token == keep {
+			return s
+		}
+		if layout, ok := fileTimeTokens[token]; ok {
+			return now.Format(layout)
+		}
+		if v, ok := fields[token]; ok && v != nil {
+			return pathValue(v)
+		}
+		if v, ok := meta[token]; ok && v != nil {
+			return pathValue(v)
+		}
+		missing = append(missing, token)
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", errors.New("missing path fields: " + strings.Join(missing, ","))
+	}
+	return path, nil
+}
+
+var pathEscaper = strings.NewReplacer("/", "_", "\\", "_")
+
+// pathValue replaces path separators and a leading dot with _, so a value is never an absolute path, . or ..
+func pathValue(v interface{}) string {
+	s := pathEscaper.Replace(fmt.Sprint(v))
+	if strings.HasPrefix(s, ".") {
+		s = "_" + s[1:]
+	}
+	return s
+}
@@ -0,0 +1,76 @@
+package job
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestFillPath(t *testing.T) {
+	now := time.Date(2024, 3, 5, 7, 0, 0, 0, time.UTC)
+	cases := []struct {
+		template string
+		meta     KeyValueConf
+		fields   map[string]interface{}
+		want     string
+	}{
+		{"/data/{yyyy}{MM}{dd}/{topic}-{n}.log", KeyValueConf{"topic": "orders"}, nil, "/data/20240305/orders-{n}.log"},
+		{"/data/{type}/{id}.log", KeyValueConf{"type": "meta", "id": 8}, map[string]interface{}{"type": "payload", "id": 7}, "/data/payload/7.log"},
+		{"/data/{type}/{id}.log", KeyValueConf{"type": "meta"}, map[string]interface{}{"type": nil, "id": 7}, "/data/meta/7.log"},
+		{"/data/{type}/x.log", nil, map[string]interface{}{"type": "../../etc"}, "/data/_._.._etc/x.log"},
+		{"/data/{type}/x.log", nil, map[string]interface{}{"type": "/"}, "/data/_/x.log"},
+		{"/data/{type}/x.log", nil, map[string]interface{}{"type": ".."}, "/data/_./x.log"},
+		{"/data/{a}{b}/x.log", nil, map[string]interface{}{"a": ".", "b": "."}, "/data/__/x.log"},
+		{"/data/{type}/x.log", nil, map[string]interface{}{"type": `a\b`}, "/data/a_b/x.log"},
+	}
+	for _, c := range cases {
+		got, err := fillPath(c.template, now, c.meta, c.fields, "n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("fillPath(%s) = %s, want %s", c.template, got, c.want)
+		}
+	}
+	if _, err := fillPath("/data/{missing}.log", now, nil, nil, "n"); err == nil {
+		t.Fatal("missing field accepted")
+	}
+}
+
+func TestSinkFileRotateCompressed(t *testing.T) {
+	for _, c := range []struct {
+		compression string
+		maxFiles    int
+	}{{"", 30}, {"gzip", 3}, {"zstd", 3}} {
+		dir := t.TempDir()
+		sf := &SinkFile{}
+		sf.init(&SinkConf{Type: "file", Metadata: KeyValueConf{
+			"path": filepath.Join(dir, "part-{n}.jsonl"), "maxSize": 4096, "compression": c.compression,
+		}}, context.Background(), zap.NewNop())
+		// 90KB of lines which compress well
+		items := make([]map[string]interface{}, 2000)
+		for i := range items {
+			items[i] = map[string]interface{}{"level": "info", "msg": "user signed in", "seq": i % 10}
+		}
+		sf.DoSink(&TaskData{Payload: items, Metadata: KeyValueConf{}})
+		if err := sf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "part-*"))
+		if len(files) == 0 || len(files) > c.maxFiles {
+			t.Fatalf("%s: %d files, want at most %d", c.compression, len(files), c.maxFiles)
+		}
+		if c.compression == "" && len(files) < 20 {
+			t.Fatalf("%d uncompressed files, want rotation by maxSize", len(files))
+		}
+		for _, f := range files {
+			if info, _ := os.Stat(f); c.compression == "" && info.Size() > 4096 {
+				t.Fatalf("%s: %d bytes over maxSize", f, info.Size())
+			}
+		}
+	}
+}
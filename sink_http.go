@@ -0,0 +1,308 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSink("http", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkHttp{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// httpStatusRange is an inclusive range of http status codes.
+type httpStatusRange struct {
+	min int
+	max int
+}
+
+// SinkHttp sends payload items to an http endpoint, one request per item, or one json array per message with batch.
+// url, header values and body strings are templates filled with payload fields, or metadata if missing, e.g. /users/{id}
+// a body string which is a single placeholder keeps the typed value. without body the item is sent as json.
+// a request failed by the transport, 429 or 5xx is retried with exponential backoff.
+// requests share the fasthttp transport, timeout seconds bound a request and the transport itself fails a response
+// not read within 2 seconds.
+type SinkHttp struct {
+	conf      *SinkConf
+	log       *zap.Logger
+	ctx       context.Context
+	method    string
+	url       string
+	headers   KeyValueConf
+	user      string
+	password  string
+	token     string
+	body      interface{}
+	batch     bool
+	batchSize int
+	success   []httpStatusRange
+	retries   int
+	backoff   time.Duration
+	timeout   time.Duration
+}
+
+func (sh *SinkHttp) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	sh.conf = conf
+	sh.log = log
+	sh.ctx = ctx
+	sh.url = conf.Metadata.GetString("url")
+	if len(sh.url) == 0 {
+		log.Panic("missing url config for SinkHttp", sh.tag())
+	}
+	sh.method = strings.ToUpper(conf.Metadata.GetStringOrDefault("method", http.MethodPost))
+	sh.headers = conf.Metadata.GetKeyValueConf("headers")
+	auth := conf.Metadata.GetKeyValueConf("auth")
+	sh.user = auth.GetString("user")
+	sh.password = auth.GetString("password")
+	sh.token = auth.GetString("token")
+	sh.body = plainValue(conf.Metadata["body"])
+	sh.batch = conf.Metadata.GetBool("batch")
+	sh.batchSize = conf.Metadata.GetInt("batchSize")
+	sh.success = []httpStatusRange{{min: 200, max: 299}}
+	if conf.Metadata.Contains("successStatus") {
+		var codes []string
+		if slice, ok := plainValue(conf.Metadata["successStatus"]).([]interface{}); ok {
+			for _, c := range slice {
+				codes = append(codes, fmt.Sprint(c))
+			}
+		} else {
+			codes = strings.Split(fmt.Sprint(conf.Metadata["successStatus"]), ",")
+		}
+		sh.success = nil
+		for _, s := range codes {
+			r, err := parseHttpStatusRange(s)
+			if err != nil {
+				log.Panic("bad successStatus config for SinkHttp", sh.tag(), zap.Error(err))
+			}
+			sh.success = append(sh.success, r)
+		}
+	}
+	sh.retries = conf.Metadata.GetInt("retries")
+	if !conf.Metadata.Contains("retries") {
+		sh.retries = 3
+	}
+	sh.backoff = time.Duration(conf.Metadata.GetInt("backoff")) * time.Millisecond
+	if sh.backoff <= 0 {
+		sh.backoff = 500 * time.Millisecond
+	}
+	sh.timeout = time.Duration(conf.Metadata.GetInt("timeout")) * time.Second
+	if sh.timeout <= 0 {
+		sh.timeout = 30 * time.Second
+	}
+}
+
+func (sh *SinkHttp) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			sh.log.Error("catch panic event.", sh.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	items := payloadItems(message.Payload)
+	if !sh.batch {
+		for _, item := range items {
+			sh.send([]interface{}{item}, message)
+		}
+		return
+	}
+	size := len(items)
+	if sh.batchSize > 0 {
+		size = sh.batchSize
+	}
+	for start := 0; start < len(items); start += size {
+		end := start + size
+		if end > len(items) {
+			end = len(items)
+		}
+		sh.send(items[start:end], message)
+	}
+}
+
+// send builds one request for the items, the url and headers of a batch are filled with metadata and the first item.
+func (sh *SinkHttp) send(items []interface{}, message *TaskData) {
+	if len(items) == 0 {
+		return
+	}
+	fields := sh.fields(items[0], message.Metadata)
+	url, err := fillTemplate(sh.url, fields)
+	if err != nil {
+		sh.log.Error("build http url failed", sh.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+		return
+	}
+	headers := make(map[string]string, len(sh.headers))
+	for k, v := range sh.headers {
+		if headers[k], err = fillTemplate(fmt.Sprint(v), fields); err != nil {
+			sh.log.Error("build http header failed", sh.tag(), zap.String("header", k), zap.Error(err), zap.Any("meta", message.Metadata))
+			return
+		}
+	}
+	var body []byte
+	if sh.method != http.MethodGet && sh.method != http.MethodHead {
+		if body, err = sh.encode(items, message.Metadata); err != nil {
+			sh.log.Error("build http body failed", sh.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+			return
+		}
+	}
+	//
+	backoff := sh.backoff
+	for attempt := 0; ; attempt++ {
+		status, res, err := sh.do(url, headers, body)
+		if err == nil && sh.succeed(status) {
+			return
+		}
+		retryable := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt >= sh.retries || sh.ctx.Err() != nil {
+			sh.log.Error("http sink failed", sh.tag(), zap.String("url", url), zap.Int("status", status), zap.Error(err),
+				zap.String("response", string(res)), zap.Int("attempts", attempt+1), zap.Any("meta", message.Metadata))
+			return
+		}
+		sh.log.Warn("http sink failed, retry later", sh.tag(), zap.String("url", url), zap.Int("status", status), zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-sh.ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (sh *SinkHttp) do(url string, headers map[string]string, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(sh.ctx, sh.timeout)
+	defer cancel()
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, sh.method, url, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(sh.user) > 0 {
+		req.SetBasicAuth(sh.user, sh.password)
+	} else if len(sh.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+sh.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return roundTripContext(req)
+}
+
+// fields merges the payload fields with metadata, payload fields take precedence.
+func (sh *SinkHttp) fields(item interface{}, meta KeyValueConf) map[string]interface{} {
+	m, _ := item.(map[string]interface{})
+	return templateFields(m, meta)
+}
+
+// encode renders the body of every item. a single item without batch is sent as is, raw bytes and strings unquoted.
+func (sh *SinkHttp) encode(items []interface{}, meta KeyValueConf) ([]byte, error) {
+	rendered := make([]interface{}, len(items))
+	for i, item := range items {
+		if sh.body == nil {
+			rendered[i] = item
+			continue
+		}
+		v, err := sh.render(sh.body, sh.fields(item, meta))
+		if err != nil {
+			return nil, err
+		}
+		rendered[i] = v
+	}
+	if sh.batch {
+		for i, v := range rendered {
+			if raw, ok := v.([]byte); ok {
+				rendered[i] = string(raw)
+			}
+		}
+		return jsonApi.Marshal(rendered)
+	}
+	switch rendered[0].(type) {
+	case []byte:
+		return rendered[0].([]byte), nil
+	case string:
+		return []byte(rendered[0].(string)), nil
+	default:
+		return jsonApi.Marshal(rendered[0])
+	}
+}
+
+// render copies the body template and fills the placeholders of every string.
+func (sh *SinkHttp) render(v interface{}, fields map[string]interface{}) (interface{}, error) {
+	switch v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v.(map[string]interface{})))
+		for k, mv := range v.(map[string]interface{}) {
+			r, err := sh.render(mv, fields)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v.([]interface{})))
+		for i, sv := range v.([]interface{}) {
+			r, err := sh.render(sv, fields)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = r
+		}
+		return s, nil
+	case string:
+		str := v.(string)
+		if loc := templateField.FindStringIndex(str); loc != nil && loc[0] == 0 && loc[1] == len(str) {
+			if fv, ok := fields[str[1:len(str)-1]]; ok && fv != nil {
+				return fv, nil
+			}
+		}
+		return fillTemplate(str, fields)
+	default:
+		return v, nil
+	}
+}
+
+func (sh *SinkHttp) succeed(status int) bool {
+	for _, r := range sh.success {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (sh *SinkHttp) tag() zap.Field {
+	return zap.String("tag", "SinkHttp")
+}
+
+// parseHttpStatusRange parses a status code 200, a class 2xx or a range 200-204.
+func parseHttpStatusRange(s string) (httpStatusRange, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		c, err := strconv.Atoi(s[:1])
+		return httpStatusRange{min: c * 100, max: c*100 + 99}, err
+	}
+	if i := strings.Index(s, "-"); i > 0 {
+		min, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return httpStatusRange{}, err
+		}
+		max, err := strconv.Atoi(s[i+1:])
+		return httpStatusRange{min: min, max: max}, err
+	}
+	c, err := strconv.Atoi(s)
+	return httpStatusRange{min: c, max: c}, err
+}
@@ -0,0 +1,45 @@
+package job
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSinkHttpTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	core, logs := observer.New(zapcore.ErrorLevel)
+	newSink := func(ctx context.Context, timeout int) *SinkHttp {
+		sh := &SinkHttp{}
+		sh.init(&SinkConf{Type: "http", Metadata: KeyValueConf{"url": srv.URL, "retries": 0, "timeout": timeout}}, ctx, zap.New(core))
+		return sh
+	}
+	// within the read timeout of the shared transport and the configured timeout
+	newSink(context.Background(), 5).DoSink(&TaskData{Payload: map[string]interface{}{"id": 1}})
+	if n := logs.Len(); n != 0 {
+		t.Fatalf("request failed: %v", logs.All()[0].ContextMap())
+	}
+	start := time.Now()
+	newSink(context.Background(), 1).DoSink(&TaskData{Payload: map[string]interface{}{"id": 1}})
+	if logs.FilterMessage("http sink failed").Len() != 1 || time.Since(start) > 1400*time.Millisecond {
+		t.Fatalf("timeout not honored, took %v", time.Since(start))
+	}
+	// the shared transport ignores the context, the request is abandoned once the task is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start = time.Now()
+	newSink(ctx, 5).DoSink(&TaskData{Payload: map[string]interface{}{"id": 1}})
+	if logs.FilterMessage("http sink failed").Len() != 2 || time.Since(start) > 1400*time.Millisecond {
+		t.Fatalf("cancel not honored, took %v", time.Since(start))
+	}
+}
@@ -0,0 +1,122 @@
+package job
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+	"reflect"
+	"time"
+)
+
+func init() {
+	RegisterSink("nats", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkNats{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// SinkNats publishes each payload item as json. the subject is a template filled with payload fields,
+// e.g. orders.{status}. JetStream publishes wait for the stream ack up to timeout seconds, or until the task stops.
+// the connection is drained on Close, so buffered core publishes are flushed.
+type SinkNats struct {
+	conf      *SinkConf
+	log       *zap.Logger
+	ctx       context.Context
+	conn      *nats.Conn
+	js        nats.JetStreamContext
+	subject   string
+	jetstream bool
+	timeout   time.Duration
+}
+
+func (sn *SinkNats) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	sn.conf = conf
+	sn.log = log
+	sn.ctx = ctx
+	sn.subject = conf.Metadata.GetString("subject")
+	if len(sn.subject) == 0 {
+		log.Panic("missing subject config for SinkNats", sn.tag())
+	}
+	sn.jetstream = conf.Metadata.GetBool("jetstream")
+	sn.timeout = time.Duration(conf.Metadata.GetInt("timeout")) * time.Second
+	if sn.timeout <= 0 {
+		sn.timeout = 5 * time.Second
+	}
+	sn.conn = newNatsConn(conf.Metadata, log)
+	if sn.jetstream {
+		js, err := sn.conn.JetStream()
+		if err != nil {
+			log.Panic("create jetstream context failed", sn.tag(), zap.Error(err))
+		}
+		sn.js = js
+	}
+}
+
+func (sn *SinkNats) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			sn.log.Error("catch panic event.", sn.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	sn.sink(message.Payload, message)
+}
+
+func (sn *SinkNats) sink(data interface{}, message *TaskData) {
+	kind := reflect.TypeOf(data).Kind()
+	switch kind {
+	case reflect.Ptr:
+		sn.sink(reflect.ValueOf(data).Elem().Interface(), message)
+	case reflect.Slice:
+		if raw, ok := data.([]byte); ok {
+			sn.publish(sn.subject, raw, message)
+			return
+		}
+		for _, item := range data.([]map[string]interface{}) {
+			sn.publishItem(item, message)
+		}
+	case reflect.Map:
+		sn.publishItem(data.(map[string]interface{}), message)
+	case reflect.String:
+		sn.publish(sn.subject, []byte(data.(string)), message)
+	default:
+		sn.log.Error("unknown message kind for sink nats", sn.tag(), zap.Any("kind", kind.String()))
+	}
+}
+
+func (sn *SinkNats) publishItem(item map[string]interface{}, message *TaskData) {
+	subject, err := fillTemplate(sn.subject, item)
+	if err != nil {
+		sn.log.Error("build nats subject failed", sn.tag(), zap.Error(err), zap.Any("item", item))
+		return
+	}
+	data, err := jsonApi.Marshal(item)
+	if err != nil {
+		sn.log.Error("encode map to json failed.", sn.tag(), zap.Error(err), zap.Any("item", item))
+		return
+	}
+	sn.publish(subject, data, message)
+}
+
+func (sn *SinkNats) publish(subject string, data []byte, message *TaskData) {
+	var err error
+	if sn.jetstream {
+		ctx, cancel := context.WithTimeout(sn.ctx, sn.timeout)
+		_, err = sn.js.Publish(subject, data, nats.Context(ctx))
+		cancel()
+	} else if err = sn.ctx.Err(); err == nil {
+		err = sn.conn.Publish(subject, data)
+	}
+	if err != nil {
+		sn.log.Error("publish nats message failed", sn.tag(), zap.String("subject", subject), zap.Error(err), zap.Any("meta", message.Metadata))
+	}
+}
+
+// Close flushes the buffered publishes and closes the connection.
+func (sn *SinkNats) Close() error {
+	return sn.conn.Drain()
+}
+
+func (sn *SinkNats) tag() zap.Field {
+	return zap.String("tag", "SinkNats")
+}
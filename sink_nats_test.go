@@ -0,0 +1,70 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+func TestSinkNats(t *testing.T) {
+	url := runNatsServer(t)
+	nc := natsConn(t, url)
+	received := make(chan *nats.Msg, 10)
+	if _, err := nc.ChanSubscribe("orders.>", received); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sn := &SinkNats{}
+	sn.init(&SinkConf{Type: "nats", Metadata: KeyValueConf{ConfAddress: url, "subject": "orders.{status}"}}, context.Background(), zap.NewNop())
+	sn.DoSink(&TaskData{Payload: []map[string]interface{}{{"id": 1, "status": "created"}, {"id": 2, "status": "paid"}, {"id": 3}}, Metadata: KeyValueConf{}})
+	if err := sn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{"created", "paid"} {
+		select {
+		case msg := <-received:
+			item := make(map[string]interface{})
+			if err := jsonApi.Unmarshal(msg.Data, &item); err != nil || msg.Subject != "orders."+w || item["status"] != w {
+				t.Fatalf("message %s %s, want status %s", msg.Subject, msg.Data, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %s not published", w)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("message %s of an item without the subject field", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSinkNatsJetStream(t *testing.T) {
+	url := runNatsServer(t)
+	js, err := natsConn(t, url).JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "EVENTS", Subjects: []string{"events"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sn := &SinkNats{}
+	sn.init(&SinkConf{Type: "nats", Metadata: KeyValueConf{ConfAddress: url, "subject": "events", "jetstream": true}}, ctx, zap.NewNop())
+	defer sn.Close()
+	sn.DoSink(&TaskData{Payload: []byte("a"), Metadata: KeyValueConf{}})
+	// nothing is published once the task stopped
+	cancel()
+	sn.DoSink(&TaskData{Payload: "b", Metadata: KeyValueConf{}})
+	info, err := js.StreamInfo("EVENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 1 {
+		t.Fatalf("%d messages in stream, want 1", info.State.Msgs)
+	}
+}
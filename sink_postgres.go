@@ -0,0 +1,315 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterSink("postgres", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkPostgres{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	PostgresInsert = "insert"
+	PostgresUpsert = "upsert"
+	PostgresCopy   = "copy"
+)
+
+// postgresStatement is a named statement, a statement built from a table which binds the columns by position,
+// or the target of COPY FROM STDIN.
+type postgresStatement struct {
+	sql        string
+	schema     string
+	table      string
+	columns    []string
+	copy       bool
+	positional bool
+}
+
+// SinkPostgres executes the statement chosen by the sqlMapKey metadata like SinkMySQL. an sql entry is a named
+// statement, e.g. INSERT INTO t (id, name) VALUES (:id, :name) ON CONFLICT (id) DO NOTHING, or a table with columns
+// and mode insert, upsert (conflict and update columns) or copy. copy loads []map batches by COPY FROM STDIN.
+// the columns of a table are quoted and bound by position, so names like user-id or geo.lat work.
+// a batch runs in one transaction, nested values are written as json.
+type SinkPostgres struct {
+	conf      *SinkConf
+	log       *zap.Logger
+	ctx       context.Context
+	db        *sqlx.DB
+	sqlMap    map[string]*postgresStatement
+	sqlMapKey string
+}
+
+func (sp *SinkPostgres) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	sp.conf = conf
+	sp.log = log
+	sp.ctx = ctx
+	sqlConf := conf.Metadata.GetKeyValueConf("sql")
+	if len(sqlConf) == 0 {
+		log.Panic("missing sql config for SinkPostgres", sp.tag())
+	}
+	sp.sqlMap = make(map[string]*postgresStatement, len(sqlConf))
+	for k, v := range sqlConf {
+		sp.sqlMap[k] = sp.statement(k, plainValue(v))
+	}
+	sp.sqlMapKey = conf.Metadata.GetString("sqlMapKey")
+	if len(sp.sqlMapKey) == 0 {
+		log.Panic("missing sqlMapKey config for SinkPostgres", sp.tag())
+	}
+	//
+	if conf.Metadata.GetBool("global") {
+		if _postgres == nil {
+			log.Panic("global postgres client not set.", sp.tag())
+		} else {
+			sp.db = _postgres
+		}
+	} else {
+		sp.db = newPostgresClient(conf.Metadata, log)
+	}
+}
+
+// statement builds the statement of an sql entry, a string is used as is.
+func (sp *SinkPostgres) statement(key string, v interface{}) *postgresStatement {
+	if s, ok := v.(string); ok {
+		return &postgresStatement{sql: s}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		sp.log.Panic("bad sql config for SinkPostgres", sp.tag(), zap.String("key", key))
+	}
+	entry := KeyValueConf(m)
+	ps := &postgresStatement{table: entry.GetString("table"), positional: true}
+	if len(ps.table) == 0 {
+		sp.log.Panic("missing table config for SinkPostgres", sp.tag(), zap.String("key", key))
+	}
+	if i := strings.LastIndex(ps.table, "."); i > 0 {
+		ps.schema, ps.table = ps.table[:i], ps.table[i+1:]
+	}
+	if entry.Contains("columns") {
+		ps.columns = entry.GetStringSlice("columns")
+	}
+	mode := strings.ToLower(entry.GetStringOrDefault("mode", PostgresInsert))
+	if mode == PostgresCopy {
+		ps.copy = true
+		return ps
+	}
+	if len(ps.columns) == 0 {
+		sp.log.Panic("missing columns config for SinkPostgres", sp.tag(), zap.String("key", key))
+	}
+	quoted := make([]string, len(ps.columns))
+	params := make([]string, len(ps.columns))
+	for i, c := range ps.columns {
+		quoted[i] = pq.QuoteIdentifier(c)
+		params[i] = "$" + strconv.Itoa(i+1)
+	}
+	ps.sql = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", ps.quotedTable(), strings.Join(quoted, ", "), strings.Join(params, ", "))
+	switch mode {
+	case PostgresInsert:
+	case PostgresUpsert:
+		if !entry.Contains("conflict") {
+			sp.log.Panic("missing conflict config for upsert of SinkPostgres", sp.tag(), zap.String("key", key))
+		}
+		conflict := entry.GetStringSlice("conflict")
+		update := entry.GetStringSlice("update")
+		if !entry.Contains("update") {
+			update = nil
+			for _, c := range ps.columns {
+				if !postgresContains(conflict, c) {
+					update = append(update, c)
+				}
+			}
+		}
+		target := make([]string, len(conflict))
+		for i, c := range conflict {
+			target[i] = pq.QuoteIdentifier(c)
+		}
+		ps.sql += " ON CONFLICT (" + strings.Join(target, ", ") + ")"
+		if len(update) == 0 {
+			ps.sql += " DO NOTHING"
+		} else {
+			set := make([]string, len(update))
+			for i, c := range update {
+				set[i] = pq.QuoteIdentifier(c) + " = EXCLUDED." + pq.QuoteIdentifier(c)
+			}
+			ps.sql += " DO UPDATE SET " + strings.Join(set, ", ")
+		}
+	default:
+		sp.log.Panic("unsupported mode for SinkPostgres", sp.tag(), zap.String("key", key), zap.String("mode", mode))
+	}
+	return ps
+}
+
+func (sp *SinkPostgres) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			sp.log.Error("catch panic event.", sp.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	tp := message.Metadata.GetString(sp.sqlMapKey)
+	if len(tp) == 0 {
+		sp.log.Error("missing sql map key meta", sp.tag(), zap.String("sqlMapKey", sp.sqlMapKey), zap.Any("data", *message))
+		return
+	}
+	//
+	if ps, ok := sp.sqlMap[tp]; !ok {
+		sp.log.Error("missing sql", sp.tag(), zap.String("key", tp), zap.Any("data", *message))
+	} else {
+		sp.sink(message.Payload, ps, message)
+	}
+}
+
+func (sp *SinkPostgres) sink(data interface{}, ps *postgresStatement, message *TaskData) {
+	kind := reflect.TypeOf(data).Kind()
+	switch kind {
+	case reflect.Ptr:
+		sp.sink(reflect.ValueOf(data).Elem().Interface(), ps, message)
+	case reflect.Slice:
+		sp.batch(data.([]map[string]interface{}), ps, message)
+	case reflect.Map:
+		if ps.copy {
+			sp.batch([]map[string]interface{}{data.(map[string]interface{})}, ps, message)
+		} else if _, e := ps.exec(sp.ctx, sp.db, data.(map[string]interface{})); e != nil {
+			sp.log.Error("execute sql failed", sp.tag(), zap.String("sql", ps.sql), zap.Error(e), zap.Any("meta", message.Metadata))
+		}
+	default:
+		sp.log.Error("unknown message kind for sink postgres", sp.tag(), zap.Any("kind", kind.String()))
+	}
+}
+
+// batch writes the rows in one transaction, a failed row rolls back the whole batch.
+func (sp *SinkPostgres) batch(rows []map[string]interface{}, ps *postgresStatement, message *TaskData) {
+	if len(rows) == 0 {
+		return
+	}
+	tx, err := sp.db.BeginTxx(sp.ctx, nil)
+	if err != nil {
+		sp.log.Error("begin transaction failed", sp.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+		return
+	}
+	if ps.copy {
+		err = sp.copy(tx, rows, ps)
+	} else {
+		for _, row := range rows {
+			if _, err = ps.exec(sp.ctx, tx, row); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		sp.log.Error("execute sql failed", sp.tag(), zap.String("sql", ps.sql), zap.String("table", ps.table), zap.Int("rows", len(rows)),
+			zap.Error(err), zap.Any("meta", message.Metadata))
+	}
+}
+
+// copy loads the rows by COPY FROM STDIN, the columns are the keys of the first row if not configured.
+func (sp *SinkPostgres) copy(tx *sqlx.Tx, rows []map[string]interface{}, ps *postgresStatement) error {
+	columns := ps.columns
+	if len(columns) == 0 {
+		for k := range rows[0] {
+			columns = append(columns, k)
+		}
+		sort.Strings(columns)
+	}
+	query := pq.CopyIn(ps.table, columns...)
+	if len(ps.schema) > 0 {
+		query = pq.CopyInSchema(ps.schema, ps.table, columns...)
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err = stmt.Exec(postgresArgs(row, columns)...); err != nil {
+			_ = stmt.Close()
+			return err
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		_ = stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+func (sp *SinkPostgres) tag() zap.Field {
+	return zap.String("tag", "SinkPostgres")
+}
+
+// postgresExecer is a db or a transaction.
+type postgresExecer interface {
+	sqlx.ExtContext
+	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
+}
+
+// exec binds the row to the statement, by position for a statement built from a table, by name otherwise.
+func (ps *postgresStatement) exec(ctx context.Context, db postgresExecer, row map[string]interface{}) (sql.Result, error) {
+	if ps.positional {
+		return db.ExecContext(ctx, ps.sql, postgresArgs(row, ps.columns)...)
+	}
+	return db.NamedExecContext(ctx, ps.sql, postgresRow(row))
+}
+
+func (ps *postgresStatement) quotedTable() string {
+	if len(ps.schema) > 0 {
+		return pq.QuoteIdentifier(ps.schema) + "." + pq.QuoteIdentifier(ps.table)
+	}
+	return pq.QuoteIdentifier(ps.table)
+}
+
+// postgresArgs returns the values of the columns in order, a missing column is null.
+func postgresArgs(row map[string]interface{}, columns []string) []interface{} {
+	row = postgresRow(row)
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		values[i] = row[c]
+	}
+	return values
+}
+
+// postgresRow encodes nested maps and slices as json, the row is copied only if changed.
+func postgresRow(row map[string]interface{}) map[string]interface{} {
+	var r map[string]interface{}
+	for k, v := range row {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}, []map[string]interface{}:
+			if r == nil {
+				r = make(map[string]interface{}, len(row))
+				for rk, rv := range row {
+					r[rk] = rv
+				}
+			}
+			if b, err := jsonApi.MarshalToString(v); err == nil {
+				r[k] = b
+			}
+		}
+	}
+	if r == nil {
+		return row
+	}
+	return r
+}
+
+func postgresContains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// recordDriver records the statements and arguments executed, a statement containing fail returns an error.
+type recordDriver struct {
+	mu    sync.Mutex
+	execs []recordExec
+}
+
+type recordExec struct {
+	query string
+	args  []interface{}
+}
+
+type recordConn struct{ d *recordDriver }
+
+type recordStmt struct {
+	d     *recordDriver
+	query string
+}
+
+func (d *recordDriver) Open(name string) (driver.Conn, error) { return &recordConn{d: d}, nil }
+
+func (c *recordConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordStmt{d: c.d, query: query}, nil
+}
+func (c *recordConn) Close() error              { return nil }
+func (c *recordConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordConn) Commit() error             { return c.d.record("COMMIT", nil) }
+func (c *recordConn) Rollback() error           { return c.d.record("ROLLBACK", nil) }
+
+func (s *recordStmt) Close() error  { return nil }
+func (s *recordStmt) NumInput() int { return -1 }
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		values[i] = a
+	}
+	if err := s.d.record(s.query, values); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func (d *recordDriver) record(query string, args []interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.execs = append(d.execs, recordExec{query: query, args: args})
+	if strings.Contains(query, "fail") {
+		return errors.New("statement failed")
+	}
+	return nil
+}
+
+func newRecordDB(t *testing.T) (*sqlx.DB, *recordDriver) {
+	d := &recordDriver{}
+	name := "record-" + t.Name()
+	sql.Register(name, d)
+	db, err := sqlx.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db, d
+}
+
+func TestSinkPostgresStatement(t *testing.T) {
+	sp := &SinkPostgres{log: zap.NewNop()}
+	cases := []struct {
+		entry map[string]interface{}
+		sql   string
+	}{
+		{
+			entry: map[string]interface{}{"table": "events", "columns": []interface{}{"id", "user-id", "geo.lat"}},
+			sql:   `INSERT INTO "events" ("id", "user-id", "geo.lat") VALUES ($1, $2, $3)`,
+		},
+		{
+			entry: map[string]interface{}{"table": "app.users", "columns": []interface{}{"id", "name", "age"}, "mode": "upsert", "conflict": []interface{}{"id"}},
+			sql:   `INSERT INTO "app"."users" ("id", "name", "age") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "age" = EXCLUDED."age"`,
+		},
+		{
+			entry: map[string]interface{}{"table": "users", "columns": []interface{}{"id", "name"}, "mode": "upsert", "conflict": []interface{}{"id"}, "update": []interface{}{}},
+			sql:   `INSERT INTO "users" ("id", "name") VALUES ($1, $2) ON CONFLICT ("id") DO NOTHING`,
+		},
+		{
+			entry: map[string]interface{}{"table": "users", "columns": []interface{}{"id", "name", "seen"}, "mode": "UPSERT", "conflict": []interface{}{"id"}, "update": []interface{}{"seen"}},
+			sql:   `INSERT INTO "users" ("id", "name", "seen") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "seen" = EXCLUDED."seen"`,
+		},
+	}
+	for _, c := range cases {
+		ps := sp.statement("k", c.entry)
+		if ps.sql != c.sql || !ps.positional {
+			t.Errorf("statement of %v\n got %s\nwant %s", c.entry, ps.sql, c.sql)
+		}
+	}
+	if ps := sp.statement("k", "INSERT INTO t (id) VALUES (:id)"); ps.positional || ps.sql != "INSERT INTO t (id) VALUES (:id)" {
+		t.Errorf("named statement %+v", ps)
+	}
+	if ps := sp.statement("k", map[string]interface{}{"table": "s.t", "mode": "copy"}); !ps.copy || ps.schema != "s" || ps.table != "t" {
+		t.Errorf("copy statement %+v", ps)
+	}
+	for _, bad := range []interface{}{
+		map[string]interface{}{"columns": []interface{}{"id"}},
+		map[string]interface{}{"table": "t"},
+		map[string]interface{}{"table": "t", "columns": []interface{}{"id"}, "mode": "upsert"},
+		map[string]interface{}{"table": "t", "columns": []interface{}{"id"}, "mode": "merge"},
+		1,
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("no panic for sql config %v", bad)
+				}
+			}()
+			sp.statement("k", bad)
+		}()
+	}
+}
+
+func TestSinkPostgresPositional(t *testing.T) {
+	db, d := newRecordDB(t)
+	sp := &SinkPostgres{log: zap.NewNop(), ctx: context.Background(), db: db, sqlMapKey: "table"}
+	sp.sqlMap = map[string]*postgresStatement{
+		"events": sp.statement("events", map[string]interface{}{"table": "events", "columns": []interface{}{"user-id", "geo.lat", "tags"}}),
+	}
+	sp.DoSink(&TaskData{Payload: map[string]interface{}{"user-id": "u1", "geo.lat": 1.5, "tags": []interface{}{"a"}}, Metadata: KeyValueConf{"table": "events"}})
+	sp.DoSink(&TaskData{Payload: []map[string]interface{}{{"user-id": "u2"}, {"user-id": "u3", "geo.lat": 2.5}}, Metadata: KeyValueConf{"table": "events"}})
+	want := []recordExec{
+		{query: sp.sqlMap["events"].sql, args: []interface{}{"u1", 1.5, `["a"]`}},
+		{query: sp.sqlMap["events"].sql, args: []interface{}{"u2", nil, nil}},
+		{query: sp.sqlMap["events"].sql, args: []interface{}{"u3", 2.5, nil}},
+		{query: "COMMIT"},
+	}
+	if !reflect.DeepEqual(d.execs, want) {
+		t.Fatalf("executed\n%v\nwant\n%v", d.execs, want)
+	}
+}
+
+func TestSinkPostgresCopy(t *testing.T) {
+	db, d := newRecordDB(t)
+	sp := &SinkPostgres{log: zap.NewNop(), ctx: context.Background(), db: db, sqlMapKey: "table"}
+	sp.sqlMap = map[string]*postgresStatement{
+		"logs":    sp.statement("logs", map[string]interface{}{"table": "logs", "mode": "copy"}),
+		"metrics": sp.statement("metrics", map[string]interface{}{"table": "app.metrics", "mode": "copy", "columns": []interface{}{"name", "value"}}),
+		"failed":  sp.statement("failed", map[string]interface{}{"table": "fail", "mode": "copy"}),
+	}
+	// the columns of logs are the sorted keys of the first row
+	sp.DoSink(&TaskData{Payload: []map[string]interface{}{{"msg": "a", "level": "info"}, {"msg": "b", "extra": 1}}, Metadata: KeyValueConf{"table": "logs"}})
+	sp.DoSink(&TaskData{Payload: map[string]interface{}{"name": "cpu", "value": 0.5, "host": "h1"}, Metadata: KeyValueConf{"table": "metrics"}})
+	want := []recordExec{
+		{query: `COPY "logs" ("level", "msg") FROM STDIN`, args: []interface{}{"info", "a"}},
+		{query: `COPY "logs" ("level", "msg") FROM STDIN`, args: []interface{}{nil, "b"}},
+		{query: `COPY "logs" ("level", "msg") FROM STDIN`, args: []interface{}{}},
+		{query: "COMMIT"},
+		{query: `COPY "app"."metrics" ("name", "value") FROM STDIN`, args: []interface{}{"cpu", 0.5}},
+		{query: `COPY "app"."metrics" ("name", "value") FROM STDIN`, args: []interface{}{}},
+		{query: "COMMIT"},
+	}
+	if !reflect.DeepEqual(d.execs, want) {
+		t.Fatalf("executed\n%v\nwant\n%v", d.execs, want)
+	}
+	// a failed copy rolls back the batch
+	d.execs = nil
+	sp.DoSink(&TaskData{Payload: []map[string]interface{}{{"id": 1}}, Metadata: KeyValueConf{"table": "failed"}})
+	if n := len(d.execs); n != 2 || d.execs[1].query != "ROLLBACK" {
+		t.Fatalf("executed %v, want a rollback", d.execs)
+	}
+}
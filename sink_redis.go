@@ -0,0 +1,198 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSink("redis", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkRedis{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	RedisXAdd  = "xadd"
+	RedisSet   = "set"
+	RedisHSet  = "hset"
+	RedisLPush = "lpush"
+	RedisRPush = "rpush"
+)
+
+// redisKeyField matches the {field} placeholders of a key template.
+var redisKeyField = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// SinkRedis writes each payload item with one of xadd, set, hset, lpush or rpush.
+// the key is a template filled with payload fields, e.g. user:{id}
+type SinkRedis struct {
+	conf    *SinkConf
+	log     *zap.Logger
+	ctx     context.Context
+	redis   redis.UniversalClient
+	command string
+	key     string
+	ttl     time.Duration
+	maxLen  int64
+}
+
+func (sr *SinkRedis) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	sr.conf = conf
+	sr.log = log
+	sr.ctx = ctx
+	sr.command = strings.ToLower(conf.Metadata.GetStringOrDefault("command", RedisSet))
+	switch sr.command {
+	case RedisXAdd, RedisSet, RedisHSet, RedisLPush, RedisRPush:
+	default:
+		log.Panic("unsupported command for SinkRedis", sr.tag(), zap.String("command", sr.command))
+	}
+	sr.key = conf.Metadata.GetString("key")
+	if len(sr.key) == 0 {
+		log.Panic("missing key config for SinkRedis", sr.tag())
+	}
+	sr.ttl = time.Duration(conf.Metadata.GetInt("ttl")) * time.Second
+	sr.maxLen = conf.Metadata.GetInt64("maxLen")
+	//
+	if conf.Metadata.GetBool("global") {
+		if _redis == nil {
+			log.Panic("global redis client not set.", sr.tag())
+		} else {
+			sr.redis = _redis
+		}
+	} else {
+		sr.redis = newRedisClient(conf.Metadata, log)
+	}
+}
+
+func (sr *SinkRedis) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			sr.log.Error("catch panic event.", sr.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	sr.sink(message.Payload, message)
+}
+
+func (sr *SinkRedis) sink(data interface{}, message *TaskData) {
+	kind := reflect.TypeOf(data).Kind()
+	switch kind {
+	case reflect.Ptr:
+		sr.sink(reflect.ValueOf(data).Elem().Interface(), message)
+	case reflect.Slice:
+		slice := data.([]map[string]interface{})
+		pipe := sr.redis.Pipeline()
+		n := 0
+		for _, item := range slice {
+			if err := sr.write(pipe, item); err != nil {
+				sr.log.Error("build redis command failed", sr.tag(), zap.Error(err), zap.Any("item", item))
+			} else {
+				n++
+			}
+		}
+		if n == 0 {
+			return
+		}
+		if _, err := pipe.Exec(sr.ctx); err != nil {
+			sr.log.Error("execute redis pipeline failed", sr.tag(), zap.String("command", sr.command), zap.Int("size", n), zap.Error(err), zap.Any("meta", message.Metadata))
+		}
+	case reflect.Map:
+		pipe := sr.redis.Pipeline()
+		if err := sr.write(pipe, data.(map[string]interface{})); err != nil {
+			sr.log.Error("build redis command failed", sr.tag(), zap.Error(err), zap.Any("data", message))
+		} else if _, err := pipe.Exec(sr.ctx); err != nil {
+			sr.log.Error("execute redis command failed", sr.tag(), zap.String("command", sr.command), zap.Error(err), zap.Any("data", message))
+		}
+	default:
+		sr.log.Error("unknown message kind for sink redis", sr.tag(), zap.Any("kind", kind.String()))
+	}
+}
+
+// write queues the command of item, and the expiry of the key if ttl is set, a stream key included.
+func (sr *SinkRedis) write(pipe redis.Pipeliner, item map[string]interface{}) error {
+	key, err := redisKey(sr.key, item)
+	if err != nil {
+		return err
+	}
+	switch sr.command {
+	case RedisXAdd:
+		values := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			values[k] = redisValue(v)
+		}
+		pipe.XAdd(sr.ctx, &redis.XAddArgs{Stream: key, MaxLen: sr.maxLen, Approx: sr.maxLen > 0, Values: values})
+	case RedisSet:
+		value, err := jsonApi.MarshalToString(item)
+		if err != nil {
+			return err
+		}
+		pipe.Set(sr.ctx, key, value, sr.ttl)
+		return nil
+	case RedisHSet:
+		values := make([]interface{}, 0, len(item)*2)
+		for k, v := range item {
+			values = append(values, k, redisValue(v))
+		}
+		pipe.HSet(sr.ctx, key, values...)
+	case RedisLPush, RedisRPush:
+		value, err := jsonApi.MarshalToString(item)
+		if err != nil {
+			return err
+		}
+		if sr.command == RedisLPush {
+			pipe.LPush(sr.ctx, key, value)
+		} else {
+			pipe.RPush(sr.ctx, key, value)
+		}
+	}
+	if sr.ttl > 0 {
+		pipe.Expire(sr.ctx, key, sr.ttl)
+	}
+	return nil
+}
+
+func (sr *SinkRedis) tag() zap.Field {
+	return zap.String("tag", "SinkRedis")
+}
+
+// redisKey fills the {field} placeholders of template with the payload fields.
+func redisKey(template string, item map[string]interface{}) (string, error) {
+	var missing []string
+	key := redisKeyField.ReplaceAllStringFunc(template, func(s string) string {
+		field := s[1 : len(s)-1]
+		v, ok := item[field]
+		if !ok || v == nil {
+			missing = append(missing, field)
+			return ""
+		}
+		return fmt.Sprint(v)
+	})
+	if len(missing) > 0 {
+		return "", errors.New("missing key fields: " + strings.Join(missing, ","))
+	}
+	return key, nil
+}
+
+// redisValue keeps scalar values, nested values are stored as json.
+func redisValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil:
+		return ""
+	case string, []byte, json.Number, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	default:
+		s, err := jsonApi.MarshalToString(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return s
+	}
+}
@@ -0,0 +1,51 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+type recordPipe struct {
+	redis.Pipeliner
+	commands []string
+}
+
+func (p *recordPipe) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	p.commands = append(p.commands, "xadd "+a.Stream)
+	return nil
+}
+
+func (p *recordPipe) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	p.commands = append(p.commands, "expire "+key)
+	return nil
+}
+
+func TestSinkRedisXAddExpire(t *testing.T) {
+	sr := &SinkRedis{log: zap.NewNop(), ctx: context.Background(), command: RedisXAdd, key: "events:{type}", ttl: time.Minute}
+	pipe := &recordPipe{}
+	if err := sr.write(pipe, map[string]interface{}{"type": "login"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pipe.commands) != 2 || pipe.commands[1] != "expire events:login" {
+		t.Fatalf("commands %v, want xadd then expire", pipe.commands)
+	}
+}
+
+func TestAdvancePending(t *testing.T) {
+	ids := map[string]string{"a": "0", "b": "0", "c": ">"}
+	advancePending(ids, []redis.XStream{
+		{Stream: "a", Messages: []redis.XMessage{{ID: "1-0"}, {ID: "2-0"}}},
+		{Stream: "b"},
+	})
+	if ids["a"] != "2-0" || ids["b"] != ">" || ids["c"] != ">" {
+		t.Fatalf("ids %v", ids)
+	}
+	advancePending(ids, nil)
+	if ids["a"] != ">" {
+		t.Fatalf("ids %v, want new entries once the pending entries are drained", ids)
+	}
+}
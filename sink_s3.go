@@ -0,0 +1,598 @@
+package job
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("s3", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkS3{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// s3MinPartSize is the minimum size of a multipart upload part except the last one.
+const s3MinPartSize = 5 << 20
+
+// s3Object is an object being written. the encoded data is buffered until partSize, then cut as a part of
+// a multipart upload, a small object is uploaded by a single put. parts are uploaded without the sink lock held,
+// upload serializes the requests of an object and pending counts the parts cut but not uploaded yet.
+type s3Object struct {
+	key      string
+	buf      *bytes.Buffer
+	comp     io.WriteCloser
+	w        io.Writer
+	size     int64
+	records  int
+	opened   time.Time
+	held     heldMessages
+	parts    int
+	upload   sync.Mutex
+	pending  sync.WaitGroup
+	uploadId string
+	etags    []string
+	err      error
+}
+
+// s3Part is the data of a part cut from an object.
+type s3Part struct {
+	obj    *s3Object
+	number int
+	data   []byte
+}
+
+// SinkS3 buffers payload items into jsonl or parquet objects of s3 compatible storage. the key template takes payload
+// fields, or metadata if missing, the time tokens {yyyy} {MM} {dd} {HH} {mm} of the processing time and a unique {part},
+// e.g. events/{topic}/{yyyy}/{MM}/{dd}/{part}.jsonl
+// an object is finished by maxSize or interval seconds, large objects are uploaded in parts of partSize.
+// a message is acknowledged to the source once all objects holding it are uploaded, a failed upload fails its messages
+// so they are delivered again. messages are held up to interval or maxSize, the drainTimeout of a kafka source
+// should be longer than interval, or the messages held on a rebalance are consumed again by the next owner.
+type SinkS3 struct {
+	conf         *SinkConf
+	log          *zap.Logger
+	ctx          context.Context
+	client       *http.Client
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	key          string
+	compression  string
+	parquet      *parquetFormat
+	partSize     int
+	maxSize      int64
+	interval     time.Duration
+	utc          bool
+	retries      int
+	mu           sync.Mutex
+	objects      map[string]*s3Object
+	seq          int64
+	closed       bool
+	stop         chan bool
+}
+
+func (ss *SinkS3) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	ss.conf = conf
+	ss.log = log
+	ss.ctx = ctx
+	ss.region = conf.Metadata.GetStringOrDefault("region", "us-east-1")
+	endpoint, err := url.Parse(conf.Metadata.GetStringOrDefault("endpoint", "https://s3."+ss.region+".amazonaws.com"))
+	if err != nil || len(endpoint.Host) == 0 {
+		log.Panic("bad endpoint config for SinkS3", ss.tag(), zap.Error(err))
+	}
+	ss.endpoint = endpoint
+	ss.bucket = conf.Metadata.GetString("bucket")
+	if len(ss.bucket) == 0 {
+		log.Panic("missing bucket config for SinkS3", ss.tag())
+	}
+	ss.accessKey = conf.Metadata.GetString("accessKey")
+	ss.secretKey = conf.Metadata.GetString("secretKey")
+	ss.sessionToken = conf.Metadata.GetString("sessionToken")
+	ss.pathStyle = !conf.Metadata.Contains("pathStyle") || conf.Metadata.GetBool("pathStyle")
+	ss.maxSize = conf.Metadata.GetInt64("maxSize")
+	if ss.maxSize <= 0 {
+		ss.maxSize = 256 << 20
+	}
+	format := conf.Metadata.GetStringOrDefault("format", "jsonl")
+	switch format {
+	case "jsonl":
+	case "parquet":
+		ss.parquet = newParquetFormat(conf.Metadata.GetKeyValueConf("parquet"), ss.maxSize, log)
+	default:
+		log.Panic("unsupported format for SinkS3", ss.tag(), zap.String("format", format))
+	}
+	ss.key = strings.TrimPrefix(conf.Metadata.GetStringOrDefault("key", "{yyyy}/{MM}/{dd}/{HH}/{part}."+format), "/")
+	if !strings.Contains(ss.key, "{part}") {
+		log.Panic("key config of SinkS3 must contain {part}", ss.tag(), zap.String("key", ss.key))
+	}
+	ss.compression = conf.Metadata.GetString("compression")
+	if ss.compression != "" && ss.compression != "gzip" && ss.compression != "zstd" {
+		log.Panic("unsupported compression for SinkS3", ss.tag(), zap.String("compression", ss.compression))
+	}
+	if ss.parquet != nil && len(ss.compression) > 0 {
+		log.Panic("parquet format is compressed by parquet.compression of SinkS3", ss.tag())
+	}
+	ss.partSize = conf.Metadata.GetInt("partSize")
+	if ss.partSize < s3MinPartSize {
+		ss.partSize = 8 << 20
+	}
+	ss.interval = time.Duration(conf.Metadata.GetInt("interval")) * time.Second
+	if ss.interval <= 0 {
+		ss.interval = time.Minute
+	}
+	ss.utc = conf.Metadata.GetBool("utc")
+	ss.retries = conf.Metadata.GetInt("retries")
+	if !conf.Metadata.Contains("retries") {
+		ss.retries = 3
+	}
+	timeout := time.Duration(conf.Metadata.GetInt("timeout")) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	// parts need a content length and more time than the shared transport allows
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = newTLSConfig(conf.Metadata.GetKeyValueConf("tls"), log)
+	ss.client = &http.Client{Timeout: timeout, Transport: tr}
+	ss.objects = make(map[string]*s3Object)
+	ss.stop = make(chan bool)
+	go ss.rotateLoop()
+}
+
+func (ss *SinkS3) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			ss.log.Error("catch panic event.", ss.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	parts, finished := ss.buffer(message)
+	for _, part := range parts {
+		ss.uploadPart(part)
+	}
+	for _, obj := range finished {
+		_ = ss.finish(obj)
+	}
+}
+
+// buffer writes the items of message under the lock, and returns the parts cut and the objects finished by maxSize.
+func (ss *SinkS3) buffer(message *TaskData) ([]*s3Part, []*s3Object) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		ss.log.Error("sink s3 is closed", ss.tag(), zap.Any("meta", message.Metadata))
+		return nil, nil
+	}
+	items := payloadItems(message.Payload)
+	if ss.parquet != nil {
+		if err := ss.parquet.infer(items); err != nil {
+			ss.log.Error("write s3 object failed, items dropped", ss.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+			return nil, nil
+		}
+	}
+	touched := make(map[*s3Object]bool)
+	var parts []*s3Part
+	for _, item := range items {
+		obj, err := ss.write(item, message.Metadata)
+		if err != nil {
+			ss.log.Error("write s3 object failed, item dropped", ss.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+			continue
+		}
+		if !touched[obj] {
+			touched[obj] = true
+			obj.held.hold(message)
+		}
+		if obj.buf.Len() >= ss.partSize {
+			parts = append(parts, ss.cut(obj))
+		}
+	}
+	var finished []*s3Object
+	for obj := range touched {
+		if obj.size >= ss.maxSize {
+			finished = append(finished, ss.detach(obj))
+		}
+	}
+	return parts, finished
+}
+
+// Close uploads all pending objects.
+func (ss *SinkS3) Close() error {
+	ss.mu.Lock()
+	if ss.closed {
+		ss.mu.Unlock()
+		return nil
+	}
+	ss.closed = true
+	close(ss.stop)
+	var finished []*s3Object
+	for _, obj := range ss.objects {
+		finished = append(finished, ss.detach(obj))
+	}
+	ss.mu.Unlock()
+	var errs []string
+	for _, obj := range finished {
+		if err := ss.finish(obj); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (ss *SinkS3) write(item interface{}, meta KeyValueConf) (*s3Object, error) {
+	now := time.Now()
+	if ss.utc {
+		now = now.UTC()
+	}
+	fields, _ := item.(map[string]interface{})
+	partition, err := fillPath(ss.key, now, meta, fields, "part")
+	if err != nil {
+		return nil, err
+	}
+	line, err := ss.encode(item)
+	if err != nil {
+		return nil, err
+	}
+	obj := ss.objects[partition]
+	if obj == nil {
+		if obj, err = ss.open(partition, now); err != nil {
+			return nil, err
+		}
+		ss.objects[partition] = obj
+	}
+	if _, err = obj.w.Write(line); err != nil {
+		return nil, err
+	}
+	obj.size += int64(len(line))
+	obj.records++
+	return obj, nil
+}
+
+func (ss *SinkS3) open(partition string, now time.Time) (*s3Object, error) {
+	ss.seq++
+	key := strings.Replace(partition, "{part}", fmt.Sprintf("%d-%d", now.UnixNano()/int64(time.Millisecond), ss.seq), -1)
+	obj := &s3Object{key: key, buf: &bytes.Buffer{}, opened: time.Now()}
+	obj.w = obj.buf
+	switch ss.compression {
+	case "gzip":
+		obj.key += ".gz"
+		obj.comp = gzip.NewWriter(obj.buf)
+		obj.w = obj.comp
+	case "zstd":
+		obj.key += ".zst"
+		enc, err := zstd.NewWriter(obj.buf)
+		if err != nil {
+			return nil, err
+		}
+		obj.comp = enc
+		obj.w = enc
+	}
+	if ss.parquet != nil {
+		pw, err := ss.parquet.writer(obj.buf)
+		if err != nil {
+			return nil, err
+		}
+		obj.comp = pw
+		obj.w = pw
+	}
+	return obj, nil
+}
+
+func (ss *SinkS3) encode(item interface{}) ([]byte, error) {
+	if ss.parquet != nil {
+		return ss.parquet.encode(item)
+	}
+	return jsonLine(item)
+}
+
+// cut takes the buffered data of an object as its next part, under the lock.
+func (ss *SinkS3) cut(obj *s3Object) *s3Part {
+	obj.parts++
+	obj.pending.Add(1)
+	part := &s3Part{obj: obj, number: obj.parts, data: append([]byte(nil), obj.buf.Bytes()...)}
+	obj.buf.Reset()
+	return part
+}
+
+// detach removes an object from the objects being written and closes its encoder, under the lock.
+func (ss *SinkS3) detach(obj *s3Object) *s3Object {
+	for k, o := range ss.objects {
+		if o == obj {
+			delete(ss.objects, k)
+		}
+	}
+	if obj.comp != nil {
+		if err := obj.comp.Close(); err != nil {
+			obj.err = err
+		}
+	}
+	return obj
+}
+
+// finish uploads the rest of a detached object once its parts are uploaded, and releases its messages.
+// the messages of a failed object are failed, so the sources do not acknowledge them and deliver them again.
+func (ss *SinkS3) finish(obj *s3Object) (err error) {
+	defer func() {
+		obj.held.release(err)
+	}()
+	obj.pending.Wait()
+	err = obj.err
+	if err == nil && obj.parts == 0 {
+		_, _, err = ss.request(http.MethodPut, obj.key, nil, obj.buf.Bytes())
+	} else if err == nil {
+		if obj.buf.Len() > 0 {
+			obj.parts++
+			err = ss.put(obj, obj.parts, obj.buf.Bytes())
+		}
+		if err == nil {
+			err = ss.complete(obj)
+		}
+	}
+	if err != nil {
+		ss.log.Error("upload s3 object failed, messages not acknowledged", ss.tag(), zap.String("key", obj.key), zap.Int("records", obj.records),
+			zap.Error(err), zap.Any("messages", obj.held.metas))
+		ss.abort(obj)
+		return err
+	}
+	ss.log.Info("s3 object uploaded", ss.tag(), zap.String("key", obj.key), zap.Int("records", obj.records),
+		zap.Int64("size", obj.size), zap.Int("parts", len(obj.etags)))
+	return nil
+}
+
+// uploadPart uploads a part cut from an object, a failed part fails the object.
+func (ss *SinkS3) uploadPart(part *s3Part) {
+	obj := part.obj
+	defer obj.pending.Done()
+	obj.upload.Lock()
+	defer obj.upload.Unlock()
+	if obj.err != nil {
+		return
+	}
+	if err := ss.put(obj, part.number, part.data); err != nil {
+		obj.err = fmt.Errorf("upload part %d of %s failed: %v", part.number, obj.key, err)
+	}
+}
+
+// put uploads a part of an object, the multipart upload is created by the first part put.
+func (ss *SinkS3) put(obj *s3Object, number int, data []byte) error {
+	if len(obj.uploadId) == 0 {
+		_, body, err := ss.request(http.MethodPost, obj.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadId string `xml:"UploadId"`
+		}
+		if err = xml.Unmarshal(body, &result); err != nil || len(result.UploadId) == 0 {
+			return fmt.Errorf("bad create multipart upload response: %v %s", err, body)
+		}
+		obj.uploadId = result.UploadId
+	}
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {obj.uploadId}}
+	header, _, err := ss.request(http.MethodPut, obj.key, query, data)
+	if err != nil {
+		return err
+	}
+	for len(obj.etags) < number {
+		obj.etags = append(obj.etags, "")
+	}
+	obj.etags[number-1] = header.Get("ETag")
+	return nil
+}
+
+func (ss *SinkS3) complete(obj *s3Object) error {
+	var body bytes.Buffer
+	body.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range obj.etags {
+		body.WriteString("<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>")
+		_ = xml.EscapeText(&body, []byte(etag))
+		body.WriteString("</ETag></Part>")
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	_, res, err := ss.request(http.MethodPost, obj.key, url.Values{"uploadId": {obj.uploadId}}, body.Bytes())
+	if err != nil {
+		return err
+	}
+	// an error of complete may come with status 200
+	if bytes.Contains(res, []byte("<Error>")) {
+		return errors.New(string(res))
+	}
+	return nil
+}
+
+func (ss *SinkS3) abort(obj *s3Object) {
+	if len(obj.uploadId) == 0 {
+		return
+	}
+	if _, _, err := ss.request(http.MethodDelete, obj.key, url.Values{"uploadId": {obj.uploadId}}, nil); err != nil {
+		ss.log.Error("abort s3 multipart upload failed", ss.tag(), zap.String("key", obj.key), zap.Error(err))
+	}
+}
+
+// request sends a signed request, failed by the network, 429 or 5xx it is retried.
+func (ss *SinkS3) request(method, key string, query url.Values, body []byte) (http.Header, []byte, error) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		header, res, status, err := ss.do(method, key, query, body)
+		if err == nil && status < 300 {
+			return header, res, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s %s: %d %s", method, key, status, strings.TrimSpace(string(res)))
+		}
+		if (status > 0 && status < 500 && status != http.StatusTooManyRequests) || attempt >= ss.retries {
+			return nil, nil, err
+		}
+		ss.log.Warn("s3 request failed, retry later", ss.tag(), zap.String("key", key), zap.Error(err), zap.Duration("backoff", backoff))
+		if !sleepContext(ss.ctx, backoff) {
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+func (ss *SinkS3) do(method, key string, query url.Values, body []byte) (http.Header, []byte, int, error) {
+	u := *ss.endpoint
+	path, rawPath := "/"+key, "/"+s3Escape(key)
+	if ss.pathStyle {
+		path, rawPath = "/"+ss.bucket+path, "/"+s3Escape(ss.bucket)+rawPath
+	} else {
+		u.Host = ss.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimRight(ss.endpoint.Path, "/") + path
+	u.RawPath = strings.TrimRight(ss.endpoint.EscapedPath(), "/") + rawPath
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	req.ContentLength = int64(len(body))
+	if _, ok := query["uploads"]; ok || (method == http.MethodPut && len(query) == 0) {
+		req.Header.Set("Content-Type", ss.contentType())
+	}
+	ss.sign(req, body, time.Now().UTC())
+	res, err := ss.client.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	return res.Header, data, res.StatusCode, err
+}
+
+// sign adds the aws signature version 4 of the request.
+func (ss *SinkS3) sign(req *http.Request, body []byte, now time.Time) {
+	hash := sha256.Sum256(body)
+	payload := hex.EncodeToString(hash[:])
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if len(ss.sessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", ss.sessionToken)
+	}
+	if len(ss.accessKey) == 0 {
+		return
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical.String(), signed, payload}, "\n")
+	scope := now.Format("20060102") + "/" + ss.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + ss.secretKey)
+	for _, s := range []string{now.Format("20060102"), ss.region, "s3", "aws4_request"} {
+		key = s3Hmac(key, s)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+ss.accessKey+"/"+scope+", SignedHeaders="+signed+
+		", Signature="+hex.EncodeToString(s3Hmac(key, toSign)))
+}
+
+// rotateLoop finishes the objects older than interval.
+func (ss *SinkS3) rotateLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ss.stop:
+			return
+		case <-ticker.C:
+		}
+		var due []*s3Object
+		ss.mu.Lock()
+		for _, obj := range ss.objects {
+			if time.Since(obj.opened) >= ss.interval {
+				due = append(due, ss.detach(obj))
+			}
+		}
+		ss.mu.Unlock()
+		for _, obj := range due {
+			_ = ss.finish(obj)
+		}
+	}
+}
+
+func (ss *SinkS3) contentType() string {
+	if ss.parquet != nil {
+		return "application/vnd.apache.parquet"
+	}
+	return "application/x-ndjson"
+}
+
+func (ss *SinkS3) tag() zap.Field {
+	return zap.String("tag", "SinkS3")
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes a key by rfc 3986 except the slashes.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes a query sorted by key as the canonical query of signature version 4.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+strings.Replace(s3Escape(v), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,187 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// s3StandIn records the objects put to a bucket, multipart uploads included.
+type s3StandIn struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	parts    map[string]string
+	requests []string
+	status   int
+	arrived  chan bool
+	delay    time.Duration
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	status := s.status
+	s.mu.Unlock()
+	if s.arrived != nil {
+		s.arrived <- true
+	}
+	time.Sleep(s.delay)
+	if status > 0 {
+		w.WriteHeader(status)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && len(q["uploads"]) > 0:
+		_, _ = w.Write([]byte("<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>"))
+	case r.Method == http.MethodPut && q.Get("partNumber") != "":
+		s.parts[q.Get("partNumber")] = string(body)
+		w.Header().Set("ETag", `"etag-`+q.Get("partNumber")+`"`)
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		var data strings.Builder
+		for i := 1; i <= len(s.parts); i++ {
+			if !strings.Contains(string(body), fmt.Sprintf(`<PartNumber>%d</PartNumber><ETag>&#34;etag-%d&#34;</ETag>`, i, i)) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data.WriteString(s.parts[fmt.Sprint(i)])
+		}
+		s.objects[r.URL.Path] = data.String()
+	case r.Method == http.MethodPut:
+		s.objects[r.URL.Path] = string(body)
+	}
+}
+
+func newTestS3(t *testing.T, s *s3StandIn, meta KeyValueConf) *SinkS3 {
+	s.objects = make(map[string]string)
+	s.parts = make(map[string]string)
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	meta["endpoint"] = srv.URL
+	meta["bucket"] = "logs"
+	meta["key"] = "{topic}/{part}.jsonl"
+	ss := &SinkS3{}
+	ss.init(&SinkConf{Type: "s3", Metadata: meta}, context.Background(), zap.NewNop())
+	t.Cleanup(func() { _ = ss.Close() })
+	return ss
+}
+
+func TestSinkS3HoldUntilUploaded(t *testing.T) {
+	s := &s3StandIn{}
+	ss := newTestS3(t, s, KeyValueConf{})
+	done := 0
+	for i := 0; i < 2; i++ {
+		data := &TaskData{Payload: map[string]interface{}{"id": i}, Metadata: KeyValueConf{"topic": "a"}, done: func() { done++ }}
+		ss.DoSink(data)
+		data.Done()
+	}
+	if done != 0 {
+		t.Fatal("message acknowledged before its object is uploaded")
+	}
+	if err := ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if done != 2 || len(s.objects) != 1 {
+		t.Fatalf("acknowledged %d, objects %v", done, s.objects)
+	}
+	for key, data := range s.objects {
+		if !strings.HasPrefix(key, "/logs/a/") || data != "{\"id\":0}\n{\"id\":1}\n" {
+			t.Fatalf("object %s: %q", key, data)
+		}
+	}
+}
+
+func TestSinkS3Multipart(t *testing.T) {
+	s := &s3StandIn{}
+	ss := newTestS3(t, s, KeyValueConf{"partSize": s3MinPartSize})
+	line := strings.Repeat("x", 1000)
+	for i := 0; i < 12000; i++ {
+		ss.DoSink(&TaskData{Payload: map[string]interface{}{"v": line}, Metadata: KeyValueConf{"topic": "a"}})
+	}
+	if err := ss.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.parts) != 3 || len(s.objects) != 1 {
+		t.Fatalf("parts %d objects %d", len(s.parts), len(s.objects))
+	}
+	for _, data := range s.objects {
+		if n := strings.Count(data, "\n"); n != 12000 {
+			t.Fatalf("object of %d lines", n)
+		}
+	}
+}
+
+func TestSinkS3FailedUpload(t *testing.T) {
+	s := &s3StandIn{status: http.StatusForbidden}
+	ss := newTestS3(t, s, KeyValueConf{})
+	done, failed := 0, 0
+	data := &TaskData{Payload: map[string]interface{}{"id": 1}, Metadata: KeyValueConf{"topic": "a"},
+		done: func() { done++ }, fail: func() { failed++ }}
+	ss.DoSink(data)
+	data.Done()
+	if err := ss.Close(); err == nil {
+		t.Fatal("failed upload not reported")
+	}
+	// not acknowledged, the source delivers it again
+	if done != 0 || failed != 1 {
+		t.Fatalf("done %d, failed %d after the upload failed", done, failed)
+	}
+}
+
+func TestSinkS3RetryCancelled(t *testing.T) {
+	s := &s3StandIn{status: http.StatusServiceUnavailable}
+	ss := newTestS3(t, s, KeyValueConf{"retries": 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	ss.ctx = ctx
+	ss.DoSink(&TaskData{Payload: map[string]interface{}{"id": 1}, Metadata: KeyValueConf{"topic": "a"}})
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := ss.Close(); err == nil {
+		t.Fatal("failed upload not reported")
+	}
+	if cost := time.Since(start); cost > 2*time.Second {
+		t.Fatalf("retried for %v after the task was cancelled", cost)
+	}
+}
+
+func TestSinkS3UploadWithoutLock(t *testing.T) {
+	s := &s3StandIn{arrived: make(chan bool, 4), delay: 500 * time.Millisecond}
+	ss := newTestS3(t, s, KeyValueConf{"maxSize": 1})
+	go ss.DoSink(&TaskData{Payload: map[string]interface{}{"id": 1}, Metadata: KeyValueConf{"topic": "a"}})
+	<-s.arrived
+	locked := make(chan bool)
+	go func() {
+		ss.mu.Lock()
+		ss.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("sink locked while uploading")
+	}
+}
+
+func TestSinkS3ParquetWithoutMaps(t *testing.T) {
+	s := &s3StandIn{}
+	ss := newTestS3(t, s, KeyValueConf{"format": "parquet"})
+	done := 0
+	data := &TaskData{Payload: "not a map", Metadata: KeyValueConf{"topic": "a"}, done: func() { done++ }}
+	ss.DoSink(data)
+	data.Done()
+	// dropped, not held forever
+	if done != 1 {
+		t.Fatal("message held after its items are dropped")
+	}
+}
@@ -0,0 +1,357 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("sqlite", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkSQLite{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// sqliteStatement is a named statement, or a table whose insert statement is built from its columns.
+type sqliteStatement struct {
+	sql        string
+	table      string
+	columns    []string
+	fixed      bool
+	known      map[string]bool
+	replace    bool
+	autoCreate bool
+}
+
+// SinkSQLite executes the statement chosen by the sqlMapKey metadata like SinkMySQL. an sql entry is a named
+// statement, e.g. INSERT INTO t (id, name) VALUES (:id, :name), or a table. the columns of a table default to the
+// columns of the existing table, with autoCreate the table is created and a field first seen in a later message
+// is added as a column, otherwise fields which are not columns are dropped with a warning. the columns of a table
+// are quoted and bound by position. the rows of a message are written in one transaction, nested values as json.
+type SinkSQLite struct {
+	conf      *SinkConf
+	log       *zap.Logger
+	ctx       context.Context
+	db        *sqlx.DB
+	sqlMap    map[string]*sqliteStatement
+	sqlMapKey string
+	mu        sync.Mutex
+}
+
+func (ss *SinkSQLite) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	ss.conf = conf
+	ss.log = log
+	ss.ctx = ctx
+	sqlConf := conf.Metadata.GetKeyValueConf("sql")
+	if len(sqlConf) == 0 {
+		log.Panic("missing sql config for SinkSQLite", ss.tag())
+	}
+	autoCreate := conf.Metadata.GetBool("autoCreate")
+	ss.sqlMap = make(map[string]*sqliteStatement, len(sqlConf))
+	for k, v := range sqlConf {
+		switch v := plainValue(v).(type) {
+		case string:
+			ss.sqlMap[k] = &sqliteStatement{sql: v}
+		case map[string]interface{}:
+			entry := KeyValueConf(v)
+			st := &sqliteStatement{table: entry.GetString("table"), replace: entry.GetBool("replace"), autoCreate: autoCreate}
+			if len(st.table) == 0 {
+				log.Panic("missing table config for SinkSQLite", ss.tag(), zap.String("key", k))
+			}
+			if entry.Contains("autoCreate") {
+				st.autoCreate = entry.GetBool("autoCreate")
+			}
+			if entry.Contains("columns") {
+				st.columns = entry.GetStringSlice("columns")
+				st.fixed = len(st.columns) > 0
+			}
+			ss.sqlMap[k] = st
+		default:
+			log.Panic("bad sql config for SinkSQLite", ss.tag(), zap.String("key", k))
+		}
+	}
+	ss.sqlMapKey = conf.Metadata.GetString("sqlMapKey")
+	if len(ss.sqlMapKey) == 0 {
+		log.Panic("missing sqlMapKey config for SinkSQLite", ss.tag())
+	}
+	//
+	if conf.Metadata.GetBool("global") {
+		if _sqlite == nil {
+			log.Panic("global sqlite client not set.", ss.tag())
+		} else {
+			ss.db = _sqlite
+		}
+	} else {
+		ss.db = newSQLiteClient(conf.Metadata, log)
+	}
+}
+
+func (ss *SinkSQLite) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			ss.log.Error("catch panic event.", ss.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	tp := message.Metadata.GetString(ss.sqlMapKey)
+	if len(tp) == 0 {
+		ss.log.Error("missing sql map key meta", ss.tag(), zap.String("sqlMapKey", ss.sqlMapKey), zap.Any("data", *message))
+		return
+	}
+	//
+	if st, ok := ss.sqlMap[tp]; !ok {
+		ss.log.Error("missing sql", ss.tag(), zap.String("key", tp), zap.Any("data", *message))
+	} else {
+		ss.sink(message.Payload, st, message)
+	}
+}
+
+func (ss *SinkSQLite) sink(data interface{}, st *sqliteStatement, message *TaskData) {
+	kind := reflect.TypeOf(data).Kind()
+	switch kind {
+	case reflect.Ptr:
+		ss.sink(reflect.ValueOf(data).Elem().Interface(), st, message)
+	case reflect.Slice:
+		ss.batch(data.([]map[string]interface{}), st, message)
+	case reflect.Map:
+		ss.batch([]map[string]interface{}{data.(map[string]interface{})}, st, message)
+	default:
+		ss.log.Error("unknown message kind for sink sqlite", ss.tag(), zap.Any("kind", kind.String()))
+	}
+}
+
+// batch writes the rows in one transaction, a failed row is logged and skipped.
+func (ss *SinkSQLite) batch(rows []map[string]interface{}, st *sqliteStatement, message *TaskData) {
+	if len(rows) == 0 {
+		return
+	}
+	sqlStr, columns, err := ss.statement(st, rows)
+	if err != nil {
+		ss.log.Error("prepare sql failed", ss.tag(), zap.String("table", st.table), zap.Error(err), zap.Any("meta", message.Metadata))
+		return
+	}
+	tx, err := ss.db.BeginTxx(ss.ctx, nil)
+	if err != nil {
+		ss.log.Error("begin transaction failed", ss.tag(), zap.Error(err), zap.Any("meta", message.Metadata))
+		return
+	}
+	var exec func(row map[string]interface{}) error
+	if len(st.table) > 0 {
+		stmt, e := tx.PreparexContext(ss.ctx, sqlStr)
+		if e != nil {
+			_ = tx.Rollback()
+			ss.log.Error("prepare sql failed", ss.tag(), zap.String("sql", sqlStr), zap.Error(e))
+			return
+		}
+		defer stmt.Close()
+		exec = func(row map[string]interface{}) error {
+			// the columns of a table are bound even if the row misses some of them
+			values := make([]interface{}, len(columns))
+			for i, c := range columns {
+				values[i] = row[c]
+			}
+			_, e := stmt.ExecContext(ss.ctx, values...)
+			return e
+		}
+	} else {
+		stmt, e := tx.PrepareNamedContext(ss.ctx, sqlStr)
+		if e != nil {
+			_ = tx.Rollback()
+			ss.log.Error("prepare sql failed", ss.tag(), zap.String("sql", sqlStr), zap.Error(e))
+			return
+		}
+		defer stmt.Close()
+		exec = func(row map[string]interface{}) error {
+			_, e := stmt.ExecContext(ss.ctx, row)
+			return e
+		}
+	}
+	for _, row := range rows {
+		row = sqliteRow(row)
+		if e := exec(row); e != nil {
+			ss.log.Error("bind sql param failed", ss.tag(), zap.Any("data", row), zap.Error(e))
+		}
+	}
+	if e := tx.Commit(); e != nil {
+		_ = tx.Rollback()
+		ss.log.Error("execute sql failed", ss.tag(), zap.String("sql", sqlStr), zap.Error(e), zap.Any("meta", message.Metadata))
+	}
+}
+
+// statement returns the sql of an entry. the statement of a table is built from the table columns, or the
+// configured ones, and rebuilt once a message brings new columns.
+func (ss *SinkSQLite) statement(st *sqliteStatement, rows []map[string]interface{}) (string, []string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(st.table) == 0 || (st.fixed && len(st.sql) > 0) {
+		return st.sql, st.columns, nil
+	}
+	if !st.fixed {
+		if err := ss.columns(st, rows); err != nil {
+			return "", nil, err
+		}
+		if len(st.sql) > 0 {
+			return st.sql, st.columns, nil
+		}
+	}
+	if len(st.columns) == 0 {
+		return "", nil, fmt.Errorf("no column found for table %s", st.table)
+	}
+	if st.fixed && st.autoCreate {
+		if err := ss.createTable(st, st.columns, rows); err != nil {
+			return "", nil, err
+		}
+	}
+	quoted := make([]string, len(st.columns))
+	params := make([]string, len(st.columns))
+	for i, c := range st.columns {
+		quoted[i] = sqliteQuote(c)
+		params[i] = "?"
+	}
+	insert := "INSERT INTO "
+	if st.replace {
+		insert = "INSERT OR REPLACE INTO "
+	}
+	st.sql = insert + sqliteQuote(st.table) + " (" + strings.Join(quoted, ", ") + ") VALUES (" + strings.Join(params, ", ") + ")"
+	return st.sql, st.columns, nil
+}
+
+// columns follows the columns of the table, the fields of the rows which are not columns yet are added with
+// autoCreate, or dropped. the statement is reset if the columns changed.
+func (ss *SinkSQLite) columns(st *sqliteStatement, rows []map[string]interface{}) error {
+	if st.known == nil {
+		var names []string
+		if err := ss.db.SelectContext(ss.ctx, &names, "SELECT name FROM pragma_table_info(?) ORDER BY cid", st.table); err != nil {
+			return err
+		}
+		st.known = make(map[string]bool, len(names))
+		for _, n := range names {
+			st.known[n] = true
+		}
+		st.columns = names
+	}
+	var fields []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		for k := range row {
+			if !st.known[k] && !seen[k] {
+				seen[k] = true
+				fields = append(fields, k)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	sort.Strings(fields)
+	if !st.autoCreate {
+		ss.log.Warn("fields are not columns of the table, dropped", ss.tag(), zap.String("table", st.table), zap.Strings("fields", fields))
+		// warned once
+		for _, f := range fields {
+			st.known[f] = true
+		}
+		return nil
+	}
+	if len(st.columns) == 0 {
+		if err := ss.createTable(st, fields, rows); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range fields {
+			def := sqliteQuote(f) + " " + sqliteType(sqliteValue(rows, f))
+			if _, err := ss.db.ExecContext(ss.ctx, "ALTER TABLE "+sqliteQuote(st.table)+" ADD COLUMN "+def); err != nil {
+				return err
+			}
+			ss.log.Info("sqlite column added", ss.tag(), zap.String("table", st.table), zap.String("column", def))
+		}
+	}
+	for _, f := range fields {
+		st.known[f] = true
+	}
+	st.columns = append(st.columns, fields...)
+	st.sql = ""
+	return nil
+}
+
+func (ss *SinkSQLite) createTable(st *sqliteStatement, columns []string, rows []map[string]interface{}) error {
+	defs := make([]string, len(columns))
+	for i, c := range columns {
+		defs[i] = sqliteQuote(c) + " " + sqliteType(sqliteValue(rows, c))
+	}
+	if _, err := ss.db.ExecContext(ss.ctx, "CREATE TABLE IF NOT EXISTS "+sqliteQuote(st.table)+" ("+strings.Join(defs, ", ")+")"); err != nil {
+		return err
+	}
+	ss.log.Info("sqlite table checked", ss.tag(), zap.String("table", st.table), zap.Strings("columns", defs))
+	return nil
+}
+
+func (ss *SinkSQLite) tag() zap.Field {
+	return zap.String("tag", "SinkSQLite")
+}
+
+func sqliteQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqliteValue is the first value of a field which is not null, for the column type.
+func sqliteValue(rows []map[string]interface{}, field string) interface{} {
+	for _, row := range rows {
+		if v := row[field]; v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// sqliteRow encodes the nested maps and slices of a row as json, the row is copied only if changed.
+func sqliteRow(row map[string]interface{}) map[string]interface{} {
+	var r map[string]interface{}
+	for k, v := range row {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}, []map[string]interface{}:
+			if r == nil {
+				r = make(map[string]interface{}, len(row))
+				for rk, rv := range row {
+					r[rk] = rv
+				}
+			}
+			if b, err := jsonApi.MarshalToString(v); err == nil {
+				r[k] = b
+			}
+		}
+	}
+	if r == nil {
+		return row
+	}
+	return r
+}
+
+// sqliteType is the column type of a value for auto created tables.
+func sqliteType(v interface{}) string {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, bool:
+		return "INTEGER"
+	case float32, float64:
+		return "REAL"
+	case json.Number:
+		if strings.ContainsAny(string(v.(json.Number)), ".eE") {
+			return "REAL"
+		}
+		return "INTEGER"
+	case []byte:
+		return "BLOB"
+	case time.Time:
+		return "TIMESTAMP"
+	default:
+		return "TEXT"
+	}
+}
@@ -0,0 +1,99 @@
+package job
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+func newTestSinkSQLite(t *testing.T, sqlConf map[interface{}]interface{}, autoCreate bool) (*SinkSQLite, *sqlx.DB) {
+	ss := &SinkSQLite{}
+	ss.init(&SinkConf{Type: "sqlite", Metadata: KeyValueConf{
+		"path":       ":memory:",
+		"wal":        false,
+		"sqlMapKey":  "table",
+		"autoCreate": autoCreate,
+		"sql":        sqlConf,
+	}}, context.Background(), zap.NewNop())
+	t.Cleanup(func() { _ = ss.db.Close() })
+	return ss, ss.db
+}
+
+func sqliteRows(t *testing.T, db *sqlx.DB, query string) []map[string]interface{} {
+	rows, err := db.Queryx(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var items []map[string]interface{}
+	for rows.Next() {
+		item := make(map[string]interface{})
+		if err := rows.MapScan(item); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range item {
+			if b, ok := v.([]byte); ok {
+				item[k] = string(b)
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestSinkSQLiteAutoCreate(t *testing.T) {
+	ss, db := newTestSinkSQLite(t, map[interface{}]interface{}{
+		"events": map[interface{}]interface{}{"table": "events"},
+	}, true)
+	meta := KeyValueConf{"table": "events"}
+	ss.DoSink(&TaskData{Payload: map[string]interface{}{"id": 1, "name": "a"}, Metadata: meta})
+	// fields first seen in a later message become columns
+	ss.DoSink(&TaskData{Payload: []map[string]interface{}{
+		{"id": 2, "user-id": "u2", "geo.lat": 1.5},
+		{"id": 3, "name": "c", "tags": []interface{}{"x"}},
+	}, Metadata: meta})
+	got := sqliteRows(t, db, `SELECT id, name, "geo.lat", tags, "user-id" FROM events ORDER BY id`)
+	want := []map[string]interface{}{
+		{"id": int64(1), "name": "a", "geo.lat": nil, "tags": nil, "user-id": nil},
+		{"id": int64(2), "name": nil, "geo.lat": 1.5, "tags": nil, "user-id": "u2"},
+		{"id": int64(3), "name": "c", "geo.lat": nil, "tags": `["x"]`, "user-id": nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows\n%v\nwant\n%v", got, want)
+	}
+	types := sqliteRows(t, db, `SELECT name, type FROM pragma_table_info('events') ORDER BY cid`)
+	if len(types) != 5 || types[0]["type"] != "INTEGER" || types[2]["name"] != "geo.lat" || types[2]["type"] != "REAL" {
+		t.Fatalf("columns %v", types)
+	}
+}
+
+func TestSinkSQLiteExistingTable(t *testing.T) {
+	ss, db := newTestSinkSQLite(t, map[interface{}]interface{}{
+		"users": map[interface{}]interface{}{"table": "users", "replace": true},
+	}, false)
+	db.MustExec(`CREATE TABLE users (id INTEGER PRIMARY KEY, "first-name" TEXT)`)
+	meta := KeyValueConf{"table": "users"}
+	ss.DoSink(&TaskData{Payload: map[string]interface{}{"id": 1, "first-name": "a", "unknown": true}, Metadata: meta})
+	ss.DoSink(&TaskData{Payload: map[string]interface{}{"id": 1, "first-name": "b"}, Metadata: meta})
+	got := sqliteRows(t, db, `SELECT * FROM users`)
+	if want := []map[string]interface{}{{"id": int64(1), "first-name": "b"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows %v, want %v", got, want)
+	}
+}
+
+func TestSinkSQLiteColumns(t *testing.T) {
+	ss, db := newTestSinkSQLite(t, map[interface{}]interface{}{
+		"metrics": map[interface{}]interface{}{"table": "metrics", "columns": []interface{}{"host.name", "value"}},
+		"named":   "INSERT INTO metrics (\"host.name\", value) VALUES (:host, :value)",
+	}, true)
+	ss.DoSink(&TaskData{Payload: []map[string]interface{}{{"host.name": "h1", "value": 0.5, "extra": 1}}, Metadata: KeyValueConf{"table": "metrics"}})
+	ss.DoSink(&TaskData{Payload: map[string]interface{}{"host": "h2", "value": 1.5}, Metadata: KeyValueConf{"table": "named"}})
+	got := sqliteRows(t, db, `SELECT * FROM metrics ORDER BY value`)
+	want := []map[string]interface{}{{"host.name": "h1", "value": 0.5}, {"host.name": "h2", "value": 1.5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("rows %v, want %v", got, want)
+	}
+}
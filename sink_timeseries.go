@@ -0,0 +1,498 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSink("timeseries", func(conf *SinkConf, ctx context.Context, log *zap.Logger) Sink {
+		s := &SinkTimeSeries{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	TimeSeriesInflux     = "influx"
+	TimeSeriesPrometheus = "prometheus"
+)
+
+// timeseriesMetricName matches the characters not allowed in prometheus metric and label names.
+var timeseriesMetricName = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// timeseriesPoint is a measurement at a time, tags are sorted by key.
+type timeseriesPoint struct {
+	measurement string
+	tags        [][2]string
+	fields      map[string]interface{}
+	time        time.Time
+}
+
+// SinkTimeSeries maps payload items to points and writes them as influx line protocol, or as prometheus
+// remote write with a metric measurement_field per numeric field. measurement is a template of payload and
+// metadata fields, tags and fields are lists of field names or maps of name to field, timestamp is a field of
+// unix time in timestampUnit or RFC3339, now by default. points are batched by batchSize or interval seconds.
+// json numbers are written as influx floats, unless the field is listed by integers, so a field never changes its type.
+// a message is acknowledged to the source once its points are written, or dropped after retries.
+type SinkTimeSeries struct {
+	conf          *SinkConf
+	log           *zap.Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+	protocol      string
+	url           string
+	user          string
+	password      string
+	token         string
+	measurement   string
+	tags          map[string]string
+	fields        map[string]string
+	integers      map[string]bool
+	timestamp     string
+	timestampUnit time.Duration
+	batchSize     int
+	interval      time.Duration
+	timeout       time.Duration
+	retries       int
+	client        *http.Client
+	mu            sync.Mutex
+	points        []*timeseriesPoint
+	held          heldMessages
+	closed        bool
+	stop          chan bool
+}
+
+func (st *SinkTimeSeries) init(conf *SinkConf, ctx context.Context, log *zap.Logger) {
+	st.conf = conf
+	st.log = log
+	// retries of failed writes stop once the task is cancelled or the sink is closed
+	st.ctx, st.cancel = context.WithCancel(ctx)
+	st.protocol = conf.Metadata.GetStringOrDefault("protocol", TimeSeriesInflux)
+	if st.protocol != TimeSeriesInflux && st.protocol != TimeSeriesPrometheus {
+		log.Panic("unsupported protocol for SinkTimeSeries", st.tag(), zap.String("protocol", st.protocol))
+	}
+	st.url = conf.Metadata.GetString("url")
+	if len(st.url) == 0 {
+		log.Panic("missing url config for SinkTimeSeries", st.tag())
+	}
+	st.user = conf.Metadata.GetString("user")
+	st.password = conf.Metadata.GetString("password")
+	st.token = conf.Metadata.GetString("token")
+	st.measurement = conf.Metadata.GetString("measurement")
+	if len(st.measurement) == 0 {
+		log.Panic("missing measurement config for SinkTimeSeries", st.tag())
+	}
+	st.tags = timeseriesMapping(conf.Metadata["tags"])
+	st.fields = timeseriesMapping(conf.Metadata["fields"])
+	if len(st.fields) == 0 {
+		log.Panic("missing fields config for SinkTimeSeries", st.tag())
+	}
+	st.integers = make(map[string]bool)
+	for _, name := range conf.Metadata.GetStringSlice("integers") {
+		st.integers[name] = true
+	}
+	st.timestamp = conf.Metadata.GetString("timestamp")
+	switch unit := conf.Metadata.GetStringOrDefault("timestampUnit", "ms"); unit {
+	case "s":
+		st.timestampUnit = time.Second
+	case "ms":
+		st.timestampUnit = time.Millisecond
+	case "us":
+		st.timestampUnit = time.Microsecond
+	case "ns":
+		st.timestampUnit = time.Nanosecond
+	default:
+		log.Panic("unsupported timestampUnit for SinkTimeSeries", st.tag(), zap.String("timestampUnit", unit))
+	}
+	st.batchSize = conf.Metadata.GetInt("batchSize")
+	if st.batchSize <= 0 {
+		st.batchSize = 1000
+	}
+	st.interval = time.Duration(conf.Metadata.GetInt("interval")) * time.Second
+	if st.interval <= 0 {
+		st.interval = 5 * time.Second
+	}
+	st.timeout = time.Duration(conf.Metadata.GetInt("timeout")) * time.Second
+	if st.timeout <= 0 {
+		st.timeout = 30 * time.Second
+	}
+	st.retries = conf.Metadata.GetInt("retries")
+	if !conf.Metadata.Contains("retries") {
+		st.retries = 3
+	}
+	st.client = newHttpClient(st.timeout, conf.Metadata.GetKeyValueConf("tls"), log)
+	st.stop = make(chan bool)
+	go st.flushLoop()
+}
+
+func (st *SinkTimeSeries) DoSink(message *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			st.log.Error("catch panic event.", st.tag(), zap.Any("err", err), zap.Any("data", *message))
+		}
+	}()
+	var points []*timeseriesPoint
+	for _, item := range st.items(message.Payload) {
+		p, err := st.point(item, message.Metadata)
+		if err != nil {
+			st.log.Error("build point failed", st.tag(), zap.Error(err), zap.Any("item", item), zap.Any("meta", message.Metadata))
+			continue
+		}
+		points = append(points, p)
+	}
+	if len(points) == 0 {
+		return
+	}
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		st.log.Error("sink timeseries is closed", st.tag(), zap.Any("meta", message.Metadata))
+		return
+	}
+	st.points = append(st.points, points...)
+	st.held.hold(message)
+	var full []*timeseriesPoint
+	var held heldMessages
+	if len(st.points) >= st.batchSize {
+		full, st.points = st.points, nil
+		held, st.held = st.held, heldMessages{}
+	}
+	st.mu.Unlock()
+	if full != nil {
+		_ = st.flush(full, held)
+	}
+}
+
+// Close writes the pending points.
+func (st *SinkTimeSeries) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	close(st.stop)
+	st.cancel()
+	points, held := st.points, st.held
+	st.points, st.held = nil, heldMessages{}
+	st.mu.Unlock()
+	return st.flush(points, held)
+}
+
+func (st *SinkTimeSeries) items(data interface{}) []map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	switch data.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{data.(map[string]interface{})}
+	case []map[string]interface{}:
+		return data.([]map[string]interface{})
+	}
+	if reflect.TypeOf(data).Kind() == reflect.Ptr {
+		return st.items(reflect.ValueOf(data).Elem().Interface())
+	}
+	st.log.Error("unknown message kind for sink timeseries", st.tag(), zap.Any("kind", reflect.TypeOf(data).Kind().String()))
+	return nil
+}
+
+// point maps an item to a point, metadata fills the fields missing from the payload.
+func (st *SinkTimeSeries) point(item map[string]interface{}, meta KeyValueConf) (*timeseriesPoint, error) {
+	values := templateFields(item, meta)
+	measurement, err := fillTemplate(st.measurement, values)
+	if err != nil {
+		return nil, err
+	}
+	p := &timeseriesPoint{measurement: measurement, fields: make(map[string]interface{}, len(st.fields)), time: time.Now()}
+	for name, field := range st.tags {
+		if v, ok := values[field]; ok && v != nil {
+			p.tags = append(p.tags, [2]string{name, fmt.Sprint(v)})
+		}
+	}
+	sort.Slice(p.tags, func(i, j int) bool {
+		return p.tags[i][0] < p.tags[j][0]
+	})
+	for name, field := range st.fields {
+		if v, ok := values[field]; ok && v != nil {
+			if st.integers[name] {
+				if v, err = timeseriesInt(v); err != nil {
+					return nil, fmt.Errorf("field %s: %v", name, err)
+				}
+			}
+			p.fields[name] = v
+		}
+	}
+	if len(p.fields) == 0 {
+		return nil, errors.New("no field found of point " + measurement)
+	}
+	if len(st.timestamp) > 0 {
+		if v, ok := values[st.timestamp]; ok && v != nil {
+			if p.time, err = st.time(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// flush writes the points, retried with backoff. the held messages are released once the points are written,
+// or failed after retries, so the sources deliver them again.
+func (st *SinkTimeSeries) time(v interface{}) (time.Time, error) {
+	switch v.(type) {
+	case time.Time:
+		return v.(time.Time), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v.(string)); err == nil {
+			return t, nil
+		}
+	}
+	if n, err := strconv.ParseInt(fmt.Sprint(v), 10, 64); err == nil {
+		return time.Unix(0, n*int64(st.timestampUnit)), nil
+	}
+	n, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp %v", v)
+	}
+	return time.Unix(0, int64(n*float64(st.timestampUnit))), nil
+}
+
+func (st *SinkTimeSeries) flush(points []*timeseriesPoint, held heldMessages) (err error) {
+	defer func() {
+		held.release(err)
+	}()
+	if len(points) == 0 {
+		return nil
+	}
+	var body []byte
+	headers := map[string]string{}
+	if st.protocol == TimeSeriesPrometheus {
+		body = snappy.Encode(nil, timeseriesRemoteWrite(points))
+		headers["Content-Type"] = "application/x-protobuf"
+		headers["Content-Encoding"] = "snappy"
+		headers["X-Prometheus-Remote-Write-Version"] = "0.1.0"
+		if len(st.token) > 0 {
+			headers["Authorization"] = "Bearer " + st.token
+		}
+	} else {
+		body = timeseriesLines(points)
+		headers["Content-Type"] = "text/plain; charset=utf-8"
+		if len(st.token) > 0 {
+			headers["Authorization"] = "Token " + st.token
+		}
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if err = st.write(body, headers); err == nil {
+			return nil
+		}
+		if attempt >= st.retries || st.ctx.Err() != nil {
+			st.log.Error("write points failed, messages not acknowledged", st.tag(), zap.String("protocol", st.protocol), zap.Int("points", len(points)),
+				zap.Int("attempts", attempt+1), zap.Error(err), zap.Any("messages", held.metas))
+			return err
+		}
+		st.log.Warn("write points failed, retry later", st.tag(), zap.String("protocol", st.protocol), zap.Error(err), zap.Duration("backoff", backoff))
+		sleepContext(st.ctx, backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// write does not depend on the task context so close can flush.
+func (st *SinkTimeSeries) write(body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(http.MethodPost, st.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if len(st.user) > 0 {
+		req.SetBasicAuth(st.user, st.password)
+	}
+	status, res, err := doRequest(st.client, req)
+	if err != nil {
+		return err
+	}
+	if status > 299 {
+		return fmt.Errorf("%d: %s", status, strings.TrimSpace(string(res)))
+	}
+	return nil
+}
+
+// flushLoop writes the pending points every interval.
+func (st *SinkTimeSeries) flushLoop() {
+	ticker := time.NewTicker(st.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.stop:
+			return
+		case <-ticker.C:
+		}
+		st.mu.Lock()
+		points, held := st.points, st.held
+		st.points, st.held = nil, heldMessages{}
+		st.mu.Unlock()
+		_ = st.flush(points, held)
+	}
+}
+
+func (st *SinkTimeSeries) tag() zap.Field {
+	return zap.String("tag", "SinkTimeSeries")
+}
+
+// timeseriesMapping reads a list of field names, or a map of name to field.
+func timeseriesMapping(v interface{}) map[string]string {
+	r := make(map[string]string)
+	switch v := plainValue(v).(type) {
+	case []interface{}:
+		for _, f := range v {
+			r[fmt.Sprint(f)] = fmt.Sprint(f)
+		}
+	case map[string]interface{}:
+		for k, f := range v {
+			r[k] = fmt.Sprint(f)
+		}
+	case string:
+		r[v] = v
+	}
+	return r
+}
+
+// timeseriesLines encodes points in influx line protocol with nanosecond timestamps. go integers are written
+// as influx integers, json numbers as floats, the integer fields are converted by point.
+func timeseriesLines(points []*timeseriesPoint) []byte {
+	measurementEscape := strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscape := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscape := strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(measurementEscape.Replace(p.measurement))
+		for _, t := range p.tags {
+			if len(t[1]) == 0 {
+				continue
+			}
+			buf.WriteString("," + keyEscape.Replace(t[0]) + "=" + keyEscape.Replace(t[1]))
+		}
+		names := make([]string, 0, len(p.fields))
+		for name := range p.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			if i == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(keyEscape.Replace(name) + "=")
+			switch v := p.fields[name].(type) {
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+				buf.WriteString(fmt.Sprint(v) + "i")
+			case float32, float64:
+				buf.WriteString(fmt.Sprint(v))
+			case bool:
+				buf.WriteString(strconv.FormatBool(v))
+			case json.Number:
+				buf.WriteString(v.String())
+			case string:
+				buf.WriteString(`"` + stringEscape.Replace(v) + `"`)
+			default:
+				s, _ := jsonApi.MarshalToString(v)
+				buf.WriteString(`"` + stringEscape.Replace(s) + `"`)
+			}
+		}
+		buf.WriteString(" " + strconv.FormatInt(p.time.UnixNano(), 10) + "\n")
+	}
+	return buf.Bytes()
+}
+
+// timeseriesRemoteWrite encodes points as a prometheus WriteRequest, one series per numeric field.
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func timeseriesRemoteWrite(points []*timeseriesPoint) []byte {
+	var req []byte
+	for _, p := range points {
+		for name, v := range p.fields {
+			value, ok := timeseriesFloat(v)
+			if !ok {
+				continue
+			}
+			labels := [][2]string{{"__name__", timeseriesMetricName.ReplaceAllString(p.measurement+"_"+name, "_")}}
+			for _, t := range p.tags {
+				labels = append(labels, [2]string{timeseriesMetricName.ReplaceAllString(t[0], "_"), t[1]})
+			}
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i][0] < labels[j][0]
+			})
+			var series []byte
+			for _, l := range labels {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, l[0])
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, l[1])
+				series = protowire.AppendTag(series, 1, protowire.BytesType)
+				series = protowire.AppendBytes(series, label)
+			}
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(p.time.UnixNano()/int64(time.Millisecond)))
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, sample)
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, series)
+		}
+	}
+	return req
+}
+
+// timeseriesInt converts a number of an integer field, a value with a fraction is an error.
+func timeseriesInt(v interface{}) (int64, error) {
+	s := fmt.Sprint(v)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || math.Abs(f) >= 1<<63 {
+		return 0, fmt.Errorf("integer expected, got %v", v)
+	}
+	return int64(f), nil
+}
+
+// timeseriesFloat converts numbers and bools to a sample value.
+func timeseriesFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	return f, err == nil
+}
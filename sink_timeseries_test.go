@@ -0,0 +1,107 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTimeseriesLines(t *testing.T) {
+	st := &SinkTimeSeries{measurement: "cpu", tags: map[string]string{"host": "host"},
+		fields: map[string]string{"load": "load", "count": "count", "up": "up", "name": "name"}, integers: map[string]bool{"count": true}}
+	at := time.Unix(0, 1700000000000000000)
+	var points []*timeseriesPoint
+	for _, item := range []map[string]interface{}{
+		{"host": "a b", "load": json.Number("10"), "count": json.Number("3"), "up": true, "name": `x"y`},
+		{"host": "a", "load": json.Number("10.5"), "count": 4.0},
+	} {
+		p, err := st.point(item, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.time = at
+		points = append(points, p)
+	}
+	want := `cpu,host=a\ b count=3i,load=10,name="x\"y",up=true 1700000000000000000` + "\n" +
+		`cpu,host=a count=4i,load=10.5 1700000000000000000` + "\n"
+	if got := string(timeseriesLines(points)); got != want {
+		t.Fatalf("lines\n%s\nwant\n%s", got, want)
+	}
+	if _, err := st.point(map[string]interface{}{"count": json.Number("1.5")}, nil); err == nil {
+		t.Fatal("fraction accepted by an integer field")
+	}
+}
+
+func TestSinkTimeSeriesHoldAndRetry(t *testing.T) {
+	var hits int32
+	var body atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// slower than the read timeout of the shared transport, within the configured timeout
+		time.Sleep(2200 * time.Millisecond)
+		b, _ := ioutil.ReadAll(r.Body)
+		body.Store(string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	st := &SinkTimeSeries{}
+	st.init(&SinkConf{Type: "timeseries", Metadata: KeyValueConf{
+		"url": srv.URL, "measurement": "cpu", "fields": []interface{}{"load"}, "batchSize": 2, "timeout": 10,
+	}}, context.Background(), zap.NewNop())
+	defer st.Close()
+	done := 0
+	data := &TaskData{Payload: map[string]interface{}{"load": 1}, done: func() { done++ }}
+	st.DoSink(data)
+	data.Done()
+	if done != 0 {
+		t.Fatal("message acknowledged before its point is written")
+	}
+	data = &TaskData{Payload: map[string]interface{}{"load": 2}, done: func() { done++ }}
+	st.DoSink(data)
+	data.Done()
+	if done != 2 || atomic.LoadInt32(&hits) != 2 {
+		t.Fatalf("acknowledged %d after %d writes", done, hits)
+	}
+	if b, _ := body.Load().(string); strings.Count(b, "\n") != 2 {
+		t.Fatalf("body %q", b)
+	}
+}
+
+func TestSinkTimeSeriesFailedWrite(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	st := &SinkTimeSeries{}
+	st.init(&SinkConf{Type: "timeseries", Metadata: KeyValueConf{
+		"url": srv.URL, "measurement": "cpu", "fields": []interface{}{"load"}, "batchSize": 1, "retries": 10,
+	}}, ctx, zap.NewNop())
+	defer st.Close()
+	done, failed := 0, 0
+	data := &TaskData{Payload: map[string]interface{}{"load": 1}, done: func() { done++ }, fail: func() { failed++ }}
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	st.DoSink(data)
+	data.Done()
+	if cost := time.Since(start); cost > 2*time.Second {
+		t.Fatalf("retried for %v after the task was cancelled", cost)
+	}
+	// not acknowledged, the source delivers it again
+	if done != 0 || failed != 1 || atomic.LoadInt32(&hits) < 2 {
+		t.Fatalf("done %d, failed %d after %d writes", done, failed, hits)
+	}
+}
@@ -30,3 +30,15 @@ func newSource(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
 type Source interface {
 	Read() <-chan *TaskData
 }
+
+// Pausable is implemented by sources which can stop fetching upstream data without leaving their group/session.
+type Pausable interface {
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+// Failable is implemented by sources which can stop on an error. Err returns the error once the source channel is closed.
+type Failable interface {
+	Err() error
+}
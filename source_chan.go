@@ -0,0 +1,107 @@
+package job
+
+import (
+	"context"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"sync"
+)
+
+func init() {
+	RegisterSource("chan", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		name := conf.Metadata.GetString("name")
+		chanMutex.Lock()
+		s, ok := chanSources[name]
+		chanMutex.Unlock()
+		if !ok {
+			log.Panic("chan source not found, create it by NewChanSource first", zap.String("tag", "ChanSource"), zap.String("name", name))
+		}
+		s.bind(ctx)
+		return s
+	})
+}
+
+var chanSources = make(map[string]*ChanSource)
+var chanMutex = sync.Mutex{}
+
+// ChanSource is an in-memory source. library users and tests create it by name, refer to it in the task conf
+// with type chan and metadata name, and feed TaskData into the task by Send.
+// the task finishes after Close, or the source is closed when the task stops.
+type ChanSource struct {
+	name    string
+	mc      chan *TaskData
+	done    chan struct{}
+	once    sync.Once
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// NewChanSource creates and registers a ChanSource, an existing one with the same name is replaced.
+func NewChanSource(name string, buffer int) *ChanSource {
+	cs := &ChanSource{
+		name: name,
+		mc:   make(chan *TaskData, util.MaxInt(buffer, 0)),
+		done: make(chan struct{}),
+	}
+	chanMutex.Lock()
+	defer chanMutex.Unlock()
+	if _, ok := chanSources[name]; ok {
+		util.Warn("chan source [%s] already exists, replaced.", name)
+	}
+	chanSources[name] = cs
+	return cs
+}
+
+func (cs *ChanSource) Read() <-chan *TaskData {
+	return cs.mc
+}
+
+// Send blocks until the task takes data, false if the source is closed.
+func (cs *ChanSource) Send(data *TaskData) bool {
+	cs.closeMu.RLock()
+	defer cs.closeMu.RUnlock()
+	if cs.closed {
+		return false
+	}
+	select {
+	case cs.mc <- data:
+		return true
+	case <-cs.done:
+		return false
+	}
+}
+
+// SendPayload sends a payload with metadata, and calls done once the data passed all sinks if done is not nil.
+// done is not called for data which failed, e.g. a sink panicked.
+func (cs *ChanSource) SendPayload(payload interface{}, meta KeyValueConf, done func()) bool {
+	if meta == nil {
+		meta = make(KeyValueConf)
+	}
+	return cs.Send(&TaskData{Payload: payload, Metadata: meta, done: done})
+}
+
+// Close stops the source, the task finishes once the sent data is processed.
+func (cs *ChanSource) Close() {
+	cs.once.Do(func() {
+		close(cs.done)
+		cs.closeMu.Lock()
+		cs.closed = true
+		close(cs.mc)
+		cs.closeMu.Unlock()
+		chanMutex.Lock()
+		if chanSources[cs.name] == cs {
+			delete(chanSources, cs.name)
+		}
+		chanMutex.Unlock()
+	})
+}
+
+func (cs *ChanSource) bind(ctx context.Context) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			cs.Close()
+		case <-cs.done:
+		}
+	}()
+}
@@ -0,0 +1,110 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func chanSourceOf(name string) (*ChanSource, bool) {
+	chanMutex.Lock()
+	defer chanMutex.Unlock()
+	cs, ok := chanSources[name]
+	return cs, ok
+}
+
+func TestChanSource(t *testing.T) {
+	cs := NewChanSource("test-chan", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if s := newSource(&SourceConf{Type: "chan", Metadata: KeyValueConf{"name": "test-chan"}}, ctx, zap.NewNop()); s != cs {
+		t.Fatal("task source is not the registered chan source")
+	}
+	done := 0
+	if !cs.SendPayload("a", nil, func() { done++ }) {
+		t.Fatal("send failed")
+	}
+	dt := <-cs.Read()
+	if dt.Payload != "a" || dt.Metadata == nil {
+		t.Fatalf("data %v %v", dt.Payload, dt.Metadata)
+	}
+	dt.Done()
+	if done != 1 {
+		t.Fatal("done not called")
+	}
+	cs.Close()
+	cs.Close()
+	if _, ok := <-cs.Read(); ok {
+		t.Fatal("source not closed")
+	}
+	if cs.SendPayload("b", nil, nil) {
+		t.Fatal("sent after close")
+	}
+	if _, ok := chanSourceOf("test-chan"); ok {
+		t.Fatal("closed source still registered")
+	}
+}
+
+func TestChanSourceSendBlocked(t *testing.T) {
+	cs := NewChanSource("test-chan-blocked", 0)
+	sent := make(chan bool)
+	go func() {
+		sent <- cs.SendPayload("a", nil, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cs.Close()
+	select {
+	case ok := <-sent:
+		if ok {
+			t.Fatal("data sent without a reader")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after close")
+	}
+}
+
+func TestChanSourceDuplicateName(t *testing.T) {
+	first := NewChanSource("test-chan-dup", 0)
+	second := NewChanSource("test-chan-dup", 0)
+	if cs, _ := chanSourceOf("test-chan-dup"); cs != second {
+		t.Fatal("existing source not replaced")
+	}
+	// closing the replaced source keeps the new one registered
+	first.Close()
+	if cs, _ := chanSourceOf("test-chan-dup"); cs != second {
+		t.Fatal("new source unregistered by the replaced one")
+	}
+	second.Close()
+	if _, ok := chanSourceOf("test-chan-dup"); ok {
+		t.Fatal("source still registered after close")
+	}
+}
+
+func TestChanSourceTaskStopped(t *testing.T) {
+	cs := NewChanSource("test-chan-stopped", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	newSource(&SourceConf{Type: "chan", Metadata: KeyValueConf{"name": "test-chan-stopped"}}, ctx, zap.NewNop())
+	cancel()
+	select {
+	case _, ok := <-cs.Read():
+		if ok {
+			t.Fatal("data after the task stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("source not closed after the task stopped")
+	}
+	if _, ok := chanSourceOf("test-chan-stopped"); ok {
+		t.Fatal("source still registered after the task stopped")
+	}
+}
+
+func TestChanSourceNotFound(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for an unknown chan source")
+		}
+	}()
+	newSource(&SourceConf{Type: "chan", Metadata: KeyValueConf{"name": "test-chan-missing"}}, context.Background(), zap.NewNop())
+}
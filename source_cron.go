@@ -0,0 +1,123 @@
+package job
+
+import (
+	"context"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("cron", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &CronSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// CronSource emits the static payload on a cron schedule or a fixed interval, a list of maps is emitted as a batch.
+// a tick is skipped when the previous one is still waiting to be read.
+type CronSource struct {
+	conf    *SourceConf
+	log     *zap.Logger
+	ctx     context.Context
+	mc      chan *TaskData
+	cron    *cron.Cron
+	payload interface{}
+	meta    KeyValueConf
+	started sync.WaitGroup
+}
+
+func (cs *CronSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	cs.conf = conf
+	cs.log = log
+	cs.ctx = ctx
+	cs.mc = make(chan *TaskData)
+	cs.payload = conf.Metadata["payload"]
+	cs.meta = conf.Metadata.GetKeyValueConf("meta")
+	//
+	spec := conf.Metadata.GetString("cron")
+	if interval := conf.Metadata.GetInt("interval"); len(spec) == 0 && interval > 0 {
+		spec = "@every " + (time.Duration(interval) * time.Second).String()
+	}
+	if len(spec) == 0 {
+		log.Panic("missing cron or interval config for CronSource", cs.tag())
+	}
+	loc := time.Local
+	if tz := conf.Metadata.GetString("timezone"); len(tz) > 0 {
+		if l, err := time.LoadLocation(tz); err != nil {
+			log.Panic("unknown timezone for CronSource", cs.tag(), zap.String("timezone", tz), zap.Error(err))
+		} else {
+			loc = l
+		}
+	}
+	opts := []cron.Option{
+		cron.WithLocation(loc),
+		cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)),
+	}
+	if conf.Metadata.GetBool("seconds") {
+		opts = append(opts, cron.WithSeconds())
+	}
+	cs.cron = cron.New(opts...)
+	if _, err := cs.cron.AddFunc(spec, cs.tick); err != nil {
+		log.Panic("bad cron spec for CronSource", cs.tag(), zap.String("cron", spec), zap.Error(err))
+	}
+	cs.cron.Start()
+	log.Info("cron source started", cs.tag(), zap.String("cron", spec))
+	if conf.Metadata.GetBool("runOnStart") {
+		cs.started.Add(1)
+		go func() {
+			defer cs.started.Done()
+			cs.tick()
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		// wait the running ticks to give up, no more messages after that
+		<-cs.cron.Stop().Done()
+		cs.started.Wait()
+		close(cs.mc)
+	}()
+}
+
+func (cs *CronSource) Read() <-chan *TaskData {
+	return cs.mc
+}
+
+func (cs *CronSource) tick() {
+	now := time.Now()
+	dt := &TaskData{Payload: cronPayload(cs.payload)}
+	dt.Metadata = map[string]interface{}{
+		"tick": now,
+	}
+	for k, v := range cs.meta {
+		dt.Metadata[k] = v
+	}
+	select {
+	case cs.mc <- dt:
+		cs.log.Debug("cron tick", cs.tag(), zap.Time("tick", now))
+	case <-cs.ctx.Done():
+	}
+}
+
+// cronPayload copies the configured payload for a tick, a list of maps becomes []map[string]interface{} like the
+// batches of other sources, which sinks take as a list of items.
+func cronPayload(v interface{}) interface{} {
+	p := plainValue(v)
+	list, ok := p.([]interface{})
+	if !ok || len(list) == 0 {
+		return p
+	}
+	items := make([]map[string]interface{}, len(list))
+	for i, e := range list {
+		if items[i], ok = e.(map[string]interface{}); !ok {
+			return p
+		}
+	}
+	return items
+}
+
+func (cs *CronSource) tag() zap.Field {
+	return zap.String("tag", "CronSource")
+}
@@ -0,0 +1,57 @@
+package job
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCronPayload(t *testing.T) {
+	list := []interface{}{map[interface{}]interface{}{"id": 1}, map[interface{}]interface{}{"id": 2}}
+	items, ok := cronPayload(list).([]map[string]interface{})
+	if !ok || len(items) != 2 || items[1]["id"] != 2 {
+		t.Fatalf("payload %#v, want a batch of maps", cronPayload(list))
+	}
+	// the payload of every tick is a copy
+	items[0]["id"] = 3
+	if again := cronPayload(list).([]map[string]interface{}); again[0]["id"] != 1 {
+		t.Fatal("configured payload changed by a tick")
+	}
+	for _, v := range []interface{}{"ping", []interface{}{1, "a"}, []interface{}{map[interface{}]interface{}{"id": 1}, "a"}, []interface{}{}} {
+		if p := cronPayload(v); reflect.TypeOf(p) != reflect.TypeOf(v) {
+			t.Fatalf("payload %#v changed to %T", v, p)
+		}
+	}
+}
+
+func TestCronSourceRunOnStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cs := &CronSource{}
+	cs.init(&SourceConf{Type: "cron", Metadata: KeyValueConf{
+		"cron":       "0 0 1 1 *",
+		"runOnStart": true,
+		"payload":    []interface{}{map[interface{}]interface{}{"job": "report"}},
+		"meta":       map[interface{}]interface{}{"topic": "daily"},
+	}}, ctx, zap.NewNop())
+	select {
+	case dt := <-cs.Read():
+		items, ok := dt.Payload.([]map[string]interface{})
+		if !ok || items[0]["job"] != "report" || dt.Metadata["topic"] != "daily" || dt.Metadata["tick"] == nil {
+			t.Fatalf("data %#v %v", dt.Payload, dt.Metadata)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no tick on start")
+	}
+	cancel()
+	select {
+	case _, ok := <-cs.Read():
+		if ok {
+			t.Fatal("tick after the task stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("source not closed after the task stopped")
+	}
+}
@@ -0,0 +1,355 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/ywengineer/g-util/es"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("elastic", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &ESSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	ESReadScroll = "scroll"
+	ESReadPit    = "pit"
+)
+
+type esHit struct {
+	Index  string                 `json:"_index"`
+	ID     string                 `json:"_id"`
+	Source map[string]interface{} `json:"_source"`
+	Sort   []interface{}          `json:"sort"`
+}
+
+type esSearchResult struct {
+	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id"`
+	Hits     struct {
+		Hits []esHit `json:"hits"`
+	} `json:"hits"`
+}
+
+// ESSource reads all documents matching a query by scroll, or by search_after with a point in time.
+// each page becomes a []map payload of the hit sources, the _index and _id metadata are lists of the hits in the
+// order of the items, SinkES indexes an item by its _id. the source is closed after the last page, so the task finishes.
+type ESSource struct {
+	conf      *SourceConf
+	log       *zap.Logger
+	ctx       context.Context
+	mc        chan *TaskData
+	_es       *esapi.API
+	address   []string
+	indices   []string
+	mode      string
+	query     interface{}
+	sort      interface{}
+	fields    []string
+	size      int
+	keepAlive string
+	meta      KeyValueConf
+	err       error
+}
+
+func (ss *ESSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	ss.conf = conf
+	ss.log = log
+	ss.ctx = ctx
+	ss.indices = conf.Metadata.GetStringSlice("index")
+	if len(ss.indices) == 0 {
+		log.Panic("missing index config for ESSource", ss.tag())
+	}
+	ss.mode = conf.Metadata.GetStringOrDefault("mode", ESReadScroll)
+	if ss.mode != ESReadScroll && ss.mode != ESReadPit {
+		log.Panic("unsupported mode for ESSource", ss.tag(), zap.String("mode", ss.mode))
+	}
+	ss.query = plainValue(conf.Metadata["query"])
+	if ss.query == nil {
+		ss.query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	ss.sort = plainValue(conf.Metadata["sort"])
+	if ss.sort == nil {
+		// cheapest orders, pit requires a tiebreaker which _shard_doc provides
+		if ss.mode == ESReadPit {
+			ss.sort = []interface{}{map[string]interface{}{"_shard_doc": "asc"}}
+		} else {
+			ss.sort = []interface{}{"_doc"}
+		}
+	}
+	ss.fields = conf.Metadata.GetStringSlice("fields")
+	ss.size = conf.Metadata.GetInt("size")
+	if ss.size <= 0 {
+		ss.size = 1000
+	}
+	ss.keepAlive = strconv.Itoa(util.MaxInt(conf.Metadata.GetInt("keepAlive"), 60)) + "s"
+	ss.meta = conf.Metadata.GetKeyValueConf("meta")
+	//
+	if conf.Metadata.GetBool("global") {
+		if _es == nil {
+			log.Panic("global elastic client not set.")
+		} else {
+			ss._es = _es
+			ss.address = _esAddress
+		}
+	} else {
+		ss.address = conf.Metadata.GetStringSlice(ConfAddress)
+		ss._es = es.NewESClient(ss.address, log)
+	}
+	if ss.mode == ESReadPit && len(ss.address) == 0 {
+		log.Panic("missing address config of pit mode for ESSource", ss.tag())
+	}
+	ss.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	go ss.run()
+}
+
+func (ss *ESSource) Read() <-chan *TaskData {
+	return ss.mc
+}
+
+func (ss *ESSource) run() {
+	defer close(ss.mc)
+	start := time.Now()
+	var pages, hits int
+	var err error
+	if ss.mode == ESReadPit {
+		pages, hits, err = ss.readPit()
+	} else {
+		pages, hits, err = ss.readScroll()
+	}
+	// the error is set before the channel is closed, so the task reads it once no more pages
+	if err != nil && ss.ctx.Err() == nil {
+		ss.log.Error("read elastic failed", ss.tag(), zap.Strings("index", ss.indices), zap.Int("pages", pages), zap.Int("hits", hits), zap.Error(err))
+		ss.err = err
+		return
+	}
+	ss.log.Info("read elastic finished", ss.tag(), zap.Strings("index", ss.indices), zap.Int("pages", pages), zap.Int("hits", hits), zap.Duration("cost", time.Since(start)))
+}
+
+// Err returns the error stopping the read, nil if all pages are read or it is stopped by the task.
+func (ss *ESSource) Err() error {
+	return ss.err
+}
+
+func (ss *ESSource) readScroll() (int, int, error) {
+	search := ss._es.Search
+	body := ss.body()
+	res, err := search(
+		search.WithIndex(ss.indices...),
+		search.WithBody(strings.NewReader(body)),
+		search.WithScroll(ss.keepAliveDuration()),
+		search.WithContext(ss.ctx),
+	)
+	r, err := ss.result(res, err)
+	scrollID := ""
+	defer func() {
+		if len(scrollID) > 0 {
+			ss.clearScroll(scrollID)
+		}
+	}()
+	pages, hits := 0, 0
+	for err == nil {
+		scrollID = r.ScrollID
+		if len(r.Hits.Hits) == 0 {
+			return pages, hits, nil
+		}
+		if !ss.emit(r.Hits.Hits, pages) {
+			return pages, hits, ss.ctx.Err()
+		}
+		pages++
+		hits += len(r.Hits.Hits)
+		//
+		scroll := ss._es.Scroll
+		body, _ := jsonApi.MarshalToString(map[string]interface{}{"scroll": ss.keepAlive, "scroll_id": scrollID})
+		res, err = scroll(scroll.WithBody(strings.NewReader(body)), scroll.WithContext(ss.ctx))
+		r, err = ss.result(res, err)
+	}
+	return pages, hits, err
+}
+
+func (ss *ESSource) clearScroll(scrollID string) {
+	clear := ss._es.ClearScroll
+	body, _ := jsonApi.MarshalToString(map[string]interface{}{"scroll_id": []string{scrollID}})
+	res, err := clear(clear.WithBody(strings.NewReader(body)), clear.WithContext(context.Background()))
+	if err != nil || res.IsError() {
+		ss.log.Warn("clear scroll failed", ss.tag(), zap.Error(err))
+	}
+	if res != nil {
+		_ = res.Body.Close()
+	}
+}
+
+func (ss *ESSource) readPit() (int, int, error) {
+	pit := make(map[string]interface{})
+	if err := ss.raw(ss.ctx, http.MethodPost, "/"+strings.Join(ss.indices, ",")+"/_pit?keep_alive="+ss.keepAlive, nil, &pit); err != nil {
+		return 0, 0, err
+	}
+	pitID, _ := pit["id"].(string)
+	defer func() {
+		// closed even if the task is cancelled
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := ss.raw(ctx, http.MethodDelete, "/_pit", map[string]interface{}{"id": pitID}, nil); err != nil {
+			ss.log.Warn("close point in time failed", ss.tag(), zap.Error(err))
+		}
+	}()
+	pages, hits := 0, 0
+	var after []interface{}
+	for {
+		req := map[string]interface{}{
+			"size":  ss.size,
+			"query": ss.query,
+			"sort":  ss.sort,
+			"pit":   map[string]interface{}{"id": pitID, "keep_alive": ss.keepAlive},
+		}
+		if len(ss.fields) > 0 {
+			req["_source"] = ss.fields
+		}
+		if after != nil {
+			req["search_after"] = after
+		}
+		body, err := jsonApi.MarshalToString(req)
+		if err != nil {
+			return pages, hits, err
+		}
+		// the index is given by the point in time, search without an index path
+		search := ss._es.Search
+		r, err := ss.result(search(search.WithBody(strings.NewReader(body)), search.WithContext(ss.ctx)))
+		if err != nil {
+			return pages, hits, err
+		}
+		if len(r.PitID) > 0 {
+			pitID = r.PitID
+		}
+		if len(r.Hits.Hits) == 0 {
+			return pages, hits, nil
+		}
+		if !ss.emit(r.Hits.Hits, pages) {
+			return pages, hits, ss.ctx.Err()
+		}
+		pages++
+		hits += len(r.Hits.Hits)
+		after = r.Hits.Hits[len(r.Hits.Hits)-1].Sort
+		if len(r.Hits.Hits) < ss.size {
+			return pages, hits, nil
+		}
+	}
+}
+
+// body is the first scroll request.
+func (ss *ESSource) body() string {
+	req := map[string]interface{}{
+		"size":  ss.size,
+		"query": ss.query,
+		"sort":  ss.sort,
+	}
+	if len(ss.fields) > 0 {
+		req["_source"] = ss.fields
+	}
+	body, _ := jsonApi.MarshalToString(req)
+	return body
+}
+
+func (ss *ESSource) emit(hits []esHit, page int) bool {
+	items := make([]map[string]interface{}, 0, len(hits))
+	indices := make([]string, 0, len(hits))
+	ids := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		item := hit.Source
+		if item == nil {
+			item = make(map[string]interface{})
+		}
+		items = append(items, item)
+		indices = append(indices, hit.Index)
+		ids = append(ids, hit.ID)
+	}
+	meta := KeyValueConf{
+		"index":  strings.Join(ss.indices, ","),
+		"page":   page,
+		"count":  len(items),
+		"_index": indices,
+		"_id":    ids,
+	}
+	for k, v := range ss.meta {
+		meta[k] = v
+	}
+	select {
+	case ss.mc <- &TaskData{Payload: items, Metadata: meta}:
+		return true
+	case <-ss.ctx.Done():
+		return false
+	}
+}
+
+func (ss *ESSource) result(res *esapi.Response, err error) (*esSearchResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		data, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("elastic search failed. %d: %s", res.StatusCode, string(data))
+	}
+	r := &esSearchResult{}
+	if err := jsonApi.NewDecoder(res.Body).Decode(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// raw sends the request to the first reachable address, for apis the client does not provide.
+func (ss *ESSource) raw(ctx context.Context, method, path string, body, result interface{}) error {
+	var err error
+	for _, address := range ss.address {
+		var reader io.Reader
+		if body != nil {
+			b, e := jsonApi.MarshalToString(body)
+			if e != nil {
+				return e
+			}
+			reader = strings.NewReader(b)
+		}
+		req, e := http.NewRequestWithContext(ctx, method, strings.TrimRight(address, "/")+path, reader)
+		if e != nil {
+			return e
+		}
+		req.Header.Set("Content-Type", "application/json")
+		status, data, e := roundTripContext(req)
+		if e != nil {
+			if ctx.Err() != nil {
+				return e
+			}
+			err = e
+			continue
+		}
+		if status > 299 {
+			return fmt.Errorf("elastic %s %s failed. %d: %s", method, path, status, string(data))
+		}
+		if result == nil {
+			return nil
+		}
+		return jsonApi.Unmarshal(data, result)
+	}
+	return err
+}
+
+func (ss *ESSource) keepAliveDuration() time.Duration {
+	d, _ := time.ParseDuration(ss.keepAlive)
+	return d
+}
+
+func (ss *ESSource) tag() zap.Field {
+	return zap.String("tag", "ESSource")
+}
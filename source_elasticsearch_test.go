@@ -0,0 +1,116 @@
+package job
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// esSourceStandIn answers the info, search, scroll and point in time apis with two hits.
+type esSourceStandIn struct {
+	mu       sync.Mutex
+	requests []string
+	status   int
+}
+
+func (es *esSourceStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	es.mu.Lock()
+	es.requests = append(es.requests, r.Method+" "+r.URL.Path)
+	es.mu.Unlock()
+	hits := `{"hits":{"hits":[{"_index":"players-1","_id":"a","_source":{"name":"x"},"sort":[1]},{"_index":"players-2","_id":"b","_source":{"name":"y"},"sort":[2]}]}}`
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/":
+		_, _ = w.Write([]byte(`{"version":{"number":"7.10.0"}}`))
+	case es.status > 0:
+		w.WriteHeader(es.status)
+		_, _ = w.Write([]byte(`{"error":"search failed"}`))
+	case r.URL.Path == "/players/_pit":
+		_, _ = w.Write([]byte(`{"id":"p1"}`))
+	case r.URL.Path == "/players/_search":
+		_, _ = w.Write([]byte(`{"_scroll_id":"s1",` + hits[1:]))
+	case r.URL.Path == "/_search/scroll" && r.Method == http.MethodPost:
+		_, _ = w.Write([]byte(`{"_scroll_id":"s1","hits":{"hits":[]}}`))
+	case r.URL.Path == "/_search" && strings.Contains(string(body), `"search_after"`):
+		_, _ = w.Write([]byte(`{"pit_id":"p1","hits":{"hits":[]}}`))
+	case r.URL.Path == "/_search":
+		_, _ = w.Write([]byte(`{"pit_id":"p1",` + hits[1:]))
+	default:
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
+
+func readESSource(t *testing.T, es *esSourceStandIn, mode string) (*ESSource, []*TaskData) {
+	srv := httptest.NewServer(es)
+	t.Cleanup(srv.Close)
+	ss := &ESSource{}
+	ss.init(&SourceConf{Type: "elastic", Metadata: KeyValueConf{
+		ConfAddress: []interface{}{srv.URL}, "index": []interface{}{"players"}, "mode": mode, "size": 2,
+	}}, context.Background(), zap.NewNop())
+	var pages []*TaskData
+	for dt := range ss.Read() {
+		pages = append(pages, dt)
+	}
+	return ss, pages
+}
+
+func TestESSourceHitMetadata(t *testing.T) {
+	for _, mode := range []string{ESReadScroll, ESReadPit} {
+		es := &esSourceStandIn{}
+		ss, pages := readESSource(t, es, mode)
+		if ss.Err() != nil || len(pages) != 1 {
+			t.Fatalf("%s: %d pages, error %v", mode, len(pages), ss.Err())
+		}
+		items := pages[0].Payload.([]map[string]interface{})
+		if len(items) != 2 || len(items[0]) != 1 || items[0]["name"] != "x" {
+			t.Fatalf("%s: items %v, want the sources only", mode, items)
+		}
+		meta := pages[0].Metadata
+		if ids, _ := meta["_id"].([]string); len(ids) != 2 || ids[1] != "b" {
+			t.Fatalf("%s: metadata %v", mode, meta)
+		}
+		// the ids are indexed by SinkES
+		sm := &SinkES{}
+		doc, err := sm.document(items[1], esItemMeta(meta, 1, len(items)))
+		if err != nil || doc["_id"] != "b" {
+			t.Fatalf("%s: document %v, error %v", mode, doc, err)
+		}
+		es.mu.Lock()
+		last := es.requests[len(es.requests)-1]
+		es.mu.Unlock()
+		if want := map[string]string{ESReadScroll: "DELETE /_search/scroll", ESReadPit: "DELETE /_pit"}[mode]; last != want {
+			t.Fatalf("%s: last request %s, want %s", mode, last, want)
+		}
+	}
+}
+
+func TestESSourceSearchError(t *testing.T) {
+	for _, mode := range []string{ESReadScroll, ESReadPit} {
+		ss, pages := readESSource(t, &esSourceStandIn{status: http.StatusInternalServerError}, mode)
+		if ss.Err() == nil || len(pages) != 0 {
+			t.Fatalf("%s: %d pages, error %v", mode, len(pages), ss.Err())
+		}
+	}
+}
+
+func TestESItemMeta(t *testing.T) {
+	meta := KeyValueConf{"_id": []string{"a", "b"}, "_index": []string{"i1", "i2"}, "topic": "t"}
+	item := esItemMeta(meta, 1, 2)
+	if item["_id"] != "b" || item["_index"] != "i2" || item["topic"] != "t" {
+		t.Fatalf("item metadata %v", item)
+	}
+	if _, ok := meta["_id"].([]string); !ok {
+		t.Fatal("metadata of the message changed")
+	}
+	// lists not matching the items are kept
+	if item = esItemMeta(meta, 0, 3); item["_id"] == "a" {
+		t.Fatalf("item metadata %v", item)
+	}
+}
@@ -0,0 +1,422 @@
+package job
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("file", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &FileSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// filePosition is the persisted read position of a file, offset is the uncompressed byte offset of the next line.
+// positions are keyed by file id, path is the last known path of the file.
+type filePosition struct {
+	Path   string `json:"path,omitempty"`
+	Offset int64  `json:"offset"`
+	Line   int64  `json:"line"`
+}
+
+// fileTracker tracks in-flight lines of a file, the committed position never passes an unfinished line.
+type fileTracker struct {
+	path      string
+	mu        sync.Mutex
+	committed filePosition
+	pending   map[int64]int64
+	next      filePosition
+}
+
+func (ft *fileTracker) track(line, offset int64, next filePosition) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.pending[line] = offset
+	ft.next = next
+}
+
+func (ft *fileTracker) done(line int64) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	delete(ft.pending, line)
+	if len(ft.pending) == 0 {
+		ft.committed = ft.next
+		return
+	}
+	min := int64(-1)
+	for l := range ft.pending {
+		if min < 0 || l < min {
+			min = l
+		}
+	}
+	ft.committed = filePosition{Offset: ft.pending[min], Line: min - 1}
+}
+
+// untrack releases the latest tracked line which was never sent, the position stays before it.
+func (ft *fileTracker) untrack(line, offset int64) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	delete(ft.pending, line)
+	ft.next = filePosition{Offset: offset, Line: line - 1}
+	if len(ft.pending) == 0 {
+		ft.committed = ft.next
+	}
+}
+
+func (ft *fileTracker) position() filePosition {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.committed
+}
+
+// tailFile is a file opened by the source.
+type tailFile struct {
+	id         string
+	path       string
+	file       *os.File
+	compressed bool
+	reader     *bufio.Reader
+	partial    []byte
+	offset     int64
+	line       int64
+	tracker    *fileTracker
+}
+
+// FileSource reads lines of files matching a glob pattern. each line becomes a TaskData.
+type FileSource struct {
+	conf         *SourceConf
+	log          *zap.Logger
+	ctx          context.Context
+	mc           chan *TaskData
+	codec        Codec
+	pattern      string
+	tail         bool
+	gzip         bool
+	positionFile string
+	interval     time.Duration
+	//
+	mu        sync.Mutex
+	trackers  map[string]*fileTracker
+	inflight  sync.WaitGroup
+	positions map[string]filePosition
+	seen      map[string]bool
+}
+
+func (fs *FileSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	fs.conf = conf
+	fs.log = log
+	fs.ctx = ctx
+	fs.pattern = conf.Metadata.GetString("path")
+	if len(fs.pattern) == 0 {
+		log.Panic("missing path config for FileSource", fs.tag())
+	}
+	if _, err := filepath.Match(fs.pattern, ""); err != nil {
+		log.Panic("bad path pattern for FileSource", fs.tag(), zap.String("path", fs.pattern), zap.Error(err))
+	}
+	fs.tail = conf.Metadata.GetBool("tail")
+	fs.gzip = conf.Metadata.GetBool("gzip")
+	fs.positionFile = conf.Metadata.GetString("positionFile")
+	fs.interval = time.Duration(util.MaxInt(conf.Metadata.GetInt("interval"), 1)) * time.Second
+	fs.codec = newSourceCodec(conf, ctx, log)
+	if fs.codec == nil && conf.Metadata.GetStringOrDefault("format", "line") == "jsonl" {
+		fs.codec = &JsonCodec{}
+	}
+	fs.trackers = make(map[string]*fileTracker)
+	fs.positions = fs.loadPositions()
+	fs.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	//
+	go fs.run()
+}
+
+func (fs *FileSource) Read() <-chan *TaskData {
+	return fs.mc
+}
+
+func (fs *FileSource) run() {
+	defer func() {
+		// wait the in-flight lines, so the final positions are persisted before the task finishes
+		defer close(fs.mc)
+		drained := make(chan bool)
+		go func() {
+			fs.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(10 * time.Second):
+			fs.log.Warn("wait in-flight lines timeout", fs.tag())
+		}
+		fs.savePositions()
+	}()
+	// opened files are keyed by file id, a file renamed to a path still matching the pattern is read on
+	opened := make(map[string]*tailFile)
+	defer func() {
+		for _, tf := range opened {
+			_ = tf.file.Close()
+		}
+	}()
+	ticker := time.NewTicker(fs.interval)
+	defer ticker.Stop()
+	for {
+		current, ok := fs.glob()
+		for id, path := range current {
+			if tf, ok := opened[id]; ok {
+				if tf.path != path {
+					fs.log.Info("file renamed", fs.tag(), zap.String("from", tf.path), zap.String("path", path))
+					fs.rename(tf, path)
+				}
+			} else if tf := fs.open(path, id); tf != nil {
+				opened[id] = tf
+			}
+		}
+		files := make([]*tailFile, 0, len(opened))
+		for _, tf := range opened {
+			files = append(files, tf)
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+		for _, tf := range files {
+			if !fs.readLines(tf) {
+				return
+			}
+			if !fs.tail {
+				_ = tf.file.Close()
+				delete(opened, tf.id)
+			} else if _, exists := current[tf.id]; ok && !exists {
+				fs.log.Info("file removed", fs.tag(), zap.String("path", tf.path))
+				_ = tf.file.Close()
+				delete(opened, tf.id)
+				fs.resetPosition(tf.id)
+			} else if fs.truncated(tf) {
+				fs.log.Info("file truncated", fs.tag(), zap.String("path", tf.path))
+				_ = tf.file.Close()
+				delete(opened, tf.id)
+				fs.resetPosition(tf.id)
+			}
+		}
+		if !fs.tail {
+			return
+		}
+		select {
+		case <-fs.ctx.Done():
+			return
+		case <-ticker.C:
+			fs.savePositions()
+		}
+	}
+}
+
+// glob returns the paths of files matching the pattern keyed by file id, false if glob failed.
+func (fs *FileSource) glob() (map[string]string, bool) {
+	paths, err := filepath.Glob(fs.pattern)
+	if err != nil {
+		fs.log.Error("glob files failed", fs.tag(), zap.String("path", fs.pattern), zap.Error(err))
+		return nil, false
+	}
+	files := make(map[string]string, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files[fileID(path, info)] = path
+	}
+	fs.mu.Lock()
+	fs.seen = make(map[string]bool, len(files))
+	for id := range files {
+		fs.seen[id] = true
+	}
+	fs.mu.Unlock()
+	return files, true
+}
+
+func (fs *FileSource) open(path, id string) *tailFile {
+	f, err := os.Open(path)
+	if err != nil {
+		fs.log.Error("open file failed", fs.tag(), zap.String("path", path), zap.Error(err))
+		return nil
+	}
+	fs.mu.Lock()
+	pos := fs.positions[id]
+	tracker, ok := fs.trackers[id]
+	if !ok {
+		tracker = &fileTracker{committed: pos, next: pos, pending: make(map[int64]int64)}
+		fs.trackers[id] = tracker
+	}
+	tracker.path = path
+	fs.mu.Unlock()
+	//
+	tf := &tailFile{id: id, path: path, file: f, tracker: tracker}
+	var r io.Reader = f
+	if fs.gzip || strings.HasSuffix(path, ".gz") {
+		tf.compressed = true
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			fs.log.Error("open gzip file failed", fs.tag(), zap.String("path", path), zap.Error(err))
+			_ = f.Close()
+			return nil
+		}
+		r = gz
+		// gzip stream is not seekable, skip the read bytes
+		if _, err := io.CopyN(ioutil.Discard, gz, pos.Offset); err != nil && err != io.EOF {
+			fs.log.Error("skip read gzip data failed", fs.tag(), zap.String("path", path), zap.Error(err))
+		}
+	} else if info, err := f.Stat(); err == nil && info.Size() < pos.Offset {
+		// truncated or replaced since the position was saved
+		pos = filePosition{}
+		tracker.committed, tracker.next = pos, pos
+	} else if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		fs.log.Error("seek file failed", fs.tag(), zap.String("path", path), zap.Error(err))
+	}
+	tf.reader = bufio.NewReader(r)
+	tf.offset = pos.Offset
+	tf.line = pos.Line
+	fs.log.Info("file opened", fs.tag(), zap.String("path", path), zap.Int64("offset", pos.Offset), zap.Int64("line", pos.Line))
+	return tf
+}
+
+// readLines sends all complete lines available, false if the source is stopped.
+func (fs *FileSource) readLines(tf *tailFile) bool {
+	for {
+		data, err := tf.reader.ReadBytes('\n')
+		if len(data) > 0 {
+			tf.partial = append(tf.partial, data...)
+		}
+		// an incomplete line is kept until the rest is written in tail mode
+		complete := len(tf.partial) > 0 && (tf.partial[len(tf.partial)-1] == '\n' || (err == io.EOF && !fs.tail))
+		if complete {
+			offset := tf.offset
+			tf.offset += int64(len(tf.partial))
+			tf.line++
+			line := strings.TrimRight(string(tf.partial), "\r\n")
+			tf.partial = nil
+			if len(line) > 0 && !fs.send(tf, line, offset) {
+				return false
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				fs.log.Error("read file failed", fs.tag(), zap.String("path", tf.path), zap.Error(err))
+			}
+			return true
+		}
+	}
+}
+
+func (fs *FileSource) send(tf *tailFile, line string, offset int64) bool {
+	lineNo := tf.line
+	dt := &TaskData{Payload: []byte(line)}
+	dt.Metadata = map[string]interface{}{
+		"path":   tf.path,
+		"line":   lineNo,
+		"offset": offset,
+	}
+	decodePayload(fs.codec, dt, fs.log)
+	tracker := tf.tracker
+	tracker.track(lineNo, offset, filePosition{Offset: tf.offset, Line: lineNo})
+	fs.inflight.Add(1)
+	dt.done = func() {
+		tracker.done(lineNo)
+		fs.inflight.Done()
+	}
+	// a failed line stays pending, the position never passes it and it is read again after restart
+	dt.fail = fs.inflight.Done
+	select {
+	case fs.mc <- dt:
+		return true
+	case <-fs.ctx.Done():
+		tracker.untrack(lineNo, offset)
+		fs.inflight.Done()
+		return false
+	}
+}
+
+// truncated checks whether the opened file is truncated. the size of a compressed file is not comparable
+// with the uncompressed offset, compressed files are never treated as truncated.
+func (fs *FileSource) truncated(tf *tailFile) bool {
+	if tf.compressed {
+		return false
+	}
+	info, err := tf.file.Stat()
+	return err == nil && info.Size() < tf.offset
+}
+
+func (fs *FileSource) rename(tf *tailFile, path string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	tf.path = path
+	tf.tracker.path = path
+}
+
+func (fs *FileSource) resetPosition(id string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.trackers, id)
+	delete(fs.positions, id)
+}
+
+func (fs *FileSource) loadPositions() map[string]filePosition {
+	positions := make(map[string]filePosition)
+	if len(fs.positionFile) == 0 {
+		return positions
+	}
+	data, err := ioutil.ReadFile(fs.positionFile)
+	if os.IsNotExist(err) {
+		return positions
+	} else if err != nil {
+		fs.log.Panic("read position file failed", fs.tag(), zap.String("file", fs.positionFile), zap.Error(err))
+	}
+	if err := jsonApi.Unmarshal(data, &positions); err != nil {
+		fs.log.Panic("parse position file failed", fs.tag(), zap.String("file", fs.positionFile), zap.Error(err))
+	}
+	return positions
+}
+
+// savePositions writes positions to a temp file first, so a crash never leaves a broken position file.
+func (fs *FileSource) savePositions() {
+	if len(fs.positionFile) == 0 {
+		return
+	}
+	fs.mu.Lock()
+	for id, tracker := range fs.trackers {
+		pos := tracker.position()
+		pos.Path = tracker.path
+		fs.positions[id] = pos
+	}
+	// drop positions of files no longer matching the pattern, a reused inode must not resume an old position
+	if fs.seen != nil {
+		for id := range fs.positions {
+			if _, ok := fs.trackers[id]; !ok && !fs.seen[id] {
+				delete(fs.positions, id)
+			}
+		}
+	}
+	data, err := jsonApi.Marshal(fs.positions)
+	fs.mu.Unlock()
+	if err != nil {
+		fs.log.Error("encode positions failed", fs.tag(), zap.Error(err))
+		return
+	}
+	tmp := fs.positionFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		fs.log.Error("write position file failed", fs.tag(), zap.String("file", tmp), zap.Error(err))
+	} else if err := os.Rename(tmp, fs.positionFile); err != nil {
+		fs.log.Error("rename position file failed", fs.tag(), zap.String("file", fs.positionFile), zap.Error(err))
+	}
+}
+
+func (fs *FileSource) tag() zap.Field {
+	return zap.String("tag", "FileSource")
+}
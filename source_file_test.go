@@ -0,0 +1,94 @@
+package job
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestFileSource(t *testing.T, pattern string) (*FileSource, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fs := &FileSource{}
+	fs.init(&SourceConf{Type: "file", Metadata: KeyValueConf{
+		"path":         pattern,
+		"tail":         true,
+		"interval":     1,
+		"positionFile": filepath.Join(filepath.Dir(pattern), "positions.json"),
+	}}, ctx, zap.NewNop())
+	t.Cleanup(func() {
+		cancel()
+		for range fs.Read() {
+		}
+	})
+	return fs, cancel
+}
+
+// readFileLines collects the lines sent during d.
+func readFileLines(fs *FileSource, d time.Duration) []string {
+	var lines []string
+	timeout := time.After(d)
+	for {
+		select {
+		case dt := <-fs.Read():
+			lines = append(lines, string(dt.Payload.([]byte)))
+			dt.Done()
+		case <-timeout:
+			return lines
+		}
+	}
+}
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSourceTailGzipOnce(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "app.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	for i := 0; i < 100; i++ {
+		_, _ = gz.Write([]byte("the same line compresses well\n"))
+	}
+	_ = gz.Close()
+	_ = f.Close()
+	fs, _ := newTestFileSource(t, filepath.Join(dir, "*.gz"))
+	// the compressed size is less than the offset, the file must not be treated as truncated on the next ticks
+	if lines := readFileLines(fs, 2500*time.Millisecond); len(lines) != 100 {
+		t.Fatalf("read %d lines, want 100", len(lines))
+	}
+}
+
+func TestFileSourceRenameKeepsPosition(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "a\nb\n")
+	fs, _ := newTestFileSource(t, path+"*")
+	if lines := readFileLines(fs, 500*time.Millisecond); len(lines) != 2 {
+		t.Fatalf("read %v, want a and b", lines)
+	}
+	// rotated by rename, the renamed file still matches the pattern
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "c\n")
+	appendFile(t, path, "d\n")
+	lines := readFileLines(fs, 1500*time.Millisecond)
+	if len(lines) != 2 || lines[0] != "d" && lines[1] != "d" || lines[0] != "c" && lines[1] != "c" {
+		t.Fatalf("read %v after rotation, want c and d only", lines)
+	}
+}
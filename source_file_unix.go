@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package job
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileID identifies a file by device and inode, so a renamed file keeps its position.
+func fileID(path string, info os.FileInfo) string {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return strconv.FormatUint(uint64(st.Dev), 10) + ":" + strconv.FormatUint(uint64(st.Ino), 10)
+	}
+	return path
+}
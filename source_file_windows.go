@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package job
+
+import "os"
+
+// fileID identifies a file by path, file index is not available from os.FileInfo on windows.
+func fileID(path string, info os.FileInfo) string {
+	return path
+}
@@ -0,0 +1,169 @@
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"math"
+	mrand "math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterSource("generator", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &GeneratorSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// generatorField matches the placeholders of template strings:
+// {seq}, {now}, {timestamp}, {uuid}, {int:min:max}, {float:min:max} and {pick:a|b|c}
+var generatorField = regexp.MustCompile(`\{(seq|now|timestamp|uuid|int:-?\d+:-?\d+|float:-?[\d.]+:-?[\d.]+|pick:[^{}]*)\}`)
+
+// GeneratorSource emits synthetic payloads from a template at rate messages per second, the task finishes
+// after count messages. a template string which is a single placeholder keeps the typed value.
+type GeneratorSource struct {
+	conf     *SourceConf
+	log      *zap.Logger
+	ctx      context.Context
+	mc       chan *TaskData
+	template interface{}
+	meta     KeyValueConf
+	rate     int
+	count    int64
+	random   *mrand.Rand
+}
+
+func (gs *GeneratorSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	gs.conf = conf
+	gs.log = log
+	gs.ctx = ctx
+	gs.template = plainValue(conf.Metadata["template"])
+	if gs.template == nil {
+		gs.template = map[string]interface{}{"seq": "{seq}", "timestamp": "{timestamp}"}
+	}
+	gs.meta = conf.Metadata.GetKeyValueConf("meta")
+	gs.rate = conf.Metadata.GetInt("rate")
+	gs.count = conf.Metadata.GetInt64("count")
+	seed := conf.Metadata.GetInt64("seed")
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	gs.random = mrand.New(mrand.NewSource(seed))
+	gs.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	go gs.run()
+}
+
+func (gs *GeneratorSource) Read() <-chan *TaskData {
+	return gs.mc
+}
+
+func (gs *GeneratorSource) run() {
+	defer close(gs.mc)
+	var tick <-chan time.Time
+	if gs.rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(gs.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	start := time.Now()
+	var seq int64
+	for gs.count <= 0 || seq < gs.count {
+		if tick != nil {
+			select {
+			case <-gs.ctx.Done():
+				return
+			case <-tick:
+			}
+		}
+		seq++
+		meta := KeyValueConf{"seq": seq}
+		for k, v := range gs.meta {
+			meta[k] = v
+		}
+		select {
+		case gs.mc <- &TaskData{Payload: gs.render(gs.template, seq), Metadata: meta}:
+		case <-gs.ctx.Done():
+			return
+		}
+	}
+	gs.log.Info("generator finished", gs.tag(), zap.Int64("count", seq), zap.Duration("cost", time.Since(start)))
+}
+
+// render copies the template and fills the placeholders of every string.
+func (gs *GeneratorSource) render(v interface{}, seq int64) interface{} {
+	switch v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v.(map[string]interface{})))
+		for k, mv := range v.(map[string]interface{}) {
+			m[k] = gs.render(mv, seq)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v.([]interface{})))
+		for i, sv := range v.([]interface{}) {
+			s[i] = gs.render(sv, seq)
+		}
+		return s
+	case string:
+		str := v.(string)
+		if loc := generatorField.FindStringIndex(str); loc != nil && loc[0] == 0 && loc[1] == len(str) {
+			return gs.value(str[1:len(str)-1], seq)
+		}
+		return generatorField.ReplaceAllStringFunc(str, func(s string) string {
+			return fmt.Sprint(gs.value(s[1:len(s)-1], seq))
+		})
+	default:
+		return v
+	}
+}
+
+func (gs *GeneratorSource) value(field string, seq int64) interface{} {
+	parts := strings.SplitN(field, ":", 3)
+	switch parts[0] {
+	case "seq":
+		return seq
+	case "now":
+		return time.Now().Format(time.RFC3339Nano)
+	case "timestamp":
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	case "uuid":
+		return generatorUUID()
+	case "int":
+		min, _ := strconv.ParseInt(parts[1], 10, 64)
+		max, _ := strconv.ParseInt(parts[2], 10, 64)
+		if max <= min {
+			return min
+		}
+		return min + gs.random.Int63n(max-min+1)
+	case "float":
+		min, _ := strconv.ParseFloat(parts[1], 64)
+		max, _ := strconv.ParseFloat(parts[2], 64)
+		return math.Round((min+gs.random.Float64()*(max-min))*1000) / 1000
+	case "pick":
+		options := strings.Split(strings.TrimPrefix(field, "pick:"), "|")
+		return options[gs.random.Intn(len(options))]
+	}
+	return field
+}
+
+func (gs *GeneratorSource) tag() zap.Field {
+	return zap.String("tag", "GeneratorSource")
+}
+
+// generatorUUID returns a random version 4 uuid.
+func generatorUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
@@ -0,0 +1,72 @@
+package job
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestGeneratorSource(t *testing.T) {
+	gs := &GeneratorSource{}
+	gs.init(&SourceConf{Type: "generator", Metadata: KeyValueConf{
+		"count": 3,
+		"seed":  1,
+		"template": map[interface{}]interface{}{
+			"seq":   "{seq}",
+			"id":    "user-{seq}",
+			"level": "{pick:info}",
+			"score": "{int:5:5}",
+			"ratio": "{float:1:1}",
+			"uuid":  "{uuid}",
+			"tags":  []interface{}{"{seq}", 7},
+		},
+		"meta": map[interface{}]interface{}{"topic": "load"},
+	}}, context.Background(), zap.NewNop())
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	var seq int64
+	for dt := range gs.Read() {
+		seq++
+		item := dt.Payload.(map[string]interface{})
+		if item["seq"] != seq || item["id"] != "user-"+strconv.FormatInt(seq, 10) || item["level"] != "info" || item["score"] != int64(5) || item["ratio"] != 1.0 {
+			t.Fatalf("item %v", item)
+		}
+		if !uuid.MatchString(item["uuid"].(string)) {
+			t.Fatalf("uuid %v", item["uuid"])
+		}
+		if tags := item["tags"].([]interface{}); tags[0] != seq || tags[1] != 7 {
+			t.Fatalf("tags %v", tags)
+		}
+		if dt.Metadata["seq"] != seq || dt.Metadata["topic"] != "load" {
+			t.Fatalf("meta %v", dt.Metadata)
+		}
+	}
+	if seq != 3 {
+		t.Fatalf("%d messages, want count 3", seq)
+	}
+}
+
+func TestGeneratorSourceStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gs := &GeneratorSource{}
+	gs.init(&SourceConf{Type: "generator", Metadata: KeyValueConf{"rate": 100}}, ctx, zap.NewNop())
+	dt := <-gs.Read()
+	if item := dt.Payload.(map[string]interface{}); item["seq"] != int64(1) || item["timestamp"] == nil {
+		t.Fatalf("default template item %v", item)
+	}
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-gs.Read():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("generator not closed after the task stopped")
+		}
+	}
+}
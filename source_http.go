@@ -0,0 +1,303 @@
+package job
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterSource("http", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &HttpSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	HttpAckAccepted = "accepted"
+	HttpAckSink     = "sink"
+)
+
+// HttpSource receives single json, json array or ndjson payloads pushed over http.
+type HttpSource struct {
+	conf        *SourceConf
+	log         *zap.Logger
+	ctx         context.Context
+	mc          chan *TaskData
+	codec       Codec
+	server      *http.Server
+	auth        string
+	username    string
+	password    string
+	token       string
+	maxBodySize int64
+	ack         string
+	ackTimeout  time.Duration
+	split       bool
+	closeMu     sync.RWMutex
+	closed      bool
+}
+
+func (hs *HttpSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	hs.conf = conf
+	hs.log = log
+	hs.ctx = ctx
+	hs.auth = conf.Metadata.GetString("auth")
+	hs.username = conf.Metadata.GetString("username")
+	hs.password = conf.Metadata.GetString("password")
+	hs.token = conf.Metadata.GetString("token")
+	switch hs.auth {
+	case "":
+	case "basic":
+		if len(hs.username) == 0 {
+			log.Panic("missing username config of basic auth for HttpSource", hs.tag())
+		}
+	case "bearer":
+		if len(hs.token) == 0 {
+			log.Panic("missing token config of bearer auth for HttpSource", hs.tag())
+		}
+	default:
+		log.Panic("unsupported auth for HttpSource", hs.tag(), zap.String("auth", hs.auth))
+	}
+	hs.maxBodySize = conf.Metadata.GetInt64("maxBodySize")
+	if hs.maxBodySize <= 0 {
+		hs.maxBodySize = 1 << 20
+	}
+	hs.ack = conf.Metadata.GetStringOrDefault("ack", HttpAckAccepted)
+	if hs.ack != HttpAckAccepted && hs.ack != HttpAckSink {
+		log.Panic("unsupported ack for HttpSource", hs.tag(), zap.String("ack", hs.ack))
+	}
+	hs.ackTimeout = time.Duration(util.MaxInt(conf.Metadata.GetInt("ackTimeout"), 1)) * time.Second
+	hs.split = conf.Metadata.GetBool("split")
+	hs.codec = newSourceCodec(conf, ctx, log)
+	hs.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	//
+	paths := conf.Metadata.GetStringSlice("paths")
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	mux := http.NewServeMux()
+	for _, path := range paths {
+		mux.HandleFunc(path, hs.handle)
+	}
+	hs.server = &http.Server{
+		Addr:         conf.Metadata.GetStringOrDefault(ConfAddress, ":8080"),
+		Handler:      mux,
+		ReadTimeout:  time.Duration(util.MaxInt(conf.Metadata.GetInt("readTimeout"), 10)) * time.Second,
+		WriteTimeout: hs.ackTimeout + 10*time.Second,
+	}
+	go func() {
+		log.Info("http source started", hs.tag(), zap.String("address", hs.server.Addr), zap.Strings("paths", paths))
+		if err := hs.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Panic("http source stopped unexpectedly", hs.tag(), zap.Error(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		// active requests are finished before no more messages
+		sc, cancel := context.WithTimeout(context.Background(), hs.ackTimeout+time.Second)
+		defer cancel()
+		if err := hs.server.Shutdown(sc); err != nil {
+			log.Error("shutdown http source failed", hs.tag(), zap.Error(err))
+		}
+		hs.closeMu.Lock()
+		hs.closed = true
+		close(hs.mc)
+		hs.closeMu.Unlock()
+	}()
+}
+
+func (hs *HttpSource) Read() <-chan *TaskData {
+	return hs.mc
+}
+
+func (hs *HttpSource) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		hs.reply(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !hs.authorized(r) {
+		if hs.auth == "basic" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chain-job"`)
+		}
+		hs.reply(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, hs.maxBodySize+1))
+	if err != nil {
+		hs.log.Error("read http body failed", hs.tag(), zap.String("path", r.URL.Path), zap.Error(err))
+		hs.reply(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if int64(len(body)) > hs.maxBodySize {
+		hs.reply(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	payloads, err := hs.decode(body)
+	if err != nil {
+		hs.log.Error("decode http payload failed", hs.tag(), zap.String("path", r.URL.Path), zap.Error(err))
+		hs.reply(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	wg := &sync.WaitGroup{}
+	var failed int32
+	if status := hs.send(r, payloads, wg, &failed); status != http.StatusAccepted {
+		hs.reply(w, status, http.StatusText(status))
+		return
+	}
+	if hs.ack == HttpAckSink {
+		finished := make(chan bool)
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(hs.ackTimeout):
+			hs.reply(w, http.StatusGatewayTimeout, "sink timeout")
+			return
+		}
+		if atomic.LoadInt32(&failed) == 1 {
+			// the client retries the request, the items already persisted are sent again
+			hs.reply(w, http.StatusInternalServerError, "sink failed")
+			return
+		}
+	}
+	hs.reply(w, http.StatusAccepted, strconv.Itoa(len(payloads))+" accepted")
+}
+
+// send passes all payloads of the request or none of them. once the first payload is accepted the rest are sent
+// regardless of the request or source being cancelled, so a retried request never duplicates a part of it.
+// the task reads until the channel is closed, which waits the read lock held here.
+func (hs *HttpSource) send(r *http.Request, payloads []interface{}, wg *sync.WaitGroup, failed *int32) int {
+	hs.closeMu.RLock()
+	defer hs.closeMu.RUnlock()
+	if hs.closed {
+		return http.StatusServiceUnavailable
+	}
+	for i, payload := range payloads {
+		dt := &TaskData{Payload: payload, Metadata: hs.metadata(r)}
+		if hs.ack == HttpAckSink {
+			wg.Add(1)
+			dt.done = wg.Done
+			dt.fail = func() {
+				atomic.StoreInt32(failed, 1)
+				wg.Done()
+			}
+		}
+		if i > 0 {
+			hs.mc <- dt
+			continue
+		}
+		select {
+		case hs.mc <- dt:
+		case <-hs.ctx.Done():
+			return http.StatusServiceUnavailable
+		case <-r.Context().Done():
+			return http.StatusRequestTimeout
+		}
+	}
+	return http.StatusAccepted
+}
+
+func (hs *HttpSource) authorized(r *http.Request) bool {
+	switch hs.auth {
+	case "basic":
+		u, p, ok := r.BasicAuth()
+		return ok && subtle.ConstantTimeCompare([]byte(u), []byte(hs.username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(p), []byte(hs.password)) == 1
+	case "bearer":
+		h := r.Header.Get("Authorization")
+		return strings.HasPrefix(h, "Bearer ") && subtle.ConstantTimeCompare([]byte(h[7:]), []byte(hs.token)) == 1
+	default:
+		return true
+	}
+}
+
+// decode returns the payloads of the request. a json array or ndjson body is one []map payload,
+// or a payload per item if split is set.
+func (hs *HttpSource) decode(body []byte) ([]interface{}, error) {
+	if hs.codec != nil {
+		p, err := hs.codec.Decode(body)
+		if err != nil {
+			return nil, err
+		}
+		return hs.splitPayload(p), nil
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty body")
+	}
+	if body[0] == '[' {
+		items := make([]map[string]interface{}, 0)
+		if err := jsonApi.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+		return hs.splitPayload(items), nil
+	}
+	items := make([]map[string]interface{}, 0)
+	decoder := jsonApi.NewDecoder(bytes.NewReader(body))
+	for {
+		item := make(map[string]interface{})
+		if err := decoder.Decode(&item); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(items) == 1 {
+		return []interface{}{items[0]}, nil
+	}
+	return hs.splitPayload(items), nil
+}
+
+func (hs *HttpSource) splitPayload(p interface{}) []interface{} {
+	if items, ok := p.([]map[string]interface{}); ok && hs.split {
+		r := make([]interface{}, len(items))
+		for i, item := range items {
+			r[i] = item
+		}
+		return r
+	}
+	return []interface{}{p}
+}
+
+// metadata keeps the request headers with lower case names, then path, method and remote address
+// which are never overridden by headers of the same names.
+func (hs *HttpSource) metadata(r *http.Request) KeyValueConf {
+	meta := KeyValueConf{}
+	for k, v := range r.Header {
+		if k == "Authorization" {
+			continue
+		}
+		meta[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	meta["path"] = r.URL.Path
+	meta["method"] = r.Method
+	meta["remote"] = r.RemoteAddr
+	return meta
+}
+
+func (hs *HttpSource) reply(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	body, _ := jsonApi.MarshalToString(map[string]interface{}{"status": status, "message": message})
+	_, _ = w.Write([]byte(body))
+}
+
+func (hs *HttpSource) tag() zap.Field {
+	return zap.String("tag", "HttpSource")
+}
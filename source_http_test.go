@@ -0,0 +1,97 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestHttpSource(buffer int) *HttpSource {
+	return &HttpSource{
+		log:         zap.NewNop(),
+		ctx:         context.Background(),
+		mc:          make(chan *TaskData, buffer),
+		maxBodySize: 16,
+		ack:         HttpAckAccepted,
+		split:       true,
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestHttpSourceBodyErrors(t *testing.T) {
+	hs := newTestHttpSource(1)
+	w := httptest.NewRecorder()
+	hs.handle(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"too large"}`)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	hs.handle(w, httptest.NewRequest(http.MethodPost, "/", errReader{}))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("broken body status %d, want 400", w.Code)
+	}
+}
+
+func TestHttpSourceMetadataReservedKeys(t *testing.T) {
+	hs := newTestHttpSource(1)
+	r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"a":1}`))
+	r.Header.Set("Path", "/other")
+	r.Header.Set("Method", "GET")
+	r.Header.Set("X-Trace", "t1")
+	w := httptest.NewRecorder()
+	hs.handle(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d", w.Code)
+	}
+	meta := (<-hs.mc).Metadata
+	if meta["path"] != "/events" || meta["method"] != http.MethodPost || meta["x-trace"] != "t1" {
+		t.Fatalf("metadata %v", meta)
+	}
+}
+
+func TestHttpSourceSendAllAfterFirstAccepted(t *testing.T) {
+	hs := newTestHttpSource(0)
+	hs.maxBodySize = 1 << 10
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[{"a":1},{"a":2},{"a":3}]`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handled := make(chan bool)
+	go func() {
+		hs.handle(w, r)
+		close(handled)
+	}()
+	<-hs.mc
+	// the client goes away after the first item is accepted
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	<-hs.mc
+	<-hs.mc
+	<-handled
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want 202 as every item is accepted", w.Code)
+	}
+}
+
+func TestHttpSourceSinkFailed(t *testing.T) {
+	hs := newTestHttpSource(1)
+	hs.ack, hs.ackTimeout = HttpAckSink, time.Second
+	go func() {
+		(<-hs.mc).Fail()
+	}()
+	w := httptest.NewRecorder()
+	hs.handle(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":1}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500 so the client retries", w.Code)
+	}
+}
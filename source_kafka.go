@@ -3,10 +3,15 @@ package job
 import (
 	"context"
 	"github.com/Shopify/sarama"
+	"github.com/ywengineer/g-util/util"
 	"go.uber.org/zap"
 	logf "log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func init() {
@@ -17,10 +22,27 @@ func init() {
 	})
 }
 
+const (
+	RebalanceAssigned = "assigned"
+	RebalanceRevoked  = "revoked"
+)
+
+// RebalanceEvent describes the partitions assigned to or revoked from this group member.
+type RebalanceEvent struct {
+	Type         string
+	MemberID     string
+	GenerationID int32
+	Claims       map[string][]int32
+	Time         time.Time
+}
+
 func newKafkaConsumer(ctx context.Context, log *zap.Logger,
 	brokers, topics, group string,
 	verbose, oldest bool,
-	version string) *kConsumer {
+	version string,
+	buffer int,
+	drainTimeout time.Duration,
+	codec Codec) *kConsumer {
 	if len(brokers) == 0 || len(topics) == 0 {
 		log.Panic("missing kafka brokers or topics, consumer will not be disabled.")
 		return nil
@@ -49,8 +71,10 @@ func newKafkaConsumer(ctx context.Context, log *zap.Logger,
 	 * Setup a new Sarama consumer group
 	 */
 	consumer := &kConsumer{
-		ready: make(chan bool),
-		log:   log,
+		log:          log,
+		drainTimeout: drainTimeout,
+		codec:        codec,
+		claims:       make(map[string]*kClaim),
 	}
 
 	//ctx, cancel := context.WithCancel(context.Background())
@@ -61,7 +85,8 @@ func newKafkaConsumer(ctx context.Context, log *zap.Logger,
 	//
 	topicArray := strings.Split(topics, ",")
 	//
-	consumer.mc = make(chan *TaskData)
+	consumer.client = client
+	consumer.mc = make(chan *TaskData, util.MaxInt(buffer, 0))
 	//
 	go func() {
 		defer func() {
@@ -79,28 +104,153 @@ func newKafkaConsumer(ctx context.Context, log *zap.Logger,
 			if ctx.Err() != nil {
 				return
 			}
-			consumer.ready = make(chan bool)
 		}
 	}()
 	return consumer
 }
 
+// kClaim tracks the in-flight messages of a claimed partition.
+type kClaim struct {
+	topic     string
+	partition int32
+	session   sarama.ConsumerGroupSession
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	pending   map[int64]struct{}
+	failed    map[int64]struct{}
+	highest   int64
+	wg        sync.WaitGroup
+}
+
+func (claim *kClaim) track(offset int64) {
+	claim.mu.Lock()
+	defer claim.mu.Unlock()
+	claim.pending[offset] = struct{}{}
+	claim.wg.Add(1)
+}
+
+// done releases the offset, and marks the lowest offset which is still in flight, so
+// messages finished out of order never commit past an unfinished one. only a finished
+// message moves the highest offset, an undelivered one is consumed again by the next owner.
+func (claim *kClaim) done(offset int64, mark bool) {
+	claim.mu.Lock()
+	defer claim.mu.Unlock()
+	delete(claim.pending, offset)
+	if mark && offset > claim.highest {
+		claim.highest = offset
+	}
+	if mark && claim.ctx.Err() == nil {
+		next := claim.highest + 1
+		for o := range claim.pending {
+			if o < next {
+				next = o
+			}
+		}
+		for o := range claim.failed {
+			if o < next {
+				next = o
+			}
+		}
+		claim.session.MarkOffset(claim.topic, claim.partition, next, "")
+	}
+	claim.wg.Done()
+}
+
+// fail releases the offset of a failed message without committing it, the committed offset stays at the lowest
+// failed one, so it is consumed again after the next rebalance or restart.
+func (claim *kClaim) fail(offset int64) {
+	claim.mu.Lock()
+	defer claim.mu.Unlock()
+	delete(claim.pending, offset)
+	claim.failed[offset] = struct{}{}
+	claim.wg.Done()
+}
+
+func (claim *kClaim) inflight() int {
+	claim.mu.Lock()
+	defer claim.mu.Unlock()
+	return len(claim.pending)
+}
+
 // Consumer represents a Sarama consumer group consumer
 type kConsumer struct {
-	ready chan bool
-	mc    chan *TaskData
-	log   *zap.Logger
+	mc           chan *TaskData
+	log          *zap.Logger
+	client       sarama.ConsumerGroup
+	paused       int32
+	drainTimeout time.Duration
+	codec        Codec
+	//
+	mu         sync.Mutex
+	claims     map[string]*kClaim
+	assignment RebalanceEvent
+	listeners  []func(event RebalanceEvent)
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *kConsumer) Setup(sarama.ConsumerGroupSession) error {
-	// Mark the consumer as ready
-	close(consumer.ready)
+func (consumer *kConsumer) Setup(session sarama.ConsumerGroupSession) error {
+	consumer.mu.Lock()
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			ctx, cancel := context.WithCancel(context.Background())
+			consumer.claims[claimKey(topic, partition)] = &kClaim{
+				topic:     topic,
+				partition: partition,
+				session:   session,
+				ctx:       ctx,
+				cancel:    cancel,
+				pending:   make(map[int64]struct{}),
+				failed:    make(map[int64]struct{}),
+				highest:   -1,
+			}
+		}
+	}
+	consumer.mu.Unlock()
+	//
+	consumer.rebalance(RebalanceAssigned, session)
 	return nil
 }
 
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *kConsumer) Cleanup(sarama.ConsumerGroupSession) error {
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited.
+// offsets are committed after Cleanup, so it waits for the in-flight messages of the revoked claims.
+func (consumer *kConsumer) Cleanup(session sarama.ConsumerGroupSession) error {
+	consumer.mu.Lock()
+	claims := make([]*kClaim, 0, len(consumer.claims))
+	for key, claim := range consumer.claims {
+		if claim.session == session {
+			claims = append(claims, claim)
+			delete(consumer.claims, key)
+		}
+	}
+	consumer.mu.Unlock()
+	//
+	drained := make(chan bool)
+	go func() {
+		for _, claim := range claims {
+			claim.wg.Wait()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(consumer.drainTimeout):
+		for _, claim := range claims {
+			if n := claim.inflight(); n > 0 {
+				consumer.log.Warn("drain in-flight messages timeout, remaining messages are cancelled",
+					consumer.tag(),
+					zap.String("topic", claim.topic),
+					zap.Int32("partition", claim.partition),
+					zap.Int("inflight", n))
+			}
+		}
+	}
+	// messages still buffered for the revoked claims are dropped by the task
+	for _, claim := range claims {
+		claim.cancel()
+	}
+	//
+	consumer.rebalance(RebalanceRevoked, session)
 	return nil
 }
 
@@ -112,6 +262,14 @@ func (consumer *kConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, cla
 	// The `ConsumeClaim` itself is called within a goroutine, see:
 	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
 	// KAFKA_TOPIC_CURRENCY,KAFKA_TOPIC_ORDER,KAFKA_TOPIC_PLAYER_CREATE,KAFKA_TOPIC_PLAYER_SIGN,KAFKA_TOPIC_PLAYER_UPGRADE
+	// partition consumers created by a rebalance are not covered by a previous PauseAll
+	if consumer.isPaused() {
+		consumer.client.Pause(map[string][]int32{claim.Topic(): {claim.Partition()}})
+	}
+	consumer.mu.Lock()
+	kc := consumer.claims[claimKey(claim.Topic(), claim.Partition())]
+	consumer.mu.Unlock()
+	//
 	for message := range claim.Messages() {
 		//BlockTimestamp time.Time       // only set if kafka is version 0.10+, outer (compressed) block timestamp
 		dt := &TaskData{Payload: message.Value}
@@ -122,20 +280,103 @@ func (consumer *kConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, cla
 			"offset":    message.Offset,
 			"key":       string(message.Key),
 		}
+		decodePayload(consumer.codec, dt, consumer.log)
+		offset := message.Offset
+		kc.track(offset)
+		dt.ctx = kc.ctx
+		dt.done = func() {
+			kc.done(offset, true)
+		}
+		dt.fail = func() {
+			kc.fail(offset)
+		}
 		//
-		consumer.mc <- dt
-		//
-		consumer.afterConsume(session, message)
+		select {
+		case consumer.mc <- dt:
+			consumer.afterConsume(session, message)
+		case <-session.Context().Done():
+			// rebalance started, the message will be delivered again to the new owner
+			kc.done(offset, false)
+			return nil
+		}
 	}
 	return nil
 }
 
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
 func (consumer *kConsumer) afterConsume(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) {
-	session.MarkMessage(message, "")
 	consumer.log.Debug("consumed kafka message", zap.String("tag", "KafkaMessage"), zap.String("data", string(message.Value)))
 }
 
+func (consumer *kConsumer) rebalance(typ string, session sarama.ConsumerGroupSession) {
+	event := RebalanceEvent{
+		Type:         typ,
+		MemberID:     session.MemberID(),
+		GenerationID: session.GenerationID(),
+		Claims:       session.Claims(),
+		Time:         time.Now(),
+	}
+	consumer.log.Info("kafka consumer group rebalanced",
+		consumer.tag(),
+		zap.String("type", typ),
+		zap.String("member", event.MemberID),
+		zap.Int32("generation", event.GenerationID),
+		zap.Any("claims", event.Claims))
+	//
+	consumer.mu.Lock()
+	if typ == RebalanceAssigned {
+		consumer.assignment = event
+	} else {
+		consumer.assignment = RebalanceEvent{Type: typ, MemberID: event.MemberID, GenerationID: event.GenerationID, Time: event.Time}
+	}
+	listeners := consumer.listeners
+	consumer.mu.Unlock()
+	//
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+func (consumer *kConsumer) onRebalance(listener func(event RebalanceEvent)) {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	consumer.listeners = append(consumer.listeners, listener)
+}
+
+func (consumer *kConsumer) currentAssignment() RebalanceEvent {
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	return consumer.assignment
+}
+
+func (consumer *kConsumer) pause() {
+	if atomic.CompareAndSwapInt32(&consumer.paused, 0, 1) {
+		consumer.client.PauseAll()
+		consumer.log.Info("kafka consumer paused", zap.String("tag", "KafkaMessage"), zap.Int("buffered", len(consumer.mc)))
+	}
+}
+
+func (consumer *kConsumer) resume() {
+	if atomic.CompareAndSwapInt32(&consumer.paused, 1, 0) {
+		consumer.client.ResumeAll()
+		consumer.log.Info("kafka consumer resumed", zap.String("tag", "KafkaMessage"), zap.Int("buffered", len(consumer.mc)))
+	}
+}
+
+func (consumer *kConsumer) isPaused() bool {
+	return atomic.LoadInt32(&consumer.paused) == 1
+}
+
+func (consumer *kConsumer) tag() zap.Field {
+	return zap.String("tag", "KafkaMessage")
+}
+
+func claimKey(topic string, partition int32) string {
+	return topic + "/" + strconv.Itoa(int(partition))
+}
+
+// KafkaSource consumes topics of a consumer group. an offset is committed once its message is done by all sinks,
+// on a rebalance the in-flight messages are drained for drainTimeout seconds, 10 by default. it should be longer than
+// the flush interval of sinks holding messages, e.g. SinkS3, or the held messages are consumed again by the next owner.
 type KafkaSource struct {
 	consumer *kConsumer
 	conf     *SourceConf
@@ -145,6 +386,10 @@ type KafkaSource struct {
 func (kafka *KafkaSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
 	kafka.log = log
 	kafka.conf = conf
+	drainTimeout := conf.Metadata.GetInt("drainTimeout")
+	if drainTimeout <= 0 {
+		drainTimeout = 10
+	}
 	kafka.consumer = newKafkaConsumer(ctx, log,
 		conf.Metadata.GetString("brokers"),
 		conf.Metadata.GetString("topics"),
@@ -152,9 +397,41 @@ func (kafka *KafkaSource) init(conf *SourceConf, ctx context.Context, log *zap.L
 		conf.Metadata.GetBool("verbose"),
 		conf.Metadata.GetBool("oldest"),
 		conf.Metadata.GetString("version"),
+		conf.Metadata.GetInt("buffer"),
+		time.Duration(drainTimeout)*time.Second,
+		newSourceCodec(conf, ctx, log),
 	)
 }
 
 func (kafka *KafkaSource) Read() <-chan *TaskData {
 	return kafka.consumer.mc
 }
+
+// Pause stops fetching from all assigned partitions, the consumer keeps its group membership.
+func (kafka *KafkaSource) Pause() {
+	kafka.consumer.pause()
+}
+
+// Resume restarts fetching from all assigned partitions.
+func (kafka *KafkaSource) Resume() {
+	kafka.consumer.resume()
+}
+
+func (kafka *KafkaSource) Paused() bool {
+	return kafka.consumer.isPaused()
+}
+
+// Buffered returns the number of prefetched messages waiting to be read.
+func (kafka *KafkaSource) Buffered() int {
+	return len(kafka.consumer.mc)
+}
+
+// Assignment returns the partitions currently claimed by this group member.
+func (kafka *KafkaSource) Assignment() RebalanceEvent {
+	return kafka.consumer.currentAssignment()
+}
+
+// OnRebalance registers a listener which is invoked when partitions are assigned or revoked.
+func (kafka *KafkaSource) OnRebalance(listener func(event RebalanceEvent)) {
+	kafka.consumer.onRebalance(listener)
+}
@@ -0,0 +1,306 @@
+package job
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+)
+
+type markSession struct {
+	sarama.ConsumerGroupSession
+	marked []int64
+}
+
+func (s *markSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.marked = append(s.marked, offset)
+}
+
+func newTestClaim() (*kClaim, *markSession) {
+	session := &markSession{}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kClaim{topic: "t", partition: 0, session: session, ctx: ctx, cancel: cancel, pending: make(map[int64]struct{}), failed: make(map[int64]struct{}), highest: -1}, session
+}
+
+func lastMarked(t *testing.T, s *markSession) int64 {
+	t.Helper()
+	if len(s.marked) == 0 {
+		t.Fatal("no offset marked")
+	}
+	return s.marked[len(s.marked)-1]
+}
+
+func TestKClaimOutOfOrderDone(t *testing.T) {
+	claim, session := newTestClaim()
+	for o := int64(10); o <= 12; o++ {
+		claim.track(o)
+	}
+	claim.done(12, true)
+	if got := lastMarked(t, session); got != 10 {
+		t.Fatalf("marked %d, want 10 while 10 and 11 are in flight", got)
+	}
+	claim.done(10, true)
+	if got := lastMarked(t, session); got != 11 {
+		t.Fatalf("marked %d, want 11 while 11 is in flight", got)
+	}
+	claim.done(11, true)
+	if got := lastMarked(t, session); got != 13 {
+		t.Fatalf("marked %d, want 13 once all are done", got)
+	}
+	if n := claim.inflight(); n != 0 {
+		t.Fatalf("inflight %d, want 0", n)
+	}
+}
+
+func TestKClaimUndeliveredNotCommitted(t *testing.T) {
+	claim, session := newTestClaim()
+	claim.track(5)
+	claim.track(6)
+	// the session ends before 6 is delivered to the task
+	claim.done(6, false)
+	claim.done(5, true)
+	if got := lastMarked(t, session); got != 6 {
+		t.Fatalf("marked %d, want 6 so the undelivered message is consumed again", got)
+	}
+}
+
+func TestKClaimCancelledNotMarked(t *testing.T) {
+	claim, session := newTestClaim()
+	claim.track(1)
+	claim.cancel()
+	claim.done(1, true)
+	if len(session.marked) != 0 {
+		t.Fatalf("marked %v after the claim was revoked", session.marked)
+	}
+}
+
+func TestKClaimFailedNotCommitted(t *testing.T) {
+	claim, session := newTestClaim()
+	for o := int64(20); o <= 22; o++ {
+		claim.track(o)
+	}
+	claim.done(20, true)
+	claim.fail(21)
+	claim.done(22, true)
+	if got := lastMarked(t, session); got != 21 {
+		t.Fatalf("marked %d, want 21 so the failed message is consumed again", got)
+	}
+	if n := claim.inflight(); n != 0 {
+		t.Fatalf("inflight %d, want 0 so the drain is not blocked", n)
+	}
+}
+
+// pauseGroup records the pause calls of a consumer group.
+type pauseGroup struct {
+	sarama.ConsumerGroup
+	mu     sync.Mutex
+	calls  []string
+	paused map[string][]int32
+}
+
+func (g *pauseGroup) record(call string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls = append(g.calls, call)
+}
+
+func (g *pauseGroup) Pause(partitions map[string][]int32) {
+	g.mu.Lock()
+	g.paused = partitions
+	g.mu.Unlock()
+	g.record("Pause")
+}
+func (g *pauseGroup) PauseAll()  { g.record("PauseAll") }
+func (g *pauseGroup) ResumeAll() { g.record("ResumeAll") }
+
+func (g *pauseGroup) recorded() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.calls...)
+}
+
+// testSession is a consumer group session claiming fixed partitions.
+type testSession struct {
+	markSession
+	ctx    context.Context
+	claims map[string][]int32
+	mu     sync.Mutex
+}
+
+func (s *testSession) Claims() map[string][]int32 { return s.claims }
+func (s *testSession) MemberID() string           { return "m1" }
+func (s *testSession) GenerationID() int32        { return 1 }
+func (s *testSession) Context() context.Context   { return s.ctx }
+func (s *testSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, offset)
+}
+
+func (s *testSession) lastMarked() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.marked) == 0 {
+		return -1
+	}
+	return s.marked[len(s.marked)-1]
+}
+
+type testClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *testClaim) Topic() string                            { return "t" }
+func (c *testClaim) Partition() int32                         { return 0 }
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// newTestConsumer makes a consumer of the pauseGroup with the buffer of mc and drain timeout.
+func newTestConsumer(buffer int, drainTimeout time.Duration) (*kConsumer, *pauseGroup) {
+	group := &pauseGroup{}
+	return &kConsumer{
+		log:          zap.NewNop(),
+		client:       group,
+		mc:           make(chan *TaskData, buffer),
+		drainTimeout: drainTimeout,
+		claims:       make(map[string]*kClaim),
+	}, group
+}
+
+// consumeTestClaim sets up a session claiming partition t/0, and consumes the messages of the claim until finished.
+func consumeTestClaim(t *testing.T, consumer *kConsumer, offsets ...int64) (*testSession, context.CancelFunc, chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &testSession{ctx: ctx, claims: map[string][]int32{"t": {0}}}
+	if err := consumer.Setup(session); err != nil {
+		t.Fatal(err)
+	}
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage, len(offsets))}
+	for _, o := range offsets {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "t", Partition: 0, Offset: o, Value: []byte("v")}
+	}
+	close(claim.messages)
+	finished := make(chan bool)
+	go func() {
+		_ = consumer.ConsumeClaim(session, claim)
+		close(finished)
+	}()
+	return session, cancel, finished
+}
+
+func TestKConsumerPauseResume(t *testing.T) {
+	consumer, group := newTestConsumer(0, time.Second)
+	source := &KafkaSource{consumer: consumer}
+	source.Pause()
+	source.Pause()
+	if !source.Paused() {
+		t.Fatal("not paused")
+	}
+	source.Resume()
+	source.Resume()
+	if source.Paused() {
+		t.Fatal("not resumed")
+	}
+	if calls := group.recorded(); !reflect.DeepEqual(calls, []string{"PauseAll", "ResumeAll"}) {
+		t.Fatalf("calls %v, want one PauseAll and one ResumeAll", calls)
+	}
+}
+
+func TestKConsumerPauseAssignedWhilePaused(t *testing.T) {
+	consumer, group := newTestConsumer(1, time.Second)
+	consumer.pause()
+	// the partition consumer of a rebalance is not covered by PauseAll
+	_, cancel, finished := consumeTestClaim(t, consumer, 3)
+	defer cancel()
+	<-consumer.mc
+	<-finished
+	group.mu.Lock()
+	paused := group.paused
+	group.mu.Unlock()
+	if !reflect.DeepEqual(paused, map[string][]int32{"t": {0}}) {
+		t.Fatalf("paused %v, want the new claim", paused)
+	}
+	consumer.resume()
+	if calls := group.recorded(); !reflect.DeepEqual(calls, []string{"PauseAll", "Pause", "ResumeAll"}) {
+		t.Fatalf("calls %v", calls)
+	}
+}
+
+func TestKConsumerBuffer(t *testing.T) {
+	consumer, _ := newTestConsumer(2, time.Second)
+	session, cancel, finished := consumeTestClaim(t, consumer, 0, 1, 2)
+	// the buffer takes two messages without a reader, the third waits
+	deadline := time.Now().Add(time.Second)
+	for len(consumer.mc) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(consumer.mc); n != 2 {
+		t.Fatalf("buffered %d, want 2", n)
+	}
+	select {
+	case <-finished:
+		t.Fatal("third message not waiting for the buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// a rebalance gives up the waiting message, it is consumed again by the next owner
+	cancel()
+	<-finished
+	first, second := <-consumer.mc, <-consumer.mc
+	first.Done()
+	second.Done()
+	if got := session.lastMarked(); got != 2 {
+		t.Fatalf("marked %d, want 2 so the undelivered message is consumed again", got)
+	}
+}
+
+func TestKConsumerDrain(t *testing.T) {
+	consumer, _ := newTestConsumer(1, time.Second)
+	session, cancel, finished := consumeTestClaim(t, consumer, 7)
+	defer cancel()
+	dt := <-consumer.mc
+	<-finished
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		dt.Done()
+	}()
+	// the revoke waits the in-flight message, which is committed
+	start := time.Now()
+	if err := consumer.Cleanup(session); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 50*time.Millisecond || cost > 900*time.Millisecond {
+		t.Fatalf("cleanup took %v", cost)
+	}
+	if got := session.lastMarked(); got != 8 {
+		t.Fatalf("marked %d, want 8", got)
+	}
+	if a := consumer.currentAssignment(); a.Type != RebalanceRevoked {
+		t.Fatalf("assignment %v", a)
+	}
+}
+
+func TestKConsumerDrainTimeout(t *testing.T) {
+	consumer, _ := newTestConsumer(1, 50*time.Millisecond)
+	session, cancel, finished := consumeTestClaim(t, consumer, 7)
+	defer cancel()
+	dt := <-consumer.mc
+	<-finished
+	start := time.Now()
+	if err := consumer.Cleanup(session); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 50*time.Millisecond || cost > 900*time.Millisecond {
+		t.Fatalf("cleanup took %v, want the drain timeout", cost)
+	}
+	// the message still in flight is cancelled, and not committed once done
+	if dt.ctx.Err() == nil {
+		t.Fatal("in-flight message not cancelled")
+	}
+	dt.Done()
+	if got := session.lastMarked(); got != -1 {
+		t.Fatalf("marked %d after the claim was revoked", got)
+	}
+}
@@ -0,0 +1,206 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("mqtt", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &MqttSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// MqttSource subscribes topic filters. QoS 1/2 messages are acknowledged once they passed all sinks,
+// with a persistent session (cleanSession: false) unacknowledged messages are delivered again after reconnect.
+// the source is created once connected and subscribed, within connectTimeout seconds. the packet id is kept in
+// messageId metadata, so an id metadata of the payload is not shadowed.
+type MqttSource struct {
+	conf       *SourceConf
+	log        *zap.Logger
+	ctx        context.Context
+	mc         chan *TaskData
+	codec      Codec
+	client     mqtt.Client
+	filters    map[string]byte
+	subscribed chan error
+	inflight   sync.WaitGroup
+	closeMu    sync.RWMutex
+	closed     bool
+}
+
+func (ms *MqttSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	ms.conf = conf
+	ms.log = log
+	ms.ctx = ctx
+	topics := conf.Metadata.GetStringSlice("topics")
+	if topic := conf.Metadata.GetString("topic"); len(topic) > 0 {
+		topics = append(topics, topic)
+	}
+	if len(topics) == 0 {
+		log.Panic("missing topics config for MqttSource", ms.tag())
+	}
+	qos := conf.Metadata.GetInt("qos")
+	if qos < 0 || qos > 2 {
+		log.Panic("unsupported qos for MqttSource", ms.tag(), zap.Int("qos", qos))
+	}
+	ms.filters = make(map[string]byte, len(topics))
+	for _, topic := range topics {
+		ms.filters[topic] = byte(qos)
+	}
+	ms.codec = newSourceCodec(conf, ctx, log)
+	ms.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	//
+	var address []string
+	if a, ok := conf.Metadata[ConfAddress].(string); ok {
+		address = []string{a}
+	} else {
+		address = conf.Metadata.GetStringSlice(ConfAddress)
+	}
+	if len(address) == 0 {
+		log.Panic("missing address config for MqttSource", ms.tag())
+	}
+	clientID := conf.Metadata.GetString("clientId")
+	cleanSession := true
+	if conf.Metadata.Contains("cleanSession") {
+		cleanSession = conf.Metadata.GetBool("cleanSession")
+	}
+	if !cleanSession && len(clientID) == 0 {
+		log.Panic("missing clientId config of persistent session for MqttSource", ms.tag())
+	}
+	opts := mqtt.NewClientOptions()
+	for _, a := range address {
+		opts.AddBroker(a)
+	}
+	opts.SetClientID(clientID)
+	opts.SetUsername(conf.Metadata.GetString("user"))
+	opts.SetPassword(conf.Metadata.GetString("password"))
+	opts.SetCleanSession(cleanSession)
+	opts.SetKeepAlive(time.Duration(util.MaxInt(conf.Metadata.GetInt("keepAlive"), 30)) * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetAutoAckDisabled(true)
+	if tc := newTLSConfig(conf.Metadata.GetKeyValueConf("tls"), log); tc != nil {
+		opts.SetTLSConfig(tc)
+	}
+	// subscribe on every connect, a clean session loses its subscriptions
+	ms.subscribed = make(chan error, 1)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		t := c.SubscribeMultiple(ms.filters, ms.receive)
+		t.Wait()
+		err := t.Error()
+		if st, ok := t.(*mqtt.SubscribeToken); ok && err == nil {
+			// a refused filter is not an error of the token
+			for topic, code := range st.Result() {
+				if code == 0x80 {
+					err = errors.New("subscribe refused by broker: " + topic)
+				}
+			}
+		}
+		if err != nil {
+			log.Error("subscribe mqtt topics failed", ms.tag(), zap.Any("topics", ms.filters), zap.Error(err))
+		} else {
+			log.Info("mqtt topics subscribed", ms.tag(), zap.Any("topics", ms.filters))
+		}
+		// the first result is waited by init
+		select {
+		case ms.subscribed <- err:
+		default:
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Warn("mqtt connection lost", ms.tag(), zap.Error(err))
+	})
+	ms.client = mqtt.NewClient(opts)
+	timeout := time.Duration(conf.Metadata.GetInt("connectTimeout")) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if t := ms.client.Connect(); !t.WaitTimeout(timeout) {
+		ms.client.Disconnect(0)
+		log.Panic("connect mqtt broker timeout", ms.tag(), zap.Strings("address", address))
+	} else if err := t.Error(); err != nil {
+		log.Panic("connect mqtt broker failed", ms.tag(), zap.Strings("address", address), zap.Error(err))
+	}
+	select {
+	case err := <-ms.subscribed:
+		if err != nil {
+			ms.client.Disconnect(0)
+			log.Panic("subscribe mqtt topics failed", ms.tag(), zap.Any("topics", ms.filters), zap.Error(err))
+		}
+	case <-time.After(timeout):
+		ms.client.Disconnect(0)
+		log.Panic("subscribe mqtt topics timeout", ms.tag(), zap.Any("topics", ms.filters))
+	}
+	go ms.wait()
+}
+
+func (ms *MqttSource) Read() <-chan *TaskData {
+	return ms.mc
+}
+
+func (ms *MqttSource) receive(c mqtt.Client, msg mqtt.Message) {
+	ms.closeMu.RLock()
+	defer ms.closeMu.RUnlock()
+	if ms.closed {
+		return
+	}
+	meta := KeyValueConf{
+		"topic":     msg.Topic(),
+		"key":       msg.Topic(),
+		"qos":       int(msg.Qos()),
+		"retained":  msg.Retained(),
+		"messageId": msg.MessageID(),
+	}
+	for i, token := range strings.Split(msg.Topic(), "/") {
+		meta["token"+strconv.Itoa(i)] = token
+	}
+	dt := &TaskData{Payload: msg.Payload(), Metadata: meta}
+	decodePayload(ms.codec, dt, ms.log)
+	ms.inflight.Add(1)
+	dt.done = func() {
+		defer ms.inflight.Done()
+		msg.Ack()
+	}
+	// not acknowledged, delivered again to a persistent session
+	dt.fail = ms.inflight.Done
+	select {
+	case ms.mc <- dt:
+	case <-ms.ctx.Done():
+		// not acknowledged, delivered again to a persistent session
+		ms.inflight.Done()
+	}
+}
+
+func (ms *MqttSource) wait() {
+	<-ms.ctx.Done()
+	ms.closeMu.Lock()
+	ms.closed = true
+	close(ms.mc)
+	ms.closeMu.Unlock()
+	// acks of in-flight messages need the connection
+	drained := make(chan bool)
+	go func() {
+		ms.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		ms.log.Warn("wait in-flight messages timeout", ms.tag())
+	}
+	ms.client.Disconnect(250)
+}
+
+func (ms *MqttSource) tag() zap.Field {
+	return zap.String("tag", "MqttSource")
+}
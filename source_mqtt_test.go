@@ -0,0 +1,195 @@
+package job
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"go.uber.org/zap"
+)
+
+// mqttStandIn is a broker of one client, it records the subscriptions and acks, and refuses the refused filter.
+type mqttStandIn struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	conn    net.Conn
+	filters []string
+	acks    chan uint16
+	refused string
+}
+
+func newMqttStandIn(t *testing.T) *mqttStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &mqttStandIn{ln: ln, acks: make(chan uint16, 10)}
+	t.Cleanup(func() { _ = ln.Close() })
+	go ms.serve()
+	return ms
+}
+
+func (ms *mqttStandIn) address() string {
+	return "tcp://" + ms.ln.Addr().String()
+}
+
+func (ms *mqttStandIn) serve() {
+	for {
+		conn, err := ms.ln.Accept()
+		if err != nil {
+			return
+		}
+		ms.mu.Lock()
+		ms.conn = conn
+		ms.mu.Unlock()
+		go ms.handle(conn)
+	}
+}
+
+func (ms *mqttStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ms.mu.Lock()
+			for i, topic := range p.Topics {
+				if topic == ms.refused {
+					ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+				} else {
+					ms.filters = append(ms.filters, topic)
+					ack.ReturnCodes = append(ack.ReturnCodes, p.Qoss[i])
+				}
+			}
+			ms.mu.Unlock()
+			reply = ack
+		case *packets.PubackPacket:
+			ms.acks <- p.MessageID
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ms *mqttStandIn) publish(t *testing.T, topic string, id uint16, payload string) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Qos = 1
+	p.MessageID = id
+	p.Payload = []byte(payload)
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := p.Write(ms.conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestMqttSource(ctx context.Context, address string, topics ...interface{}) *MqttSource {
+	ms := &MqttSource{}
+	ms.init(&SourceConf{Type: "mqtt", Metadata: KeyValueConf{
+		ConfAddress: address, "topics": topics, "qos": 1, "codec": "json", "clientId": "test", "connectTimeout": 2,
+	}}, ctx, zap.NewNop())
+	return ms
+}
+
+func TestMqttSource(t *testing.T) {
+	broker := newMqttStandIn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := newTestMqttSource(ctx, broker.address(), "devices/+/status")
+	// init returns once subscribed
+	broker.mu.Lock()
+	filters := broker.filters
+	broker.mu.Unlock()
+	if len(filters) != 1 || filters[0] != "devices/+/status" {
+		t.Fatalf("filters %v", filters)
+	}
+	broker.publish(t, "devices/d1/status", 7, `{"id":"d1","online":true}`)
+	broker.publish(t, "devices/d2/status", 8, `{"id":"d2","online":false}`)
+	var data []*TaskData
+	for len(data) < 2 {
+		select {
+		case dt := <-source.Read():
+			data = append(data, dt)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no mqtt message")
+		}
+	}
+	first := data[0]
+	if item := first.Payload.(map[string]interface{}); item["id"] != "d1" {
+		t.Fatalf("payload %v", item)
+	}
+	// the packet id does not shadow the id of the payload
+	if _, ok := first.Metadata["id"]; ok || first.Metadata["messageId"] != uint16(7) || first.Metadata["token1"] != "d1" || first.Metadata["qos"] != 1 {
+		t.Fatalf("meta %v", first.Metadata)
+	}
+	// a failed message is not acknowledged
+	data[1].Fail()
+	first.Done()
+	select {
+	case id := <-broker.acks:
+		if id != 7 {
+			t.Fatalf("acked %d, want 7", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not acknowledged")
+	}
+	select {
+	case id := <-broker.acks:
+		t.Fatalf("failed message %d acknowledged", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case _, ok := <-source.Read():
+		if ok {
+			t.Fatal("message after the task stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("source not closed after the task stopped")
+	}
+}
+
+func TestMqttSourceSubscribeRefused(t *testing.T) {
+	broker := newMqttStandIn(t)
+	broker.refused = "private/#"
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for a refused subscription")
+		}
+	}()
+	newTestMqttSource(context.Background(), broker.address(), "public/#", "private/#")
+}
+
+func TestMqttSourceConnectTimeout(t *testing.T) {
+	// a listener which never answers the connect
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for a broker not connected")
+		}
+	}()
+	newTestMqttSource(context.Background(), "tcp://"+ln.Addr().String(), "a")
+}
@@ -0,0 +1,294 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/ywengineer/g-util/sql"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterSource("mysql", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &MySQLSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// mysqlWatermark is the last emitted value of the watermark column, and of the tie column
+// which orders the rows sharing a watermark value, e.g. updated_at and id.
+type mysqlWatermark struct {
+	Watermark interface{} `json:"watermark"`
+	Tie       interface{} `json:"tie"`
+}
+
+// MySQLSource polls a query incrementally. the query reads the last watermark from the named parameter
+// :watermark (and :tie), e.g. SELECT * FROM t WHERE id > :watermark ORDER BY id LIMIT 1000
+// a watermark column which is not unique needs a tie column, otherwise rows sharing the last watermark of a page
+// are skipped or polled forever, set unique only if the column is unique.
+type MySQLSource struct {
+	conf         *SourceConf
+	log          *zap.Logger
+	ctx          context.Context
+	mc           chan *TaskData
+	mysql        *sql.MySQL
+	query        string
+	column       string
+	tieColumn    string
+	unique       bool
+	limit        int
+	batch        bool
+	interval     time.Duration
+	positionFile string
+	meta         KeyValueConf
+	watermark    mysqlWatermark
+}
+
+func (ms *MySQLSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	ms.conf = conf
+	ms.log = log
+	ms.ctx = ctx
+	ms.query = conf.Metadata.GetString("query")
+	if len(ms.query) == 0 {
+		log.Panic("missing query config for MySQLSource", ms.tag())
+	}
+	ms.column = conf.Metadata.GetString("column")
+	if len(ms.column) == 0 {
+		log.Panic("missing watermark column config for MySQLSource", ms.tag())
+	}
+	ms.tieColumn = conf.Metadata.GetString("tieColumn")
+	ms.unique = conf.Metadata.GetBool("unique")
+	if len(ms.tieColumn) == 0 && !ms.unique {
+		log.Panic("missing tieColumn config for MySQLSource, or set unique if the watermark column is unique", ms.tag(), zap.String("column", ms.column))
+	}
+	ms.limit = conf.Metadata.GetInt("limit")
+	ms.batch = conf.Metadata.GetBool("batch")
+	ms.interval = time.Duration(util.MaxInt(conf.Metadata.GetInt("interval"), 1)) * time.Second
+	ms.positionFile = conf.Metadata.GetString("positionFile")
+	ms.meta = conf.Metadata.GetKeyValueConf("meta")
+	ms.watermark = mysqlWatermark{Watermark: conf.Metadata["initial"], Tie: conf.Metadata["initialTie"]}
+	if ms.watermark.Watermark == nil {
+		ms.watermark.Watermark = 0
+	}
+	if ms.watermark.Tie == nil {
+		ms.watermark.Tie = 0
+	}
+	ms.loadWatermark()
+	//
+	if conf.Metadata.GetBool("global") {
+		if mysql == nil {
+			log.Panic("global mysql client not set.", ms.tag())
+		} else {
+			ms.mysql = mysql
+		}
+	} else {
+		ms.mysql = newMySQLClient(conf.Metadata, log)
+	}
+	ms.mc = make(chan *TaskData)
+	go ms.run()
+}
+
+func (ms *MySQLSource) Read() <-chan *TaskData {
+	return ms.mc
+}
+
+func (ms *MySQLSource) run() {
+	defer close(ms.mc)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ms.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		n, ok := ms.poll()
+		if !ok {
+			return
+		}
+		// a full page means more rows are waiting
+		if ms.limit > 0 && n >= ms.limit {
+			timer.Reset(0)
+		} else {
+			timer.Reset(ms.interval)
+		}
+	}
+}
+
+// poll emits the rows after the watermark, and advances the watermark once all rows are done.
+func (ms *MySQLSource) poll() (int, bool) {
+	rows, err := ms.mysql.GetConn().NamedQueryContext(ms.ctx, ms.query, map[string]interface{}{
+		"watermark": ms.watermark.Watermark,
+		"tie":       ms.watermark.Tie,
+	})
+	if err != nil {
+		if ms.ctx.Err() != nil {
+			return 0, false
+		}
+		ms.log.Error("poll mysql failed", ms.tag(), zap.String("sql", ms.query), zap.Any("watermark", ms.watermark), zap.Error(err))
+		return 0, true
+	}
+	items, err := scanMySQLRows(rows)
+	_ = rows.Close()
+	if err != nil {
+		ms.log.Error("scan mysql rows failed", ms.tag(), zap.String("sql", ms.query), zap.Error(err))
+		return 0, true
+	}
+	if len(items) == 0 {
+		return 0, true
+	}
+	next := ms.watermarkOf(items[len(items)-1])
+	if len(ms.tieColumn) == 0 && len(items) > 1 && fmt.Sprint(items[len(items)-2][ms.column]) == fmt.Sprint(next.Watermark) {
+		ms.log.Error("watermark column is not unique, rows sharing the last watermark may be skipped. set tieColumn",
+			ms.tag(), zap.String("column", ms.column), zap.Any("watermark", next.Watermark))
+	}
+	//
+	wg := &sync.WaitGroup{}
+	var payloads []interface{}
+	var marks []mysqlWatermark
+	if ms.batch {
+		payloads = []interface{}{items}
+		marks = []mysqlWatermark{next}
+	} else {
+		for _, item := range items {
+			payloads = append(payloads, item)
+			marks = append(marks, ms.watermarkOf(item))
+		}
+	}
+	failed := make([]int32, len(payloads))
+	for i, payload := range payloads {
+		dt := &TaskData{Payload: payload, Metadata: ms.metadata(marks[i])}
+		wg.Add(1)
+		dt.done = wg.Done
+		index := i
+		dt.fail = func() {
+			atomic.StoreInt32(&failed[index], 1)
+			wg.Done()
+		}
+		select {
+		case ms.mc <- dt:
+		case <-ms.ctx.Done():
+			// the watermark is not advanced, rows are polled again after restart
+			return 0, false
+		}
+	}
+	wg.Wait()
+	// the watermark stops before the first failed row, which is polled again
+	for i := range failed {
+		if atomic.LoadInt32(&failed[i]) == 1 {
+			if i > 0 {
+				ms.watermark = marks[i-1]
+				ms.saveWatermark()
+			}
+			ms.log.Error("mysql rows failed, polled again", ms.tag(), zap.Any("watermark", ms.watermark))
+			return i, true
+		}
+	}
+	ms.watermark = next
+	ms.saveWatermark()
+	return len(items), true
+}
+
+// watermarkOf returns the watermark of a row.
+func (ms *MySQLSource) watermarkOf(item map[string]interface{}) mysqlWatermark {
+	wm := mysqlWatermark{Watermark: item[ms.column], Tie: ms.watermark.Tie}
+	if len(ms.tieColumn) > 0 {
+		wm.Tie = item[ms.tieColumn]
+	}
+	return wm
+}
+
+// metadata keeps the watermark of the row, or of the last row for a batch.
+func (ms *MySQLSource) metadata(wm mysqlWatermark) KeyValueConf {
+	meta := KeyValueConf{"watermark": wm.Watermark}
+	if len(ms.tieColumn) > 0 {
+		meta["tie"] = wm.Tie
+	}
+	for k, v := range ms.meta {
+		meta[k] = v
+	}
+	return meta
+}
+
+func (ms *MySQLSource) loadWatermark() {
+	if len(ms.positionFile) == 0 {
+		return
+	}
+	data, err := ioutil.ReadFile(ms.positionFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		ms.log.Panic("read watermark file failed", ms.tag(), zap.String("file", ms.positionFile), zap.Error(err))
+	}
+	if err := jsonApi.Unmarshal(data, &ms.watermark); err != nil {
+		ms.log.Panic("parse watermark file failed", ms.tag(), zap.String("file", ms.positionFile), zap.Error(err))
+	}
+	ms.log.Info("watermark loaded", ms.tag(), zap.Any("watermark", ms.watermark))
+}
+
+func (ms *MySQLSource) saveWatermark() {
+	if len(ms.positionFile) == 0 {
+		return
+	}
+	data, err := jsonApi.Marshal(ms.watermark)
+	if err != nil {
+		ms.log.Error("encode watermark failed", ms.tag(), zap.Error(err))
+		return
+	}
+	tmp := ms.positionFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		ms.log.Error("write watermark file failed", ms.tag(), zap.String("file", tmp), zap.Error(err))
+	} else if err := os.Rename(tmp, ms.positionFile); err != nil {
+		ms.log.Error("rename watermark file failed", ms.tag(), zap.String("file", ms.positionFile), zap.Error(err))
+	}
+}
+
+func (ms *MySQLSource) tag() zap.Field {
+	return zap.String("tag", "MySQLSource")
+}
+
+// scanMySQLRows scans rows into maps. the driver returns text columns as []byte, they are converted to
+// strings, and numeric columns to json.Number, the same as json decoded payloads.
+func scanMySQLRows(rows *sqlx.Rows) ([]map[string]interface{}, error) {
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return nil, err
+		}
+		item := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			item[col.Name()] = mysqlValue(col.DatabaseTypeName(), values[i])
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func mysqlValue(typ string, v interface{}) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	switch strings.TrimPrefix(strings.ToUpper(typ), "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE", "YEAR":
+		return json.Number(b)
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY":
+		return append([]byte(nil), b...)
+	default:
+		return string(b)
+	}
+}
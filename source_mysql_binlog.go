@@ -0,0 +1,373 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	mysqlx "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("mysql_binlog", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &MySQLBinlogSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// binlogCheckpoint is the binlog position after a committed transaction.
+type binlogCheckpoint struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+	GTID string `json:"gtid"`
+}
+
+type binlogEntry struct {
+	done       bool
+	failed     bool
+	checkpoint *binlogCheckpoint
+}
+
+// binlogTracker keeps emitted row events and transaction checkpoints in binlog order.
+// a checkpoint is committed once all row events before it are done.
+type binlogTracker struct {
+	mu        sync.Mutex
+	queue     []*binlogEntry
+	committed binlogCheckpoint
+	dirty     bool
+}
+
+func (bt *binlogTracker) track() *binlogEntry {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	e := &binlogEntry{}
+	bt.queue = append(bt.queue, e)
+	return e
+}
+
+func (bt *binlogTracker) checkpoint(cp binlogCheckpoint) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.queue = append(bt.queue, &binlogEntry{done: true, checkpoint: &cp})
+	bt.advance()
+}
+
+func (bt *binlogTracker) done(e *binlogEntry) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	e.done = true
+	bt.advance()
+}
+
+// fail keeps a failed row event in the queue, no later checkpoint is committed and it is replicated again after restart.
+func (bt *binlogTracker) fail(e *binlogEntry) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	e.failed = true
+}
+
+func (bt *binlogTracker) advance() {
+	for len(bt.queue) > 0 && bt.queue[0].done {
+		if cp := bt.queue[0].checkpoint; cp != nil {
+			bt.committed = *cp
+			bt.dirty = true
+		}
+		bt.queue = bt.queue[1:]
+	}
+}
+
+func (bt *binlogTracker) pending() int {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	n := 0
+	for _, e := range bt.queue {
+		if !e.done && !e.failed {
+			n++
+		}
+	}
+	return n
+}
+
+// take returns the committed checkpoint if it changed since last take.
+func (bt *binlogTracker) take() (binlogCheckpoint, bool) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	dirty := bt.dirty
+	bt.dirty = false
+	return bt.committed, dirty
+}
+
+// MySQLBinlogSource reads the row based binlog as a replica, and emits a TaskData for each changed row.
+// the payload is the after image, or the before image for deletes.
+type MySQLBinlogSource struct {
+	canal.DummyEventHandler
+	conf         *SourceConf
+	log          *zap.Logger
+	ctx          context.Context
+	mc           chan *TaskData
+	canal        *canal.Canal
+	flavor       string
+	useGTID      bool
+	envelope     bool
+	positionFile string
+	interval     time.Duration
+	tracker      *binlogTracker
+	file         string
+	gtid         string
+	saveMu       sync.Mutex
+	err          error
+}
+
+func (bs *MySQLBinlogSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	bs.conf = conf
+	bs.log = log
+	bs.ctx = ctx
+	bs.useGTID = conf.Metadata.GetBool("gtid")
+	bs.envelope = conf.Metadata.GetBool("envelope")
+	bs.positionFile = conf.Metadata.GetString("positionFile")
+	bs.interval = time.Duration(util.MaxInt(conf.Metadata.GetInt("interval"), 1)) * time.Second
+	bs.tracker = &binlogTracker{}
+	bs.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	//
+	cfg := canal.NewDefaultConfig()
+	cfg.Addr = conf.Metadata.GetStringOrDefault(ConfAddress, cfg.Addr)
+	cfg.User = conf.Metadata.GetString("user")
+	cfg.Password = conf.Metadata.GetString("password")
+	cfg.Flavor = conf.Metadata.GetStringOrDefault("flavor", cfg.Flavor)
+	if id := conf.Metadata.GetInt("serverId"); id > 0 {
+		cfg.ServerID = uint32(id)
+	}
+	cfg.IncludeTableRegex = conf.Metadata.GetStringSlice("includeTables")
+	cfg.ExcludeTableRegex = conf.Metadata.GetStringSlice("excludeTables")
+	// never dump, start from the checkpoint or the current master position
+	cfg.Dump.ExecutionPath = ""
+	bs.flavor = cfg.Flavor
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		log.Panic("create binlog replica failed", bs.tag(), zap.String("address", cfg.Addr), zap.Error(err))
+	}
+	c.SetEventHandler(bs)
+	bs.canal = c
+	//
+	start := bs.loadCheckpoint()
+	bs.tracker.committed = start
+	go bs.run(start)
+}
+
+func (bs *MySQLBinlogSource) Read() <-chan *TaskData {
+	return bs.mc
+}
+
+func (bs *MySQLBinlogSource) run(start binlogCheckpoint) {
+	defer func() {
+		// wait the in-flight rows, so the final checkpoint is persisted
+		deadline := time.Now().Add(10 * time.Second)
+		for bs.tracker.pending() > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		bs.saveCheckpoint()
+		close(bs.mc)
+	}()
+	go func() {
+		<-bs.ctx.Done()
+		bs.canal.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(bs.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bs.ctx.Done():
+				return
+			case <-ticker.C:
+				bs.saveCheckpoint()
+			}
+		}
+	}()
+	// the error is set before the channel is closed, so the task reads it once no more rows
+	if err := bs.replicate(start); err != nil && bs.ctx.Err() == nil {
+		bs.log.Error("binlog replication stopped", bs.tag(), zap.Error(err))
+		bs.err = err
+	}
+}
+
+// replicate runs the replication from the checkpoint until it fails or the canal is closed.
+func (bs *MySQLBinlogSource) replicate(start binlogCheckpoint) error {
+	if bs.useGTID {
+		var set mysqlx.GTIDSet
+		var err error
+		if len(start.GTID) > 0 {
+			set, err = mysqlx.ParseGTIDSet(bs.flavor, start.GTID)
+		} else {
+			set, err = bs.canal.GetMasterGTIDSet()
+		}
+		if err != nil {
+			return fmt.Errorf("resolve start gtid set failed: %w", err)
+		}
+		bs.log.Info("binlog replication started", bs.tag(), zap.String("gtid", set.String()))
+		return bs.canal.StartFromGTID(set)
+	}
+	pos := mysqlx.Position{Name: start.File, Pos: start.Pos}
+	if len(pos.Name) == 0 {
+		var err error
+		if pos, err = bs.canal.GetMasterPos(); err != nil {
+			return fmt.Errorf("resolve master position failed: %w", err)
+		}
+	}
+	bs.file = pos.Name
+	bs.log.Info("binlog replication started", bs.tag(), zap.String("file", pos.Name), zap.Uint32("pos", pos.Pos))
+	return bs.canal.RunFrom(pos)
+}
+
+// Err returns the error stopping the replication, nil if it is stopped by the task.
+func (bs *MySQLBinlogSource) Err() error {
+	return bs.err
+}
+
+func (bs *MySQLBinlogSource) OnRotate(e *replication.RotateEvent) error {
+	bs.file = string(e.NextLogName)
+	return nil
+}
+
+func (bs *MySQLBinlogSource) OnGTID(gtid mysqlx.GTIDSet) error {
+	if gtid != nil {
+		bs.gtid = gtid.String()
+	}
+	return nil
+}
+
+func (bs *MySQLBinlogSource) OnPosSynced(pos mysqlx.Position, set mysqlx.GTIDSet, force bool) error {
+	cp := binlogCheckpoint{File: pos.Name, Pos: pos.Pos}
+	if set != nil {
+		cp.GTID = set.String()
+	}
+	bs.tracker.checkpoint(cp)
+	return nil
+}
+
+func (bs *MySQLBinlogSource) OnRow(e *canal.RowsEvent) error {
+	step := 1
+	if e.Action == canal.UpdateAction {
+		step = 2
+	}
+	for i := 0; i+step <= len(e.Rows); i += step {
+		var before, after map[string]interface{}
+		switch e.Action {
+		case canal.InsertAction:
+			after = binlogRow(e.Table, e.Rows[i])
+		case canal.DeleteAction:
+			before = binlogRow(e.Table, e.Rows[i])
+		case canal.UpdateAction:
+			before = binlogRow(e.Table, e.Rows[i])
+			after = binlogRow(e.Table, e.Rows[i+1])
+		}
+		dt := &TaskData{Metadata: KeyValueConf{
+			"action":     e.Action,
+			"schema":     e.Table.Schema,
+			"table":      e.Table.Name,
+			"key":        e.Table.Schema + "." + e.Table.Name,
+			"gtid":       bs.gtid,
+			"binlogFile": bs.file,
+		}}
+		if e.Header != nil {
+			dt.Metadata["binlogPos"] = e.Header.LogPos
+			dt.Metadata["timestamp"] = time.Unix(int64(e.Header.Timestamp), 0)
+		}
+		if bs.envelope {
+			dt.Payload = map[string]interface{}{"before": before, "after": after}
+		} else if after != nil {
+			dt.Payload = after
+			if before != nil {
+				dt.Metadata["before"] = before
+			}
+		} else {
+			dt.Payload = before
+		}
+		entry := bs.tracker.track()
+		dt.done = func() {
+			bs.tracker.done(entry)
+		}
+		dt.fail = func() {
+			bs.tracker.fail(entry)
+		}
+		select {
+		case bs.mc <- dt:
+		case <-bs.ctx.Done():
+			return bs.ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (bs *MySQLBinlogSource) String() string {
+	return "MySQLBinlogSource"
+}
+
+func (bs *MySQLBinlogSource) loadCheckpoint() binlogCheckpoint {
+	cp := binlogCheckpoint{}
+	if len(bs.positionFile) == 0 {
+		return cp
+	}
+	data, err := ioutil.ReadFile(bs.positionFile)
+	if os.IsNotExist(err) {
+		return cp
+	} else if err != nil {
+		bs.log.Panic("read binlog checkpoint file failed", bs.tag(), zap.String("file", bs.positionFile), zap.Error(err))
+	}
+	if err := jsonApi.Unmarshal(data, &cp); err != nil {
+		bs.log.Panic("parse binlog checkpoint file failed", bs.tag(), zap.String("file", bs.positionFile), zap.Error(err))
+	}
+	bs.log.Info("binlog checkpoint loaded", bs.tag(), zap.Any("checkpoint", cp))
+	return cp
+}
+
+func (bs *MySQLBinlogSource) saveCheckpoint() {
+	cp, dirty := bs.tracker.take()
+	if !dirty || len(bs.positionFile) == 0 {
+		return
+	}
+	bs.saveMu.Lock()
+	defer bs.saveMu.Unlock()
+	data, err := jsonApi.Marshal(cp)
+	if err != nil {
+		bs.log.Error("encode binlog checkpoint failed", bs.tag(), zap.Error(err))
+		return
+	}
+	tmp := bs.positionFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		bs.log.Error("write binlog checkpoint failed", bs.tag(), zap.String("file", tmp), zap.Error(err))
+	} else if err := os.Rename(tmp, bs.positionFile); err != nil {
+		bs.log.Error("rename binlog checkpoint failed", bs.tag(), zap.String("file", bs.positionFile), zap.Error(err))
+	}
+}
+
+func (bs *MySQLBinlogSource) tag() zap.Field {
+	return zap.String("tag", "MySQLBinlogSource")
+}
+
+// binlogRow maps the row values to column names, text columns are converted to strings.
+func binlogRow(table *schema.Table, row []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(table.Columns))
+	for i, col := range table.Columns {
+		if i >= len(row) {
+			break
+		}
+		v := row[i]
+		if b, ok := v.([]byte); ok {
+			switch col.Type {
+			case schema.TYPE_STRING, schema.TYPE_JSON, schema.TYPE_ENUM, schema.TYPE_SET:
+				v = string(b)
+			}
+		}
+		m[col.Name] = v
+	}
+	return m
+}
@@ -0,0 +1,29 @@
+package job
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestMySQLSourceRequiresTieColumn(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("missing tieColumn accepted for a column not declared unique")
+		}
+	}()
+	ms := &MySQLSource{}
+	ms.init(&SourceConf{Type: "mysql", Metadata: KeyValueConf{"query": "SELECT 1", "column": "updated_at"}}, context.Background(), zap.NewNop())
+}
+
+func TestMySQLSourceRowWatermark(t *testing.T) {
+	ms := &MySQLSource{column: "updated_at", tieColumn: "id"}
+	rows := []map[string]interface{}{{"updated_at": 5, "id": 1}, {"updated_at": 5, "id": 2}, {"updated_at": 6, "id": 3}}
+	for _, row := range rows {
+		meta := ms.metadata(ms.watermarkOf(row))
+		if meta["watermark"] != row["updated_at"] || meta["tie"] != row["id"] {
+			t.Fatalf("metadata %v of row %v", meta, row)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("nats", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &NatsSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// NatsSource subscribes a core subject, optionally in a queue group, or pulls from a durable JetStream consumer.
+// JetStream messages are acknowledged once they passed all sinks.
+type NatsSource struct {
+	conf      *SourceConf
+	log       *zap.Logger
+	ctx       context.Context
+	mc        chan *TaskData
+	codec     Codec
+	conn      *nats.Conn
+	sub       *nats.Subscription
+	subject   string
+	queue     string
+	jetstream bool
+	stream    string
+	durable   string
+	batch     int
+	inflight  sync.WaitGroup
+	closeMu   sync.RWMutex
+	closed    bool
+}
+
+func (ns *NatsSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	ns.conf = conf
+	ns.log = log
+	ns.ctx = ctx
+	ns.subject = conf.Metadata.GetString("subject")
+	if len(ns.subject) == 0 {
+		log.Panic("missing subject config for NatsSource", ns.tag())
+	}
+	ns.queue = conf.Metadata.GetString("queue")
+	ns.jetstream = conf.Metadata.GetBool("jetstream")
+	ns.batch = conf.Metadata.GetInt("batch")
+	if ns.batch <= 0 {
+		ns.batch = 100
+	}
+	ns.codec = newSourceCodec(conf, ctx, log)
+	ns.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	ns.conn = newNatsConn(conf.Metadata, log)
+	//
+	if ns.jetstream {
+		ns.initJetStream()
+		go ns.pull()
+	} else {
+		sub, err := ns.conn.QueueSubscribe(ns.subject, ns.queue, ns.receive)
+		if err != nil {
+			log.Panic("subscribe nats subject failed", ns.tag(), zap.String("subject", ns.subject), zap.Error(err))
+		}
+		ns.sub = sub
+		go ns.wait()
+	}
+	log.Info("nats source started", ns.tag(), zap.String("subject", ns.subject), zap.String("queue", ns.queue),
+		zap.Bool("jetstream", ns.jetstream), zap.String("durable", ns.durable))
+}
+
+// initJetStream binds the durable consumer, which is created if missing. a bound consumer is never deleted
+// when the subscription stops, so acknowledged positions survive restarts.
+func (ns *NatsSource) initJetStream() {
+	conf := ns.conf.Metadata
+	ns.stream = conf.GetString("stream")
+	if len(ns.stream) == 0 {
+		ns.log.Panic("missing stream config of jetstream for NatsSource", ns.tag())
+	}
+	ns.durable = conf.GetString("durable")
+	if len(ns.durable) == 0 {
+		ns.log.Panic("missing durable config of jetstream for NatsSource", ns.tag())
+	}
+	js, err := ns.conn.JetStream()
+	if err != nil {
+		ns.log.Panic("create jetstream context failed", ns.tag(), zap.Error(err))
+	}
+	if _, err = js.ConsumerInfo(ns.stream, ns.durable); errors.Is(err, nats.ErrConsumerNotFound) {
+		cc := &nats.ConsumerConfig{
+			Durable:       ns.durable,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       time.Duration(util.MaxInt(conf.GetInt("ackWait"), 30)) * time.Second,
+			MaxAckPending: conf.GetInt("maxAckPending"),
+			FilterSubject: ns.subject,
+		}
+		switch conf.GetStringOrDefault("deliver", "all") {
+		case "new":
+			cc.DeliverPolicy = nats.DeliverNewPolicy
+		case "last":
+			cc.DeliverPolicy = nats.DeliverLastPolicy
+		default:
+			cc.DeliverPolicy = nats.DeliverAllPolicy
+		}
+		_, err = js.AddConsumer(ns.stream, cc)
+	}
+	if err != nil {
+		ns.log.Panic("create jetstream consumer failed", ns.tag(), zap.String("stream", ns.stream), zap.String("durable", ns.durable), zap.Error(err))
+	}
+	sub, err := js.PullSubscribe(ns.subject, ns.durable, nats.Bind(ns.stream, ns.durable))
+	if err != nil {
+		ns.log.Panic("subscribe jetstream consumer failed", ns.tag(), zap.String("stream", ns.stream), zap.String("durable", ns.durable), zap.Error(err))
+	}
+	ns.sub = sub
+}
+
+func (ns *NatsSource) Read() <-chan *TaskData {
+	return ns.mc
+}
+
+// receive handles core messages, which are not acknowledged.
+func (ns *NatsSource) receive(msg *nats.Msg) {
+	ns.closeMu.RLock()
+	defer ns.closeMu.RUnlock()
+	if ns.closed {
+		return
+	}
+	select {
+	case ns.mc <- ns.taskData(msg):
+	case <-ns.ctx.Done():
+	}
+}
+
+func (ns *NatsSource) wait() {
+	<-ns.ctx.Done()
+	if err := ns.sub.Unsubscribe(); err != nil {
+		ns.log.Warn("unsubscribe nats subject failed", ns.tag(), zap.Error(err))
+	}
+	ns.closeMu.Lock()
+	ns.closed = true
+	close(ns.mc)
+	ns.closeMu.Unlock()
+	ns.conn.Close()
+}
+
+func (ns *NatsSource) pull() {
+	defer func() {
+		close(ns.mc)
+		// acks of in-flight messages need the connection
+		drained := make(chan bool)
+		go func() {
+			ns.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(10 * time.Second):
+			ns.log.Warn("wait in-flight messages timeout", ns.tag())
+		}
+		ns.conn.Close()
+	}()
+	for ns.ctx.Err() == nil {
+		fc, cancel := context.WithTimeout(ns.ctx, 5*time.Second)
+		msgs, err := ns.sub.Fetch(ns.batch, nats.Context(fc))
+		cancel()
+		if err != nil {
+			if ns.ctx.Err() != nil {
+				return
+			}
+			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, nats.ErrTimeout) {
+				ns.log.Error("fetch jetstream messages failed", ns.tag(), zap.String("durable", ns.durable), zap.Error(err))
+				select {
+				case <-ns.ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+			continue
+		}
+		for i, msg := range msgs {
+			m := msg
+			dt := ns.taskData(m)
+			ns.inflight.Add(1)
+			dt.done = func() {
+				defer ns.inflight.Done()
+				if err := m.Ack(); err != nil {
+					ns.log.Error("ack jetstream message failed", ns.tag(), zap.String("subject", m.Subject), zap.Error(err))
+				}
+			}
+			dt.fail = func() {
+				defer ns.inflight.Done()
+				if err := m.Nak(); err != nil {
+					ns.log.Error("nak jetstream message failed", ns.tag(), zap.String("subject", m.Subject), zap.Error(err))
+				}
+			}
+			select {
+			case ns.mc <- dt:
+			case <-ns.ctx.Done():
+				// redeliver the unsent messages at once
+				ns.inflight.Done()
+				for _, rest := range msgs[i:] {
+					_ = rest.Nak()
+				}
+				return
+			}
+		}
+	}
+}
+
+// taskData keeps the subject and its tokens in metadata, e.g. orders.created gives token0=orders and token1=created.
+func (ns *NatsSource) taskData(msg *nats.Msg) *TaskData {
+	meta := KeyValueConf{
+		"subject": msg.Subject,
+		"key":     msg.Subject,
+	}
+	for i, token := range strings.Split(msg.Subject, ".") {
+		meta["token"+strconv.Itoa(i)] = token
+	}
+	for k, v := range msg.Header {
+		meta[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	if ns.jetstream {
+		if md, err := msg.Metadata(); err == nil {
+			meta["stream"] = md.Stream
+			meta["sequence"] = md.Sequence.Stream
+			meta["delivered"] = md.NumDelivered
+			meta["timestamp"] = md.Timestamp
+		}
+	}
+	dt := &TaskData{Payload: msg.Data, Metadata: meta}
+	decodePayload(ns.codec, dt, ns.log)
+	return dt
+}
+
+func (ns *NatsSource) tag() zap.Field {
+	return zap.String("tag", "NatsSource")
+}
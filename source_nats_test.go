@@ -0,0 +1,124 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+// runNatsServer starts an in-process server with JetStream on a random port.
+func runNatsServer(t *testing.T) string {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+func natsConn(t *testing.T, url string) *nats.Conn {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func readNats(t *testing.T, ns *NatsSource) *TaskData {
+	select {
+	case dt := <-ns.Read():
+		return dt
+	case <-time.After(5 * time.Second):
+		t.Fatal("no nats message")
+	}
+	return nil
+}
+
+func TestNatsSource(t *testing.T) {
+	url := runNatsServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns := &NatsSource{}
+	ns.init(&SourceConf{Type: "nats", Metadata: KeyValueConf{ConfAddress: url, "subject": "orders.*", "codec": "json"}}, ctx, zap.NewNop())
+	nc := natsConn(t, url)
+	msg := nats.NewMsg("orders.created")
+	msg.Data = []byte(`{"id":1}`)
+	msg.Header.Set("Trace-Id", "t1")
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	dt := readNats(t, ns)
+	if item, ok := dt.Payload.(map[string]interface{}); !ok || item["id"] == nil {
+		t.Fatalf("payload %#v", dt.Payload)
+	}
+	if dt.Metadata["subject"] != "orders.created" || dt.Metadata["token0"] != "orders" || dt.Metadata["token1"] != "created" || dt.Metadata["trace-id"] != "t1" {
+		t.Fatalf("meta %v", dt.Metadata)
+	}
+	cancel()
+	select {
+	case _, ok := <-ns.Read():
+		if ok {
+			t.Fatal("message after the task stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("source not closed after the task stopped")
+	}
+}
+
+func TestNatsSourceJetStream(t *testing.T) {
+	url := runNatsServer(t)
+	nc := natsConn(t, url)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b"} {
+		if _, err = js.Publish("orders.created", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ns := &NatsSource{}
+	ns.init(&SourceConf{Type: "nats", Metadata: KeyValueConf{
+		ConfAddress: url, "subject": "orders.>", "jetstream": true, "stream": "ORDERS", "durable": "sink", "batch": 2,
+	}}, ctx, zap.NewNop())
+	first, second := readNats(t, ns), readNats(t, ns)
+	if string(first.Payload.([]byte)) != "a" || first.Metadata["stream"] != "ORDERS" || first.Metadata["sequence"] != uint64(1) {
+		t.Fatalf("first %s %v", first.Payload, first.Metadata)
+	}
+	first.Done()
+	// a failed message is redelivered
+	second.Fail()
+	again := readNats(t, ns)
+	if string(again.Payload.([]byte)) != "b" || again.Metadata["delivered"] != uint64(2) {
+		t.Fatalf("redelivered %s %v", again.Payload, again.Metadata)
+	}
+	again.Done()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := js.ConsumerInfo("ORDERS", "sink")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.AckFloor.Stream == 2 && info.NumAckPending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer ack floor %d, pending %d", info.AckFloor.Stream, info.NumAckPending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,219 @@
+package job
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("redis_stream", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &RedisStreamSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+// RedisStreamSource reads streams as a member of a consumer group. an entry is acknowledged by XACK once
+// it passed all sinks, entries left pending by a previous run of the same consumer are read again first.
+// the consumer name is the host name by default.
+type RedisStreamSource struct {
+	conf     *SourceConf
+	log      *zap.Logger
+	ctx      context.Context
+	mc       chan *TaskData
+	codec    Codec
+	redis    redis.UniversalClient
+	streams  []string
+	group    string
+	consumer string
+	field    string
+	count    int64
+	block    time.Duration
+	inflight sync.WaitGroup
+}
+
+func (rs *RedisStreamSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	rs.conf = conf
+	rs.log = log
+	rs.ctx = ctx
+	if stream := conf.Metadata.GetString("stream"); len(stream) > 0 {
+		rs.streams = []string{stream}
+	} else {
+		rs.streams = conf.Metadata.GetStringSlice("streams")
+	}
+	if len(rs.streams) == 0 {
+		log.Panic("missing stream config for RedisStreamSource", rs.tag())
+	}
+	rs.group = conf.Metadata.GetString("group")
+	if len(rs.group) == 0 {
+		log.Panic("missing group config for RedisStreamSource", rs.tag())
+	}
+	// a stable name by default, so the entries left pending by the previous process are read again after restart.
+	// processes of the same group on one host need their own consumer names.
+	rs.consumer = conf.Metadata.GetString("consumer")
+	if len(rs.consumer) == 0 {
+		rs.consumer, _ = os.Hostname()
+	}
+	if len(rs.consumer) == 0 {
+		log.Panic("missing consumer config for RedisStreamSource", rs.tag())
+	}
+	rs.field = conf.Metadata.GetString("field")
+	rs.count = conf.Metadata.GetInt64("count")
+	if rs.count <= 0 {
+		rs.count = 100
+	}
+	rs.block = time.Duration(util.MaxInt(conf.Metadata.GetInt("block"), 1)) * time.Second
+	rs.codec = newSourceCodec(conf, ctx, log)
+	//
+	if conf.Metadata.GetBool("global") {
+		if _redis == nil {
+			log.Panic("global redis client not set.", rs.tag())
+		} else {
+			rs.redis = _redis
+		}
+	} else {
+		rs.redis = newRedisClient(conf.Metadata, log)
+	}
+	// the group starts from new entries by default, "0" reads the whole stream
+	start := conf.Metadata.GetStringOrDefault("start", "$")
+	for _, stream := range rs.streams {
+		err := rs.redis.XGroupCreateMkStream(ctx, stream, rs.group, start).Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			log.Panic("create consumer group failed", rs.tag(), zap.String("stream", stream), zap.String("group", rs.group), zap.Error(err))
+		}
+	}
+	rs.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	go rs.run()
+}
+
+func (rs *RedisStreamSource) Read() <-chan *TaskData {
+	return rs.mc
+}
+
+func (rs *RedisStreamSource) run() {
+	defer func() {
+		close(rs.mc)
+		drained := make(chan bool)
+		go func() {
+			rs.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(10 * time.Second):
+			rs.log.Warn("wait in-flight entries timeout", rs.tag())
+		}
+	}()
+	rs.log.Info("redis stream source started", rs.tag(), zap.Strings("streams", rs.streams), zap.String("group", rs.group), zap.String("consumer", rs.consumer))
+	// pending entries of this consumer first, then new entries
+	ids := make(map[string]string, len(rs.streams))
+	for _, stream := range rs.streams {
+		ids[stream] = "0"
+	}
+	for rs.ctx.Err() == nil {
+		pending := false
+		for _, id := range ids {
+			pending = pending || id != ">"
+		}
+		args := &redis.XReadGroupArgs{
+			Group:    rs.group,
+			Consumer: rs.consumer,
+			Streams:  make([]string, 0, len(rs.streams)*2),
+			Count:    rs.count,
+			Block:    rs.block,
+		}
+		args.Streams = append(args.Streams, rs.streams...)
+		for _, stream := range rs.streams {
+			args.Streams = append(args.Streams, ids[stream])
+		}
+		if pending {
+			args.Block = -1
+		}
+		streams, err := rs.redis.XReadGroup(rs.ctx, args).Result()
+		if err == redis.Nil {
+			advancePending(ids, nil)
+			continue
+		} else if err != nil {
+			if rs.ctx.Err() != nil {
+				return
+			}
+			rs.log.Error("read redis stream failed", rs.tag(), zap.Strings("streams", rs.streams), zap.Error(err))
+			select {
+			case <-rs.ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if !rs.send(stream.Stream, msg) {
+					return
+				}
+			}
+		}
+		advancePending(ids, streams)
+	}
+}
+
+// advancePending moves the start id of each stream still reading its pending entries to the last entry read,
+// a stream switches to new entries ">" once a pending read returns nothing.
+func advancePending(ids map[string]string, streams []redis.XStream) {
+	read := make(map[string]string, len(streams))
+	for _, stream := range streams {
+		if n := len(stream.Messages); n > 0 {
+			read[stream.Stream] = stream.Messages[n-1].ID
+		}
+	}
+	for stream, id := range ids {
+		if id == ">" {
+			continue
+		}
+		if last, ok := read[stream]; ok {
+			ids[stream] = last
+		} else {
+			ids[stream] = ">"
+		}
+	}
+}
+
+func (rs *RedisStreamSource) send(stream string, msg redis.XMessage) bool {
+	dt := &TaskData{Metadata: KeyValueConf{
+		"stream": stream,
+		"key":    stream,
+		"id":     msg.ID,
+		"group":  rs.group,
+	}}
+	if len(rs.field) > 0 {
+		dt.Payload = msg.Values[rs.field]
+		decodePayload(rs.codec, dt, rs.log)
+	} else {
+		dt.Payload = msg.Values
+	}
+	rs.inflight.Add(1)
+	dt.done = func() {
+		defer rs.inflight.Done()
+		if err := rs.redis.XAck(context.Background(), stream, rs.group, msg.ID).Err(); err != nil {
+			rs.log.Error("ack redis stream entry failed", rs.tag(), zap.String("stream", stream), zap.String("id", msg.ID), zap.Error(err))
+		}
+	}
+	// left pending, read again after restart
+	dt.fail = rs.inflight.Done
+	select {
+	case rs.mc <- dt:
+		return true
+	case <-rs.ctx.Done():
+		// left pending, read again after restart
+		rs.inflight.Done()
+		return false
+	}
+}
+
+func (rs *RedisStreamSource) tag() zap.Field {
+	return zap.String("tag", "RedisStreamSource")
+}
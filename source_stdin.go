@@ -0,0 +1,101 @@
+package job
+
+import (
+	"bufio"
+	"context"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterSource("stdin", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &StdinSource{}
+		s.init(conf, ctx, log, os.Stdin)
+		return s
+	})
+}
+
+// StdinSource reads ndjson lines from stdin, or raw lines with format line. the task finishes at EOF.
+type StdinSource struct {
+	conf   *SourceConf
+	log    *zap.Logger
+	ctx    context.Context
+	mc     chan *TaskData
+	codec  Codec
+	reader io.Reader
+	meta   KeyValueConf
+}
+
+func (ss *StdinSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger, reader io.Reader) {
+	ss.conf = conf
+	ss.log = log
+	ss.ctx = ctx
+	ss.reader = reader
+	ss.meta = conf.Metadata.GetKeyValueConf("meta")
+	ss.codec = newSourceCodec(conf, ctx, log)
+	if ss.codec == nil && conf.Metadata.GetStringOrDefault("format", "jsonl") == "jsonl" {
+		ss.codec = &JsonCodec{}
+	}
+	ss.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	go ss.run()
+}
+
+func (ss *StdinSource) Read() <-chan *TaskData {
+	return ss.mc
+}
+
+func (ss *StdinSource) run() {
+	defer close(ss.mc)
+	// reading stdin can not be cancelled, the reader is left behind when the task stops
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(ss.reader)
+		scanner.Buffer(make([]byte, 64*1024), util.MaxInt(ss.conf.Metadata.GetInt("maxLineSize"), 1<<20))
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ss.ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			ss.log.Error("read stdin failed", ss.tag(), zap.Error(err))
+		}
+	}()
+	var n int64
+	for {
+		var line string
+		var ok bool
+		select {
+		case <-ss.ctx.Done():
+			return
+		case line, ok = <-lines:
+			if !ok {
+				return
+			}
+		}
+		n++
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		meta := KeyValueConf{"line": n}
+		for k, v := range ss.meta {
+			meta[k] = v
+		}
+		dt := &TaskData{Payload: []byte(line), Metadata: meta}
+		decodePayload(ss.codec, dt, ss.log)
+		select {
+		case ss.mc <- dt:
+		case <-ss.ctx.Done():
+			return
+		}
+	}
+}
+
+func (ss *StdinSource) tag() zap.Field {
+	return zap.String("tag", "StdinSource")
+}
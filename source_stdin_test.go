@@ -0,0 +1,55 @@
+package job
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStdinSource(t *testing.T) {
+	ss := &StdinSource{}
+	ss.init(&SourceConf{Type: "stdin", Metadata: KeyValueConf{
+		"meta": map[interface{}]interface{}{"topic": "import"},
+	}}, context.Background(), zap.NewNop(), strings.NewReader("{\"id\":1}\n\n  \n{\"id\":2}\n"))
+	var lines []int64
+	for dt := range ss.Read() {
+		item, ok := dt.Payload.(map[string]interface{})
+		if !ok || item["id"] == nil || dt.Metadata["topic"] != "import" {
+			t.Fatalf("data %#v %v", dt.Payload, dt.Metadata)
+		}
+		lines = append(lines, dt.Metadata["line"].(int64))
+	}
+	// blank lines are skipped but counted
+	if len(lines) != 2 || lines[0] != 1 || lines[1] != 4 {
+		t.Fatalf("lines %v", lines)
+	}
+}
+
+func TestStdinSourceLines(t *testing.T) {
+	ss := &StdinSource{}
+	ss.init(&SourceConf{Type: "stdin", Metadata: KeyValueConf{"format": "line"}}, context.Background(), zap.NewNop(),
+		strings.NewReader("plain text\nnot {json"))
+	var got []string
+	for dt := range ss.Read() {
+		got = append(got, string(dt.Payload.([]byte)))
+	}
+	if len(got) != 2 || got[0] != "plain text" || got[1] != "not {json" {
+		t.Fatalf("lines %q", got)
+	}
+}
+
+func TestStdinSourceStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// a reader which never returns, like an idle terminal
+	r, w := io.Pipe()
+	defer w.Close()
+	ss := &StdinSource{}
+	ss.init(&SourceConf{Type: "stdin", Metadata: KeyValueConf{}}, ctx, zap.NewNop(), r)
+	cancel()
+	if _, ok := <-ss.Read(); ok {
+		t.Fatal("data after the task stopped")
+	}
+}
@@ -0,0 +1,446 @@
+package job
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/ywengineer/g-util/util"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterSource("syslog", func(conf *SourceConf, ctx context.Context, log *zap.Logger) Source {
+		s := &SyslogSource{}
+		s.init(conf, ctx, log)
+		return s
+	})
+}
+
+const (
+	SyslogAuto    = "auto"
+	SyslogRFC3164 = "rfc3164"
+	SyslogRFC5424 = "rfc5424"
+)
+
+var syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron",
+	"authpriv", "ftp", "ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4",
+	"local5", "local6", "local7"}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// SyslogSource receives syslog messages over udp and tcp (optionally tls), and parses RFC3164 or RFC5424
+// messages into maps with facility, severity, timestamp, hostname, app, procId, msgId, structuredData and msg.
+// tcp accepts both octet counting and newline framing.
+type SyslogSource struct {
+	conf      *SourceConf
+	log       *zap.Logger
+	ctx       context.Context
+	mc        chan *TaskData
+	format    string
+	maxSize   int
+	udp       net.PacketConn
+	tcp       net.Listener
+	transport string
+	running   sync.WaitGroup
+	closeMu   sync.RWMutex
+	closed    bool
+}
+
+func (ss *SyslogSource) init(conf *SourceConf, ctx context.Context, log *zap.Logger) {
+	ss.conf = conf
+	ss.log = log
+	ss.ctx = ctx
+	ss.format = conf.Metadata.GetStringOrDefault("format", SyslogAuto)
+	switch ss.format {
+	case SyslogAuto, SyslogRFC3164, SyslogRFC5424:
+	default:
+		log.Panic("unsupported format for SyslogSource", ss.tag(), zap.String("format", ss.format))
+	}
+	ss.maxSize = conf.Metadata.GetInt("maxMessageSize")
+	if ss.maxSize <= 0 {
+		ss.maxSize = 64 * 1024
+	}
+	ss.mc = make(chan *TaskData, util.MaxInt(conf.Metadata.GetInt("buffer"), 0))
+	//
+	udpAddress := conf.Metadata.GetString("udp")
+	tcpAddress := conf.Metadata.GetString("tcp")
+	if len(udpAddress) == 0 && len(tcpAddress) == 0 {
+		udpAddress = ":514"
+	}
+	if len(udpAddress) > 0 {
+		pc, err := net.ListenPacket("udp", udpAddress)
+		if err != nil {
+			log.Panic("listen syslog udp failed", ss.tag(), zap.String("address", udpAddress), zap.Error(err))
+		}
+		ss.udp = pc
+		ss.running.Add(1)
+		go ss.serveUDP()
+	}
+	if len(tcpAddress) > 0 {
+		l, err := net.Listen("tcp", tcpAddress)
+		if err != nil {
+			log.Panic("listen syslog tcp failed", ss.tag(), zap.String("address", tcpAddress), zap.Error(err))
+		}
+		ss.transport = "tcp"
+		if tc := newTLSConfig(conf.Metadata.GetKeyValueConf("tls"), log); tc != nil {
+			if len(tc.Certificates) == 0 {
+				log.Panic("missing tls cert config for SyslogSource", ss.tag())
+			}
+			if tc.ClientCAs != nil {
+				tc.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			l = tls.NewListener(l, tc)
+			ss.transport = "tls"
+		}
+		ss.tcp = l
+		ss.running.Add(1)
+		go ss.serveTCP()
+	}
+	log.Info("syslog source started", ss.tag(), zap.String("udp", udpAddress), zap.String("tcp", tcpAddress), zap.String("format", ss.format))
+	go func() {
+		<-ctx.Done()
+		if ss.udp != nil {
+			_ = ss.udp.Close()
+		}
+		if ss.tcp != nil {
+			_ = ss.tcp.Close()
+		}
+		ss.running.Wait()
+		ss.closeMu.Lock()
+		ss.closed = true
+		close(ss.mc)
+		ss.closeMu.Unlock()
+	}()
+}
+
+func (ss *SyslogSource) Read() <-chan *TaskData {
+	return ss.mc
+}
+
+func (ss *SyslogSource) serveUDP() {
+	defer ss.running.Done()
+	buf := make([]byte, ss.maxSize)
+	var delay time.Duration
+	for {
+		n, addr, err := ss.udp.ReadFrom(buf)
+		if err != nil {
+			if ss.retry("read syslog udp failed", err, &delay) {
+				continue
+			}
+			return
+		}
+		delay = 0
+		ss.send(buf[:n], addr, "udp")
+	}
+}
+
+func (ss *SyslogSource) serveTCP() {
+	defer ss.running.Done()
+	var delay time.Duration
+	for {
+		conn, err := ss.tcp.Accept()
+		if err != nil {
+			if ss.retry("accept syslog connection failed", err, &delay) {
+				continue
+			}
+			return
+		}
+		delay = 0
+		ss.running.Add(1)
+		go ss.serveConn(conn)
+	}
+}
+
+// retry waits a growing delay after a temporary error like net/http.Server, false once the source is stopped
+// or the error is permanent, e.g. the listener is closed.
+func (ss *SyslogSource) retry(msg string, err error, delay *time.Duration) bool {
+	if ss.ctx.Err() != nil {
+		return false
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+		ss.log.Error(msg+", listener stopped", ss.tag(), zap.Error(err))
+		return false
+	}
+	if *delay == 0 {
+		*delay = 5 * time.Millisecond
+	} else if *delay *= 2; *delay > time.Second {
+		*delay = time.Second
+	}
+	ss.log.Error(msg, ss.tag(), zap.Error(err), zap.Duration("delay", *delay))
+	select {
+	case <-ss.ctx.Done():
+		return false
+	case <-time.After(*delay):
+		return true
+	}
+}
+
+func (ss *SyslogSource) serveConn(conn net.Conn) {
+	defer ss.running.Done()
+	finished := make(chan bool)
+	defer close(finished)
+	go func() {
+		select {
+		case <-ss.ctx.Done():
+		case <-finished:
+		}
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReaderSize(conn, 4096)
+	for {
+		frame, err := ss.readFrame(reader)
+		if len(frame) > 0 {
+			ss.send(frame, conn.RemoteAddr(), ss.transport)
+		}
+		if err != nil {
+			if err != io.EOF && ss.ctx.Err() == nil {
+				ss.log.Warn("read syslog connection failed", ss.tag(), zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// readFrame reads an octet counted frame (RFC6587 "LEN SP MSG"), or a newline terminated one.
+func (ss *SyslogSource) readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		head, err := reader.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(head))
+		if err != nil || size > ss.maxSize {
+			return nil, errors.New("bad octet counting frame length " + head)
+		}
+		frame := make([]byte, size)
+		_, err = io.ReadFull(reader, frame)
+		return frame, err
+	}
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// a long line, read the rest up to the max message size
+		long := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(long) < ss.maxSize {
+			line, err = reader.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("syslog message exceeds max message size")
+		}
+		line = long
+	}
+	return bytes.TrimRight(line, "\r\n\x00"), err
+}
+
+func (ss *SyslogSource) send(data []byte, remote net.Addr, transport string) {
+	item, err := parseSyslog(data, ss.format)
+	if err != nil {
+		ss.log.Debug("parse syslog message failed", ss.tag(), zap.ByteString("data", data), zap.Error(err))
+		item = map[string]interface{}{"msg": string(data)}
+	}
+	host := remote.String()
+	if h, _, e := net.SplitHostPort(host); e == nil {
+		host = h
+	}
+	if _, ok := item["hostname"]; !ok {
+		item["hostname"] = host
+	}
+	meta := KeyValueConf{
+		"remote":    remote.String(),
+		"transport": transport,
+	}
+	for _, k := range []string{"hostname", "app", "facility", "severity"} {
+		if v, ok := item[k]; ok {
+			meta[k] = v
+		}
+	}
+	ss.closeMu.RLock()
+	defer ss.closeMu.RUnlock()
+	if ss.closed {
+		return
+	}
+	select {
+	case ss.mc <- &TaskData{Payload: item, Metadata: meta}:
+	case <-ss.ctx.Done():
+	}
+}
+
+func (ss *SyslogSource) tag() zap.Field {
+	return zap.String("tag", "SyslogSource")
+}
+
+// parseSyslog parses a RFC3164 or RFC5424 message, auto detects by the version after the priority.
+func parseSyslog(data []byte, format string) (map[string]interface{}, error) {
+	s := strings.TrimRight(string(data), "\r\n\x00")
+	if len(s) < 3 || s[0] != '<' {
+		return nil, errors.New("missing priority")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("bad priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return nil, errors.New("bad priority")
+	}
+	item := map[string]interface{}{
+		"priority": pri,
+		"facility": syslogFacilities[pri/8],
+		"severity": syslogSeverities[pri%8],
+	}
+	rest := s[end+1:]
+	if format == SyslogRFC5424 || (format == SyslogAuto && len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ') {
+		return item, parseRFC5424(rest, item)
+	}
+	parseRFC3164(rest, item)
+	return item, nil
+}
+
+// parseRFC5424 parses VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseRFC5424(s string, item map[string]interface{}) error {
+	fields := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		sp := strings.IndexByte(s, ' ')
+		if sp < 0 {
+			return errors.New("incomplete rfc5424 header")
+		}
+		fields = append(fields, s[:sp])
+		s = s[sp+1:]
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return errors.New("bad rfc5424 version")
+	}
+	item["version"] = version
+	if fields[1] != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			return err
+		}
+		item["timestamp"] = ts
+	}
+	for i, k := range []string{"hostname", "app", "procId", "msgId"} {
+		if fields[i+2] != "-" {
+			item[k] = fields[i+2]
+		}
+	}
+	sd, msg, err := parseStructuredData(s)
+	if err != nil {
+		return err
+	}
+	if sd != nil {
+		item["structuredData"] = sd
+	}
+	msg = strings.TrimPrefix(msg, "\ufeff")
+	item["msg"] = msg
+	return nil
+}
+
+// parseStructuredData parses [id name="value" ...] elements, and returns the message after them.
+func parseStructuredData(s string) (map[string]interface{}, string, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, strings.TrimPrefix(s[1:], " "), nil
+	}
+	sd := make(map[string]interface{})
+	for strings.HasPrefix(s, "[") {
+		end := -1
+		quoted := false
+		for i := 1; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && quoted {
+				i++
+			} else if c == '"' {
+				quoted = !quoted
+			} else if c == ']' && !quoted {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, "", errors.New("unterminated structured data")
+		}
+		element := s[1:end]
+		s = s[end+1:]
+		id := element
+		params := make(map[string]interface{})
+		if sp := strings.IndexByte(element, ' '); sp >= 0 {
+			id = element[:sp]
+			element = element[sp+1:]
+			for len(element) > 0 {
+				element = strings.TrimLeft(element, " ")
+				eq := strings.Index(element, `="`)
+				if eq < 0 {
+					return nil, "", errors.New("bad structured data param")
+				}
+				name := element[:eq]
+				element = element[eq+2:]
+				var value strings.Builder
+				i := 0
+				for ; i < len(element) && element[i] != '"'; i++ {
+					if element[i] == '\\' && i+1 < len(element) {
+						i++
+					}
+					value.WriteByte(element[i])
+				}
+				if i >= len(element) {
+					return nil, "", errors.New("unterminated structured data param")
+				}
+				params[name] = value.String()
+				element = element[i+1:]
+			}
+		}
+		sd[id] = params
+	}
+	return sd, strings.TrimPrefix(s, " "), nil
+}
+
+// parseRFC3164 parses the BSD format TIMESTAMP HOSTNAME TAG[PID]: MSG, leniently, parts may be missing.
+func parseRFC3164(s string, item map[string]interface{}) {
+	if len(s) >= 15 {
+		if ts, err := time.ParseInLocation(time.Stamp, s[:15], time.Local); err == nil {
+			now := time.Now()
+			ts = ts.AddDate(now.Year(), 0, 0)
+			// a message from december received in january
+			if ts.After(now.Add(24 * time.Hour)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			item["timestamp"] = ts
+			s = strings.TrimPrefix(s[15:], " ")
+			if sp := strings.IndexByte(s, ' '); sp > 0 && !strings.HasSuffix(s[:sp], ":") {
+				item["hostname"] = s[:sp]
+				s = s[sp+1:]
+			}
+		}
+	}
+	// the tag is alphanumeric up to 32 chars, followed by [pid] or a colon
+	for i := 0; i < len(s) && i <= 48; i++ {
+		c := s[i]
+		if c == '[' {
+			if end := strings.IndexByte(s[i:], ']'); end > 0 {
+				item["app"] = s[:i]
+				item["procId"] = s[i+1 : i+end]
+				s = strings.TrimPrefix(s[i+end+1:], ":")
+			}
+			break
+		} else if c == ':' {
+			item["app"] = s[:i]
+			s = s[i+1:]
+			break
+		} else if c == ' ' {
+			break
+		}
+	}
+	item["msg"] = strings.TrimPrefix(s, " ")
+}
@@ -0,0 +1,120 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseSyslog(t *testing.T) {
+	ts, _ := time.Parse(time.RFC3339Nano, "2003-10-11T22:14:15.003Z")
+	cases := []struct {
+		name   string
+		data   string
+		format string
+		want   map[string]interface{}
+		err    bool
+	}{
+		{
+			name: "rfc5424 without structured data",
+			data: "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \ufeff'su root' failed for lonvick\n",
+			want: map[string]interface{}{"priority": 34, "facility": "auth", "severity": "crit", "version": 1, "timestamp": ts,
+				"hostname": "mymachine.example.com", "app": "su", "msgId": "ID47", "msg": "'su root' failed for lonvick"},
+		},
+		{
+			name: "rfc5424 with structured data",
+			data: `<165>1 - host app 1234 - [exampleSDID@32473 iut="3" eventSource="Application"][meta seq="1"] started`,
+			want: map[string]interface{}{"priority": 165, "facility": "local4", "severity": "notice", "version": 1,
+				"hostname": "host", "app": "app", "procId": "1234", "msg": "started", "structuredData": map[string]interface{}{
+					"exampleSDID@32473": map[string]interface{}{"iut": "3", "eventSource": "Application"},
+					"meta":              map[string]interface{}{"seq": "1"},
+				}},
+		},
+		{
+			name: "rfc5424 with escaped structured data values",
+			data: `<13>1 - - - - - [x a="q\"uote" b="br\]acket" c="back\\slash"]`,
+			want: map[string]interface{}{"priority": 13, "facility": "user", "severity": "notice", "version": 1, "msg": "",
+				"structuredData": map[string]interface{}{"x": map[string]interface{}{"a": `q"uote`, "b": "br]acket", "c": `back\slash`}}},
+		},
+		{
+			name:   "rfc5424 unterminated structured data",
+			data:   `<13>1 - - - - - [x a="1"`,
+			format: SyslogRFC5424,
+			err:    true,
+		},
+		{
+			name: "rfc3164 without a year",
+			data: "<13>Feb  5 17:32:18 10.0.0.99 myapp[42]: Use the BFG!",
+			want: map[string]interface{}{"priority": 13, "facility": "user", "severity": "notice",
+				"hostname": "10.0.0.99", "app": "myapp", "procId": "42", "msg": "Use the BFG!"},
+		},
+		{
+			name: "rfc3164 without timestamp",
+			data: "<0>kernel: panic",
+			want: map[string]interface{}{"priority": 0, "facility": "kern", "severity": "emerg", "app": "kernel", "msg": "panic"},
+		},
+		{name: "missing priority", data: "hello", err: true},
+		{name: "priority out of range", data: "<192>1 - - - - - -", err: true},
+		{name: "priority not a number", data: "<1a>hello", err: true},
+		{name: "priority not terminated", data: "<13 hello", err: true},
+	}
+	for _, c := range cases {
+		format := c.format
+		if len(format) == 0 {
+			format = SyslogAuto
+		}
+		item, err := parseSyslog([]byte(c.data), format)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: no error, item %v", c.name, item)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got, ok := item["timestamp"].(time.Time); ok && c.want["timestamp"] == nil {
+			// the year of a rfc3164 timestamp is the current one
+			if got.Month() != time.February || got.Day() != 5 || got.Year() < time.Now().Year()-1 {
+				t.Errorf("%s: timestamp %v", c.name, got)
+			}
+			delete(item, "timestamp")
+		}
+		if !reflect.DeepEqual(item, c.want) {
+			t.Errorf("%s:\n got %v\nwant %v", c.name, item, c.want)
+		}
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestSyslogRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ss := &SyslogSource{log: zap.NewNop(), ctx: ctx}
+	var delay time.Duration
+	for i := 0; i < 3; i++ {
+		if !ss.retry("read failed", temporaryError{}, &delay) {
+			t.Fatal("temporary error not retried")
+		}
+	}
+	if delay != 20*time.Millisecond {
+		t.Fatalf("delay %v, want a growing backoff", delay)
+	}
+	if ss.retry("read failed", &net.OpError{Op: "read", Err: errors.New("use of closed network connection")}, &delay) {
+		t.Fatal("permanent error retried")
+	}
+	cancel()
+	if ss.retry("read failed", temporaryError{}, &delay) {
+		t.Fatal("retried after the source stopped")
+	}
+}
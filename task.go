@@ -4,12 +4,104 @@ import (
 	"context"
 	"github.com/ywengineer/g-util/util"
 	"go.uber.org/zap"
+	"io"
 	"sync"
 )
 
 type TaskData struct {
 	Payload  interface{}
 	Metadata KeyValueConf
+	ctx      context.Context
+	done     func()
+	fail     func()
+	hold     *taskHold
+}
+
+// taskHold counts the sinks which have not persisted the data yet, done waits for them.
+type taskHold struct {
+	mu     sync.Mutex
+	count  int
+	failed bool
+	done   func()
+	fail   func()
+}
+
+// Context returns the context bound by the source. the data is dropped by the task once the context is done.
+func (td *TaskData) Context() context.Context {
+	if td.ctx == nil {
+		return context.Background()
+	}
+	return td.ctx
+}
+
+// Done notifies the source that the data has passed through all filters and sinks.
+// the notification is deferred while the data is held by a sink, and turns into Fail if a sink failed to persist it.
+func (td *TaskData) Done() {
+	td.notify(false)
+}
+
+// Fail notifies the source that the data is not persisted, e.g. a filter or sink panicked. the source does not
+// acknowledge the data, it is delivered again by sources which can, e.g. kafka after a rebalance or restart.
+func (td *TaskData) Fail() {
+	td.notify(true)
+}
+
+func (td *TaskData) notify(failed bool) {
+	if td.done == nil && td.fail == nil {
+		return
+	}
+	done, fail := td.done, td.fail
+	td.done, td.fail = nil, nil
+	if h := td.hold; h != nil {
+		h.mu.Lock()
+		h.failed = h.failed || failed
+		if h.count > 0 {
+			h.done, h.fail = done, fail
+			h.mu.Unlock()
+			return
+		}
+		failed = h.failed
+		h.mu.Unlock()
+	}
+	notifySource(done, fail, failed)
+}
+
+func notifySource(done, fail func(), failed bool) {
+	if failed {
+		if fail != nil {
+			fail()
+		}
+	} else if done != nil {
+		done()
+	}
+}
+
+// Hold is called by a sink which persists the data later, e.g. with a batch upload. the source is not notified
+// by Done until every returned release has been called, a release with an error fails the data.
+func (td *TaskData) Hold() (release func(err error)) {
+	if td.hold == nil {
+		td.hold = &taskHold{}
+	}
+	h := td.hold
+	h.mu.Lock()
+	h.count++
+	h.mu.Unlock()
+	once := sync.Once{}
+	return func(err error) {
+		once.Do(func() {
+			h.mu.Lock()
+			h.count--
+			h.failed = h.failed || err != nil
+			done, fail, failed := h.done, h.fail, h.failed
+			if h.count > 0 {
+				done, fail = nil, nil
+			} else {
+				h.done, h.fail = nil, nil
+			}
+			h.mu.Unlock()
+			notifySource(done, fail, failed)
+		})
+	}
 }
 
 type Task struct {
@@ -24,6 +116,7 @@ type Task struct {
 	sinks      []Sink
 	sinkSize   int
 	stopChan   chan bool
+	err        error
 	runState   sync.Once
 	stopMu     sync.Mutex
 }
@@ -57,6 +150,19 @@ func (task *Task) _Run() {
 	}
 	//
 	wg.Wait()
+	if f, ok := task.source.(Failable); ok {
+		if task.err = f.Err(); task.err != nil {
+			task.log.Error("task source failed.", zap.Any("desc", task.conf.Desc), zap.Error(task.err))
+		}
+	}
+	// no more data, sinks holding resources flush and release them
+	for _, sink := range task.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				task.log.Error("close sink failed.", zap.Any("desc", task.conf.Desc), zap.Error(err))
+			}
+		}
+	}
 	task.log.Info("task finished.", zap.Any("desc", task.conf.Desc))
 	close(task.stopChan)
 }
@@ -66,16 +172,7 @@ func (task *Task) run() {
 		select {
 		case data, ok := <-task.source.Read():
 			if ok {
-				if task.filterSize > 0 {
-					for _, filter := range task.filters {
-						filter.DoFilter(data)
-					}
-				}
-				if task.sinkSize > 0 {
-					for _, sink := range task.sinks {
-						sink.DoSink(data)
-					}
-				}
+				task.process(data)
 			} else {
 				return
 			}
@@ -83,6 +180,33 @@ func (task *Task) run() {
 	}
 }
 
+// process passes the data through the filters and sinks. the source is always notified, the data fails if a filter
+// or sink panics, so it is not acknowledged.
+func (task *Task) process(data *TaskData) {
+	defer func() {
+		if err := recover(); err != nil {
+			task.log.Error("catch panic event.", zap.Any("desc", task.conf.Desc), zap.Any("err", err), zap.Any("meta", data.Metadata))
+			data.Fail()
+			return
+		}
+		data.Done()
+	}()
+	if data.Context().Err() != nil {
+		task.log.Debug("drop cancelled data", zap.Any("data", data.Metadata))
+		return
+	}
+	if task.filterSize > 0 {
+		for _, filter := range task.filters {
+			filter.DoFilter(data)
+		}
+	}
+	if task.sinkSize > 0 {
+		for _, sink := range task.sinks {
+			sink.DoSink(data)
+		}
+	}
+}
+
 func (task *Task) Stop() <-chan bool {
 	task.stopMu.Lock()
 	defer task.stopMu.Unlock()
@@ -122,3 +246,34 @@ func NewTask(conf TaskConf, parentCtx context.Context, log *zap.Logger) *Task {
 	}
 	return task
 }
+
+// Pause stops the task source from fetching new data. it returns false when the source is not Pausable.
+func (task *Task) Pause() bool {
+	if p, ok := task.source.(Pausable); ok {
+		p.Pause()
+		return true
+	}
+	return false
+}
+
+// Resume restarts a paused task source. it returns false when the source is not Pausable.
+func (task *Task) Resume() bool {
+	if p, ok := task.source.(Pausable); ok {
+		p.Resume()
+		return true
+	}
+	return false
+}
+
+// Err returns the error stopping the task source, nil if the source is not Failable or finished normally.
+// it is only set after the task finished.
+func (task *Task) Err() error {
+	return task.err
+}
+
+func (task *Task) Paused() bool {
+	if p, ok := task.source.(Pausable); ok {
+		return p.Paused()
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type panicSink struct{}
+
+func (panicSink) DoSink(message *TaskData) {
+	panic("sink failed")
+}
+
+func TestTaskProcessFailAfterPanic(t *testing.T) {
+	task := &Task{log: zap.NewNop(), sinks: []Sink{panicSink{}}, sinkSize: 1}
+	done, failed := 0, 0
+	task.process(&TaskData{Payload: "x", done: func() { done++ }, fail: func() { failed++ }})
+	// a panicked message is never acknowledged
+	if done != 0 || failed != 1 {
+		t.Fatalf("done %d, failed %d", done, failed)
+	}
+}
+
+func TestTaskDataHold(t *testing.T) {
+	done := 0
+	data := &TaskData{done: func() { done++ }}
+	release := data.Hold()
+	data.Done()
+	if done != 0 {
+		t.Fatal("done notified while held")
+	}
+	release(nil)
+	release(nil)
+	if done != 1 {
+		t.Fatalf("done called %d times, want 1", done)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task := &Task{log: zap.NewNop(), sinks: []Sink{panicSink{}}, sinkSize: 1}
+	task.process(&TaskData{ctx: ctx, done: func() { done++ }})
+	if done != 2 {
+		t.Fatal("cancelled data not released")
+	}
+}
+
+func TestTaskDataHoldFailed(t *testing.T) {
+	done, failed := 0, 0
+	data := &TaskData{done: func() { done++ }, fail: func() { failed++ }}
+	first, second := data.Hold(), data.Hold()
+	data.Done()
+	first(errors.New("upload failed"))
+	if done != 0 || failed != 0 {
+		t.Fatal("notified while held")
+	}
+	second(nil)
+	if done != 0 || failed != 1 {
+		t.Fatalf("done %d, failed %d, want the data failed by one sink", done, failed)
+	}
+}
+
+type failedSource struct {
+	mc chan *TaskData
+}
+
+func (fs *failedSource) Read() <-chan *TaskData {
+	return fs.mc
+}
+
+func (fs *failedSource) Err() error {
+	return errors.New("replication stopped")
+}
+
+func TestTaskSourceError(t *testing.T) {
+	source := &failedSource{mc: make(chan *TaskData)}
+	close(source.mc)
+	task := &Task{log: zap.NewNop(), source: source, stopChan: make(chan bool)}
+	task.Run()
+	if err := task.Err(); err == nil || err.Error() != "replication stopped" {
+		t.Fatalf("task error %v", err)
+	}
+}